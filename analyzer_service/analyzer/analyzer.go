@@ -1,8 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
 	"os"
@@ -10,31 +12,85 @@ import (
 	"regexp"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"common/classify"
+	"common/elfinfo"
+	"common/hashes"
+	"common/history"
+	"common/migrations"
+	"common/similarity"
+	"common/snapshot"
+	"common/store"
+	"common/views"
+
 	"github.com/joho/godotenv"
 	_ "github.com/lib/pq"
 )
 
+// Actor of the changes the analyzer records in the status history.
+const historyActor = "analyzer"
+
+// Number of files table rows inserted or updated by all batches.
+var filesChanged int64
+
+// Set by --snapshot: files are only classified, nothing is stored.
+var offline bool
+
+// Directory the batch reports are written to, per host.
+var reportsDir string
+
+// Lookup filter metrics of all batches.
+var (
+	filterMu      sync.Mutex
+	filterMetrics store.FilterMetrics
+)
+
 type ScannedFiles struct {
-	Name       string `json:"name"`
-	Path       string `json:"path"`
-	Size       int    `json:"size"`
-	Owner      string `json:"owner"`
-	Perm       string `json:"perm"`
-	Accessed   string `json:"accessed"`
-	Created    string `json:"created"`
-	Group      string `json:"group"`
-	Modified   string `json:"modified"`
-	MD5        string `json:"MD5"`
-	SHA1       string `json:"SHA1"`
-	SHA256     string `json:"SHA256"`
-	SHA512     string `json:"SHA512"`
-	FileStatus string `json:"fileStatus"`
+	Name        string            `json:"name"`
+	Path        string            `json:"path"`
+	Container   string            `json:"container,omitempty"`
+	Size        int               `json:"size"`
+	Owner       string            `json:"owner"`
+	Perm        string            `json:"perm"`
+	Accessed    string            `json:"accessed"`
+	Created     string            `json:"created"`
+	Group       string            `json:"group"`
+	Modified    string            `json:"modified"`
+	Hashes      map[string]string `json:"hashes,omitempty"`
+	MD5         string            `json:"MD5,omitempty"`
+	SHA1        string            `json:"SHA1,omitempty"`
+	SHA256      string            `json:"SHA256,omitempty"`
+	SHA512      string            `json:"SHA512,omitempty"`
+	FileStatus  string            `json:"fileStatus"`
+	Family      string            `json:"family,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	FirstSeen   string            `json:"firstSeen,omitempty"`
+	ThreatLabel string            `json:"threatLabel,omitempty"`
+	Similar     *SimilarFile      `json:"similar,omitempty"`
+	ELF         *elfinfo.Info     `json:"elf,omitempty"`
+}
+
+// SimilarFile is the known malicious file a suspicious-similar candidate
+// is closest to. Score is the TLSH distance or the ssdeep score.
+type SimilarFile struct {
+	Path        string            `json:"path,omitempty"`
+	Hashes      map[string]string `json:"hashes"`
+	Family      string            `json:"family,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	ThreatLabel string            `json:"threatLabel,omitempty"`
+	Algorithm   string            `json:"algorithm"`
+	Score       int               `json:"score"`
 }
 
 type Metadata struct {
-	IPv4Address string `json:"ip_address"`
+	IPv4Address    string `json:"ip_address"`
+	ScanID         string `json:"scan_id,omitempty"`
+	Profile        string `json:"profile,omitempty"`
+	ProfileVersion string `json:"profile_version,omitempty"`
+	// Directories the agent scanned.
+	Directories []string `json:"directories,omitempty"`
 }
 
 type ScanRequest struct {
@@ -44,132 +100,233 @@ type ScanRequest struct {
 }
 
 type Report struct {
-	Metadata       Metadata       `json:"metadata"`
-	VerifiedFiles  []ScannedFiles `json:"verifiedFiles"`
-	CandidateFiles []ScannedFiles `json:"candidateFiles"`
-	MaliciousFiles []ScannedFiles `json:"maliciousFiles"`
-	MaliciousVars  []string       `json:"maliciousVariables"`
+	Metadata       Metadata             `json:"metadata"`
+	VerifiedFiles  []ScannedFiles       `json:"verifiedFiles"`
+	CandidateFiles []ScannedFiles       `json:"candidateFiles"`
+	MaliciousFiles []ScannedFiles       `json:"maliciousFiles"`
+	MaliciousVars  []string             `json:"maliciousVariables"`
+	LookupFilter   *store.FilterMetrics `json:"lookupFilter,omitempty"`
 }
 
-func checkHashes(files *[]ScannedFiles, db *sql.DB) (*[]ScannedFiles, *[]ScannedFiles, *[]ScannedFiles, error) {
+// checkHashes classifies files by the status of the known files matching
+// them, and flags candidates similar to those of index. With a filter,
+// only files it may know are looked up and metrics counts how often it
+// was right.
+func checkHashes(files *[]ScannedFiles, metadata *Metadata, st store.KnownHashStore, filter *store.Filter, metrics *store.FilterMetrics, index *similarity.Index) (*[]ScannedFiles, *[]ScannedFiles, *[]ScannedFiles, error) {
 	var verifiedFiles []ScannedFiles
 	var maliciousFiles []ScannedFiles
 	var candidateFiles []ScannedFiles
 
+	ctx := context.Background()
+	var valid []ScannedFiles
+	var lookups []store.Hashes
 	for _, file := range *files {
-		fileStatus := checkIfFileExists(&file, db)
+		h, err := store.HashesOf(file.Hashes)
+		if err != nil {
+			log.Printf("error decoding hashes of %v: \n%v", file.Path, err)
+			file.FileStatus = "candidate"
+			flagSimilar(&file, index)
+			candidateFiles = append(candidateFiles, file)
+			continue
+		}
+		valid = append(valid, file)
+		lookups = append(lookups, h)
+	}
+
+	// A batch whose files could not be looked up is not reported at all,
+	// rather than without them.
+	matches, err := classify.Lookup(ctx, st, lookups, filter, metrics)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+
+	var sightings []store.Sighting
+	for i, file := range valid {
+		if matches[i].Invalid != nil {
+			log.Printf("error decoding hashes of %v: \n%v", file.Path, matches[i].Invalid)
+			file.FileStatus = "candidate"
+			flagSimilar(&file, index)
+			candidateFiles = append(candidateFiles, file)
+			continue
+		}
+		fileStatus := checkIfFileExists(&file, lookups[i], matches[i].Files, metadata, st)
+
+		if fileStatus == "none" && !offline {
+			outcome, err := insertNewFileData(&file, lookups[i], metadata, st)
+			if err != nil {
+				log.Println(err)
+			}
+			if err == nil && outcome != store.Inserted && matches[i].Filtered {
+				// The file was stored after the filter was loaded.
+				metrics.StaleMisses++
+				known, err := st.Lookup(ctx, lookups[i])
+				if err != nil {
+					log.Println(err)
+				}
+				fileStatus = checkIfFileExists(&file, lookups[i], known, metadata, st)
+			}
+			if filter != nil && err == nil {
+				filter.Add(lookups[i])
+			}
+		}
 
 		if fileStatus == "verified" {
+			// ELF facts are only of interest for unknown and
+			// malicious files.
 			file.FileStatus = "verified"
+			file.ELF = nil
 			verifiedFiles = append(verifiedFiles, file)
 		}
 		if fileStatus == "malicious" {
 			file.FileStatus = "malicious"
 			maliciousFiles = append(maliciousFiles, file)
 		}
-		if fileStatus == "candidate" {
+		// Similar candidates are recorded with their sightings, so they
+		// are never promoted.
+		var similarTo int64
+		if fileStatus == "candidate" || fileStatus == "none" {
 			file.FileStatus = "candidate"
+			similarTo = flagSimilar(&file, index)
 			candidateFiles = append(candidateFiles, file)
 		}
-		if fileStatus == "none" {
-			file.FileStatus = "candidate"
-			candidateFiles = append(candidateFiles, file)
-			err := insertNewFileData(&file, db)
-			if err != nil {
-				log.Println(err)
-			}
+		if file.FileStatus != "verified" {
+			sightings = append(sightings, store.Sighting{
+				Hashes:    lookups[i],
+				Path:      file.Path,
+				Host:      metadata.IPv4Address,
+				ScanID:    scanID(metadata),
+				SimilarTo: similarTo,
+			})
+		}
+	}
+
+	// Stores that do not keep sightings only classify files.
+	if recorder, ok := st.(store.SightingRecorder); ok && len(sightings) > 0 {
+		if err := recorder.RecordSightings(ctx, sightings); err != nil {
+			log.Println(err)
 		}
 	}
 
 	return &verifiedFiles, &maliciousFiles, &candidateFiles, nil
 }
 
-func checkIfFileExists(file *ScannedFiles, db *sql.DB) string {
-	stmt, err := db.Prepare(`
-		SELECT MD5, SHA1, SHA256, SHA512, status
-		FROM files
-		WHERE MD5 = $1 OR SHA1 = $2 OR SHA256 = $3 OR SHA512 = $4;
-	`)
-	if err != nil {
-		fmt.Errorf("error preparing query: \n%v", err)
-		return "none"
+// flagSimilar marks a candidate whose fuzzy digests are close to those of
+// a known malicious file as suspicious-similar, and returns the ID of that
+// file, or 0.
+func flagSimilar(file *ScannedFiles, index *similarity.Index) int64 {
+	if index == nil {
+		return 0
 	}
-
-	rows, err := stmt.Query(file.MD5, file.SHA1, file.SHA256, file.SHA512)
-	if err != nil {
-		fmt.Errorf("error executing query: \n%v", err)
-		return "none"
+	match, ok := index.Closest(file.Hashes)
+	if !ok {
+		return 0
+	}
+	similar := &SimilarFile{
+		Hashes:      match.File.Hashes().Map(),
+		Family:      match.File.Family,
+		Source:      match.File.Source,
+		ThreatLabel: match.File.ThreatLabel,
+		Algorithm:   match.Algorithm,
+		Score:       match.Score,
 	}
+	if len(match.File.Paths) > 0 {
+		similar.Path = match.File.Paths[0]
+	}
+	file.FileStatus = "suspicious-similar"
+	file.Similar = similar
+	return match.File.ID
+}
 
-	var existingHashes []ScannedFiles
-	for rows.Next() {
-		var scannedFile ScannedFiles
-		err := rows.Scan(
-			&scannedFile.MD5,
-			&scannedFile.SHA1,
-			&scannedFile.SHA256,
-			&scannedFile.SHA512,
-			&scannedFile.FileStatus,
-		)
-		if err != nil {
-			fmt.Errorf("error checking query results: \n%v", err)
-			return "none"
-		}
-		existingHashes = append(existingHashes, scannedFile)
-	}
-	rows.Close()
-	var result ScannedFiles
-	if len(existingHashes) > 0 {
-		result = existingHashes[0]
-		if result.MD5 == "" && file.MD5 != "" {
-			result.MD5 = file.MD5
+// normalizeHashes moves the digests of agents that send them in fields of
+// their own into Hashes, so reports only hold the Hashes.
+func normalizeHashes(file *ScannedFiles) {
+	for algorithm, digest := range map[string]string{"MD5": file.MD5, "SHA1": file.SHA1, "SHA256": file.SHA256, "SHA512": file.SHA512} {
+		if digest == "" {
+			continue
 		}
-		if result.SHA1 == "" && file.SHA1 != "" {
-			result.SHA1 = file.SHA1
+		if file.Hashes == nil {
+			file.Hashes = make(map[string]string)
 		}
-		if result.SHA256 == "" && file.SHA256 != "" {
-			result.SHA256 = file.SHA256
+		if file.Hashes[algorithm] == "" {
+			file.Hashes[algorithm] = digest
 		}
-		if result.SHA512 == "" && file.SHA512 != "" {
-			result.SHA512 = file.SHA512
-		}
-		_, err = db.Exec(`
-			UPDATE files
-			SET MD5 = $1, SHA1 = $2, SHA256 = $3, SHA512 = $4
-			WHERE filepath = $5;
-		`, result.MD5, result.SHA1, result.SHA256, result.SHA512, result.Path)
+	}
+	file.MD5, file.SHA1, file.SHA256, file.SHA512 = "", "", "", ""
+}
+
+// checkIfFileExists returns the status of the first known file matching
+// file, or none, and fills in the hashes the known file is missing.
+func checkIfFileExists(file *ScannedFiles, h store.Hashes, matches []store.File, metadata *Metadata, st store.KnownHashStore) string {
+	classified, known := classify.Classify(matches)
+	file.Family = classified.Family
+	file.Source = classified.Source
+	file.FirstSeen = classified.FirstSeen
+	file.ThreatLabel = classified.ThreatLabel
+	if len(matches) == 0 {
+		return "none"
+	}
+	result := matches[0]
+	missing := false
+	knownHashes := result.Hashes().Map()
+	for algorithm := range h.Map() {
+		missing = missing || knownHashes[algorithm] == ""
+	}
+	if !offline && missing {
+		// A failed backfill does not change how the file is classified.
+		backfill := store.File{Status: result.Status}
+		backfill.SetHashes(h)
+		outcome, err := st.Upsert(context.Background(), backfill, store.Change{
+			Actor:  historyActor,
+			Source: history.ScanSource(scanID(metadata)),
+			Reason: "hashes backfilled from " + metadata.IPv4Address,
+		})
 		if err != nil {
-			fmt.Errorf("error updating entry: \n%v", err)
-			return "none"
+			log.Printf("error updating entry: \n%v", err)
+		} else if outcome != store.Unchanged {
+			atomic.AddInt64(&filesChanged, 1)
 		}
 	}
-	if result.FileStatus == "" {
+	if !known {
 		return "none"
 	}
-	return result.FileStatus
+	return classified.Status
 }
 
-func insertNewFileData(file *ScannedFiles, db *sql.DB) error {
-	_, err := db.Exec(`
-		INSERT INTO files (MD5, SHA1, SHA256, SHA512, filesize, filepath, status)
-		VALUES ($1, $2, $3, $4, $5, $6, $7);
-	`, file.MD5, file.SHA1, file.SHA256, file.SHA512, file.Size, file.Path, "candidate")
+func insertNewFileData(file *ScannedFiles, h store.Hashes, metadata *Metadata, st store.KnownHashStore) (store.Outcome, error) {
+	size := int64(file.Size)
+	f := store.File{
+		Size:   &size,
+		Status: "candidate",
+	}
+	f.SetHashes(h)
+	if file.Path != "" {
+		f.Paths = []string{file.Path}
+	}
+	outcome, err := st.Upsert(context.Background(), f, store.Change{
+		Actor:  historyActor,
+		Source: history.ScanSource(scanID(metadata)),
+		Reason: "new file found on " + metadata.IPv4Address,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to insert new file data into files table: \n%v\nFile details:\nPath: %v\nSize: %v\nMD5: %v\nSHA1: %v\nSHA256: %v\nSHA512: %v", err, file.Path, file.Size, file.MD5, file.SHA1, file.SHA256, file.SHA512)
+		return outcome, fmt.Errorf("failed to insert new file data into files table: \n%v\nFile details:\nPath: %v\nSize: %v\nHashes: %v", err, file.Path, file.Size, file.Hashes)
 	}
-	return nil
+	if outcome != store.Unchanged {
+		atomic.AddInt64(&filesChanged, 1)
+	}
+	return outcome, nil
 }
 
-func saveReport(scanMetadata *Metadata, verifiedFiles *[]ScannedFiles, maliciousFiles *[]ScannedFiles, candidateFiles *[]ScannedFiles, maliciousVars *[]string) {
+func scanID(metadata *Metadata) string {
+	if metadata.ScanID == "" {
+		// Agents that do not send a scan ID are counted once per day.
+		return metadata.IPv4Address + "/" + time.Now().UTC().Format("2006-01-02")
+	}
+	return metadata.ScanID
+}
 
-	reportsDir := os.Getenv("REPORTS_DIR")
-	var report Report
-	report.Metadata = *scanMetadata
-	report.VerifiedFiles = *verifiedFiles
-	report.CandidateFiles = *candidateFiles
-	report.MaliciousFiles = *maliciousFiles
-	report.MaliciousVars = *maliciousVars
-	directory := fmt.Sprintf("%s/%s", reportsDir, scanMetadata.IPv4Address)
+// saveReport writes the report of the batch numbered batch.
+func saveReport(report *Report, batch int) {
+	directory := fmt.Sprintf("%s/%s", reportsDir, report.Metadata.IPv4Address)
 
 	err := os.MkdirAll(directory, 0755)
 
@@ -180,7 +337,7 @@ func saveReport(scanMetadata *Metadata, verifiedFiles *[]ScannedFiles, malicious
 
 	currentTime := time.Now()
 	timestamp := currentTime.Format("2006-01-02-15:04:05")
-	filnename := fmt.Sprintf("%s/report-%s.json", directory, timestamp)
+	filnename := fmt.Sprintf("%s/report-%s-%d.json", directory, timestamp, batch)
 
 	file, err := os.Create(filnename)
 	if err != nil {
@@ -199,11 +356,11 @@ func saveReport(scanMetadata *Metadata, verifiedFiles *[]ScannedFiles, malicious
 }
 
 func readJson() (*ScanRequest, error) {
-	if len(os.Args) < 2 {
+	if flag.NArg() < 1 {
 		return nil, fmt.Errorf("please provide a full path to data file")
 	}
 
-	filePath := os.Args[1]
+	filePath := flag.Arg(0)
 
 	data, err := os.ReadFile(filePath)
 	if err != nil {
@@ -216,6 +373,9 @@ func readJson() (*ScanRequest, error) {
 	if err != nil {
 		return nil, fmt.Errorf("error decoding JSON: %v", err)
 	}
+	for i := range request.Files {
+		normalizeHashes(&request.Files[i])
+	}
 
 	return &request, nil
 }
@@ -227,31 +387,56 @@ func main() {
 		os.Exit(1)
 	}
 
+	snapshotPath := flag.String("snapshot", "", "classify the scan against this snapshot instead of the database, without storing anything")
+	snapshotKey := flag.String("snapshot-key", "", "public key the snapshot is signed with (default SNAPSHOT_PUBLIC_KEY)")
+	flag.StringVar(&reportsDir, "reports-dir", "", "write the reports to this directory (default REPORTS_DIR)")
+	flag.Parse()
+	offline = *snapshotPath != ""
+
+	// Offline hosts may only have the snapshot and its key.
 	envPath := fmt.Sprintf("/home/%s/.sys-check/.env/analyzer.env", currentUser.Username)
 	err = godotenv.Load(envPath)
-	if err != nil {
+	if err != nil && !offline {
 		log.Fatal("Error loading .env file")
 	}
+	if reportsDir == "" {
+		reportsDir = os.Getenv("REPORTS_DIR")
+	}
+	if reportsDir == "" && offline {
+		reportsDir = fmt.Sprintf("/home/%s/.sys-check/reports", currentUser.Username)
+	}
+	if reportsDir == "" {
+		log.Fatal("REPORTS_DIR must be set in analyzer.env")
+	}
 
-	host := os.Getenv("DB_HOST")
-	port, _ := strconv.Atoi(os.Getenv("DB_PORT"))
-	dbName := os.Getenv("DB_NAME")
-	dbSchema := os.Getenv("DB_SCHEMA")
-	user := os.Getenv("DB_USER")
-	password := os.Getenv("DB_PASSWORD")
-
-	psqlInfo := fmt.Sprintf("host=%s port=%d dbname=%s search_path=%s user=%s password=%s sslmode=disable",
-		host, port, dbName, dbSchema, user, password)
-	db, err := sql.Open("postgres", psqlInfo)
+	var st store.KnownHashStore
+	if offline {
+		st, err = openSnapshot(*snapshotPath, *snapshotKey)
+	} else {
+		st, err = openStore()
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer db.Close()
+	defer st.Close()
 
-	if err := db.Ping(); err != nil {
-		log.Fatal(err)
+	// Without its filter the analyzer still works, it only queries the
+	// store for every file.
+	filter, err := loadFilter(st, currentUser.Username)
+	if err != nil {
+		log.Println("lookup filter disabled:", err)
 	}
 
+	// Without the index candidates are still reported, only never as
+	// similar to malware.
+	index, err := loadSimilarity(st)
+	if err != nil {
+		log.Println("similarity matching disabled:", err)
+	}
+
+	// Build IDs are only checked when servers are configured.
+	debuginfo := newDebuginfod()
+
 	scanData, err := readJson()
 	if err != nil {
 		log.Fatal(err)
@@ -263,11 +448,147 @@ func main() {
 	var wg sync.WaitGroup
 	wg.Add(len(batches))
 
-	for _, batch := range batches {
-		go process_batch(&batch, &scanData.Metadata, db, &wg)
+	reports := make([]*Report, len(batches))
+	errs := make([]error, len(batches))
+	for i := range batches {
+		go func(i int) {
+			defer wg.Done()
+			reports[i], errs[i] = process_batch(&batches[i], &scanData.Metadata, st, filter, index, debuginfo)
+		}(i)
 	}
 
 	wg.Wait()
+	// Reports are only saved once every batch was looked up, so the
+	// request fails and is sent again instead of leaving files out.
+	failed := 0
+	for _, err := range errs {
+		if err != nil {
+			log.Println("database query failed:", err)
+			failed++
+		}
+	}
+	if failed == 0 {
+		for i, report := range reports {
+			saveReport(report, i)
+		}
+	}
+	if filter != nil {
+		log.Printf("lookup filter: %d hits, %d misses, %d false positives, %d stale misses",
+			filterMetrics.Hits, filterMetrics.Misses, filterMetrics.FalsePositives, filterMetrics.StaleMisses)
+	}
+	if atomic.LoadInt64(&filesChanged) > 0 {
+		refresh(st)
+	}
+	if failed > 0 {
+		st.Close()
+		log.Fatalf("%d of %d batches failed, no report was saved", failed, len(batches))
+	}
+}
+
+// refresh refreshes data derived from the files of stores that keep any,
+// like the materialized views, once all batches are done.
+func refresh(st store.KnownHashStore) {
+	refresher, ok := st.(store.Refresher)
+	if !ok {
+		return
+	}
+	interval, err := views.Interval()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err := refresher.Refresh(context.Background(), interval); err != nil {
+		log.Println(err)
+	}
+}
+
+// loadFilter loads the lookup filter of stores that can feed one, unless
+// LOOKUP_FILTER is off. It is cached in LOOKUP_FILTER_CACHE between runs.
+func loadFilter(st store.KnownHashStore, username string) (*store.Filter, error) {
+	lister, ok := st.(store.HashLister)
+	if !ok || os.Getenv("LOOKUP_FILTER") == "off" {
+		return nil, nil
+	}
+	cachePath := os.Getenv("LOOKUP_FILTER_CACHE")
+	if cachePath == "" {
+		cachePath = fmt.Sprintf("/home/%s/.sys-check/cache/lookup-filter", username)
+	}
+	return store.LoadFilter(context.Background(), lister, cachePath)
+}
+
+// loadSimilarity indexes the fuzzy digests of the known malicious files of
+// stores that can list them, unless FUZZY_MATCHING is off.
+func loadSimilarity(st store.KnownHashStore) (*similarity.Index, error) {
+	lister, ok := st.(store.FuzzyLister)
+	if !ok || os.Getenv("FUZZY_MATCHING") == "off" {
+		return nil, nil
+	}
+	thresholds, err := similarity.ThresholdsFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	index, err := similarity.Load(context.Background(), lister, thresholds)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("similarity matching against %d malicious files", index.Len())
+	return index, nil
+}
+
+func openSnapshot(path, keyPath string) (store.KnownHashStore, error) {
+	if keyPath == "" {
+		keyPath = os.Getenv("SNAPSHOT_PUBLIC_KEY")
+	}
+	if keyPath == "" {
+		return nil, fmt.Errorf("--snapshot-key or SNAPSHOT_PUBLIC_KEY must name the public key of the snapshot")
+	}
+	key, err := snapshot.LoadPublicKey(keyPath)
+	if err != nil {
+		return nil, err
+	}
+	snap, err := snapshot.Open(path, key)
+	if err != nil {
+		return nil, err
+	}
+	header := snap.Header()
+	log.Printf("offline analysis with snapshot of %s (%d verified, %d malicious files)",
+		header.CreatedAt.Format(time.RFC3339), header.Files["verified"], header.Files["malicious"])
+	return snap, nil
+}
+
+// openStore opens the known hash store selected by KNOWN_HASH_STORE. The
+// PostgreSQL schema must be at the version the analyzer was built for.
+func openStore() (store.KnownHashStore, error) {
+	cfg, err := store.ConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend == store.BackendBolt {
+		return store.OpenBolt(cfg.Path)
+	}
+
+	host := os.Getenv("DB_HOST")
+	port, _ := strconv.Atoi(os.Getenv("DB_PORT"))
+	dbName := os.Getenv("DB_NAME")
+	dbSchema := os.Getenv("DB_SCHEMA")
+	user := os.Getenv("DB_USER")
+	password := os.Getenv("DB_PASSWORD")
+
+	psqlInfo := fmt.Sprintf("host=%s port=%d dbname=%s search_path=%s user=%s password=%s sslmode=disable",
+		host, port, dbName, dbSchema, user, password)
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := migrations.Check(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return store.NewPostgres(db), nil
 }
 
 func split_to_batches(files []ScannedFiles, batchSize int) [][]ScannedFiles {
@@ -285,20 +606,40 @@ func split_to_batches(files []ScannedFiles, batchSize int) [][]ScannedFiles {
 	return result
 }
 
-func process_batch(files *[]ScannedFiles, metadata *Metadata, db *sql.DB, wg *sync.WaitGroup) {
-	defer wg.Done()
-
+// process_batch classifies the files of a batch and returns their report,
+// or an error when they could not be looked up.
+func process_batch(files *[]ScannedFiles, metadata *Metadata, st store.KnownHashStore, filter *store.Filter, index *similarity.Index, debuginfo *debuginfod) (*Report, error) {
 	validatedData, maliciousVars, err := validateData(*files)
 	if err != nil {
 		log.Println("data validation failed:", err)
 	}
 
-	verifiedFiles, maliciousFiles, candidateFiles, err := checkHashes(validatedData, db)
+	var metrics *store.FilterMetrics
+	if filter != nil {
+		metrics = &store.FilterMetrics{}
+	}
+	verifiedFiles, maliciousFiles, candidateFiles, err := checkHashes(validatedData, metadata, st, filter, metrics, index)
 	if err != nil {
-		log.Println("database query failed:", err)
+		return nil, err
+	}
+	if debuginfo != nil {
+		debuginfo.check(*candidateFiles)
+		debuginfo.check(*maliciousFiles)
+	}
+	if metrics != nil {
+		filterMu.Lock()
+		filterMetrics.Add(*metrics)
+		filterMu.Unlock()
 	}
 
-	saveReport(metadata, verifiedFiles, maliciousFiles, candidateFiles, maliciousVars)
+	return &Report{
+		Metadata:       *metadata,
+		VerifiedFiles:  *verifiedFiles,
+		CandidateFiles: *candidateFiles,
+		MaliciousFiles: *maliciousFiles,
+		MaliciousVars:  *maliciousVars,
+		LookupFilter:   metrics,
+	}, nil
 }
 
 func validateData(files []ScannedFiles) (*[]ScannedFiles, *[]string, error) {
@@ -312,23 +653,20 @@ func validateData(files []ScannedFiles) (*[]ScannedFiles, *[]string, error) {
 
 	maliciousVars := make([]string, 0)
 
-	for i := 0; i < len(files); i++ {
-		if matched := regexpPattern.MatchString(files[i].MD5); matched {
-			maliciousVars = append(maliciousVars, files[i].MD5)
-			files = append(files[:i], files[i+1])
-		}
-		if matched := regexpPattern.MatchString(files[i].SHA1); matched {
-			maliciousVars = append(maliciousVars, files[i].SHA1)
-			files = append(files[:i], files[i+1])
-		}
-		if matched := regexpPattern.MatchString(files[i].SHA256); matched {
-			maliciousVars = append(maliciousVars, files[i].SHA256)
-			files = append(files[:i], files[i+1])
+	var validated []ScannedFiles
+	for _, file := range files {
+		injected := false
+		for algorithm, digest := range file.Hashes {
+			// Fuzzy hashes contain punctuation, so only malformed digests
+			// are matched.
+			if _, err := hashes.Normalize(algorithm, digest); err != nil && regexpPattern.MatchString(digest) {
+				maliciousVars = append(maliciousVars, digest)
+				injected = true
+			}
 		}
-		if matched := regexpPattern.MatchString(files[i].SHA512); matched {
-			maliciousVars = append(maliciousVars, files[i].SHA512)
-			files = append(files[:i], files[i+1])
+		if !injected {
+			validated = append(validated, file)
 		}
 	}
-	return &files, &maliciousVars, nil
+	return &validated, &maliciousVars, nil
 }
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Build IDs are looked up by this many requests at a time, across batches.
+const debuginfodRequests = 8
+
+// A server that failed is not asked again for this long, so unreachable
+// servers do not hold up the scan with a timeout per file.
+const debuginfodRetryAfter = 5 * time.Minute
+
+// Build IDs are hex encoded hashes, at most 64 bytes long.
+var buildIDPattern = regexp.MustCompile(`^([0-9a-f]{2}){1,64}$`)
+
+var errServersDown = errors.New("a debuginfod server is not available")
+
+// debuginfod asks the debuginfod servers of distributions whether they
+// know the GNU build IDs of ELF files. A binary at a packaged path whose
+// build ID its distribution never built was rebuilt or replaced.
+type debuginfod struct {
+	urls     []string
+	client   *http.Client
+	requests chan struct{}
+	mu       sync.Mutex
+	known    map[string]bool
+	// When each server that failed may be asked again.
+	downUntil map[string]time.Time
+}
+
+// newDebuginfod returns a client of the servers in DEBUGINFOD_URLS,
+// separated by spaces as for elfutils, or nil if it is not set.
+func newDebuginfod() *debuginfod {
+	urls := strings.Fields(os.Getenv("DEBUGINFOD_URLS"))
+	if len(urls) == 0 {
+		return nil
+	}
+	for i, url := range urls {
+		urls[i] = strings.TrimRight(url, "/")
+	}
+	return &debuginfod{
+		urls:      urls,
+		client:    &http.Client{Timeout: 10 * time.Second},
+		requests:  make(chan struct{}, debuginfodRequests),
+		known:     make(map[string]bool),
+		downUntil: make(map[string]time.Time),
+	}
+}
+
+// check records on the ELF facts of files whether a server knows their
+// build ID. Files are left unchanged when no server could be asked.
+func (d *debuginfod) check(files []ScannedFiles) {
+	var wg sync.WaitGroup
+	for i := range files {
+		elf := files[i].ELF
+		if elf == nil || elf.BuildID == "" {
+			continue
+		}
+		// Build IDs come from the agents and end up in URLs.
+		buildID := strings.ToLower(elf.BuildID)
+		if !buildIDPattern.MatchString(buildID) {
+			log.Printf("invalid build ID %q of %s", elf.BuildID, files[i].Path)
+			continue
+		}
+
+		wg.Add(1)
+		d.requests <- struct{}{}
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-d.requests }()
+			known, err := d.knows(buildID)
+			if errors.Is(err, errServersDown) {
+				return
+			}
+			if err != nil {
+				log.Printf("failed to look up build ID %s of %s: %v", buildID, files[i].Path, err)
+				return
+			}
+			files[i].ELF.KnownBuild = &known
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (d *debuginfod) knows(buildID string) (bool, error) {
+	d.mu.Lock()
+	known, ok := d.known[buildID]
+	d.mu.Unlock()
+	if ok {
+		return known, nil
+	}
+
+	// A build ID is unknown once every server said so.
+	skipped := false
+	var failed error
+	for _, url := range d.urls {
+		if !d.available(url) {
+			skipped = true
+			continue
+		}
+		// HEAD only asks whether the server has the debug info, without
+		// downloading it.
+		response, err := d.client.Head(fmt.Sprintf("%s/buildid/%s/debuginfo", url, buildID))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode == http.StatusOK {
+				known = true
+				break
+			}
+			if response.StatusCode != http.StatusNotFound {
+				err = fmt.Errorf("%s answered %s", url, response.Status)
+			}
+		}
+		if err != nil {
+			failed = err
+			d.fail(url, err)
+		}
+	}
+	if !known && failed != nil {
+		return false, failed
+	}
+	if !known && skipped {
+		return false, errServersDown
+	}
+	d.mu.Lock()
+	d.known[buildID] = known
+	d.mu.Unlock()
+	return known, nil
+}
+
+func (d *debuginfod) available(url string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return time.Now().After(d.downUntil[url])
+}
+
+// fail stops asking url for a while after it failed.
+func (d *debuginfod) fail(url string, err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if time.Now().Before(d.downUntil[url]) {
+		return
+	}
+	d.downUntil[url] = time.Now().Add(debuginfodRetryAfter)
+	log.Printf("not asking %s for %v after it failed: %v", url, debuginfodRetryAfter, err)
+}
@@ -2,6 +2,15 @@ module analyzer
 
 go 1.19
 
-require github.com/lib/pq v1.10.9
+require (
+	common v0.0.0-00010101000000-000000000000
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+)
 
-require github.com/joho/godotenv v1.5.1 // indirect
+require (
+	go.etcd.io/bbolt v1.3.7 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
+
+replace common => ../../common
@@ -2,4 +2,10 @@ module listener
 
 go 1.18
 
-require github.com/joho/godotenv v1.5.1
+require (
+	common v0.0.0-00010101000000-000000000000
+	github.com/joho/godotenv v1.5.1
+	github.com/lib/pq v1.10.9
+)
+
+replace common => ../../common
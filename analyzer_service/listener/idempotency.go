@@ -0,0 +1,104 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// Agents send every spooled request with an Idempotency-Key header and
+// retry it until it is acknowledged. The keys of processed requests are
+// kept as files in IDEMPOTENCY_DIR, so a replayed batch is acknowledged
+// without being analyzed twice, even across restarts.
+
+var idempotencyKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,128}$`)
+
+type idempotency struct {
+	dir       string
+	retention time.Duration
+
+	mu       sync.Mutex
+	inFlight map[string]chan struct{}
+}
+
+func newIdempotency(username string) (*idempotency, error) {
+	dir := os.Getenv("IDEMPOTENCY_DIR")
+	if dir == "" {
+		dir = fmt.Sprintf("/home/%s/.sys-check/idempotency", username)
+	}
+	retention := 30 * 24 * time.Hour
+	if value := os.Getenv("IDEMPOTENCY_RETENTION"); value != "" {
+		var err error
+		retention, err = time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid IDEMPOTENCY_RETENTION %q: %v", value, err)
+		}
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &idempotency{dir: dir, retention: retention, inFlight: make(map[string]chan struct{})}, nil
+}
+
+// begin returns whether the request with key still has to be processed.
+// A request replayed while the first one is processed waits for it, and
+// is only processed again if the first one failed. Every request that
+// has to be processed must be ended with end.
+func (i *idempotency) begin(key string) (bool, error) {
+	if !idempotencyKeyPattern.MatchString(key) {
+		return false, fmt.Errorf("invalid idempotency key %q", key)
+	}
+	for {
+		i.mu.Lock()
+		if _, err := os.Stat(filepath.Join(i.dir, key)); err == nil {
+			i.mu.Unlock()
+			return false, nil
+		}
+		wait, ok := i.inFlight[key]
+		if !ok {
+			i.inFlight[key] = make(chan struct{})
+			i.mu.Unlock()
+			return true, nil
+		}
+		i.mu.Unlock()
+		<-wait
+	}
+}
+
+// end records key as processed if the request succeeded.
+func (i *idempotency) end(key string, succeeded bool) {
+	var err error
+	if succeeded {
+		err = os.WriteFile(filepath.Join(i.dir, key), nil, 0644)
+	}
+
+	i.mu.Lock()
+	close(i.inFlight[key])
+	delete(i.inFlight, key)
+	i.mu.Unlock()
+	if err != nil {
+		log.Println("failed to record idempotency key:", err)
+	}
+}
+
+// prune forgets the keys of requests processed longer ago than the
+// retention, every hour.
+func (i *idempotency) prune() {
+	for {
+		entries, err := os.ReadDir(i.dir)
+		if err != nil {
+			log.Println("failed to prune idempotency keys:", err)
+		}
+		for _, entry := range entries {
+			info, err := entry.Info()
+			if err == nil && time.Since(info.ModTime()) > i.retention {
+				os.Remove(filepath.Join(i.dir, entry.Name()))
+			}
+		}
+		time.Sleep(time.Hour)
+	}
+}
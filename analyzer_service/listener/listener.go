@@ -10,28 +10,38 @@ import (
 	"os/exec"
 	"os/user"
 
+	"common/elfinfo"
+
 	"github.com/joho/godotenv"
 )
 
 type ScannedFiles struct {
-	Name       string `json:"name"`
-	Path       string `json:"path"`
-	Size       int    `json:"size"`
-	Owner      string `json:"owner"`
-	Perm       string `json:"perm"`
-	Accessed   string `json:"accessed"`
-	Created    string `json:"created"`
-	Group      string `json:"group"`
-	Modified   string `json:"modified"`
-	MD5        string `json:"MD5"`
-	SHA1       string `json:"SHA1"`
-	SHA256     string `json:"SHA256"`
-	SHA512     string `json:"SHA512"`
-	FileStatus string `json:"fileStatus"`
+	Name       string            `json:"name"`
+	Path       string            `json:"path"`
+	Container  string            `json:"container,omitempty"`
+	Size       int               `json:"size"`
+	Owner      string            `json:"owner"`
+	Perm       string            `json:"perm"`
+	Accessed   string            `json:"accessed"`
+	Created    string            `json:"created"`
+	Group      string            `json:"group"`
+	Modified   string            `json:"modified"`
+	Hashes     map[string]string `json:"hashes,omitempty"`
+	MD5        string            `json:"MD5,omitempty"`
+	SHA1       string            `json:"SHA1,omitempty"`
+	SHA256     string            `json:"SHA256,omitempty"`
+	SHA512     string            `json:"SHA512,omitempty"`
+	FileStatus string            `json:"fileStatus"`
+	ELF        *elfinfo.Info     `json:"elf,omitempty"`
 }
 
 type Metadata struct {
-	IPv4Address string `json:"ip_address"`
+	IPv4Address    string `json:"ip_address"`
+	ScanID         string `json:"scan_id,omitempty"`
+	Profile        string `json:"profile,omitempty"`
+	ProfileVersion string `json:"profile_version,omitempty"`
+	// Directories the agent scanned.
+	Directories []string `json:"directories,omitempty"`
 }
 
 type ScanRequest struct {
@@ -40,6 +50,8 @@ type ScanRequest struct {
 	Status   string         `json:"status"`
 }
 
+var idempotencyKeys *idempotency
+
 func main() {
 	currentUser, err := user.Current()
 	if err != nil {
@@ -52,11 +64,30 @@ func main() {
 		log.Fatal("Error loading .env file")
 	}
 
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		if err := runMigrate(os.Args[2:]); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	idempotencyKeys, err = newIdempotency(currentUser.Username)
+	if err != nil {
+		log.Fatal("Failed to open the idempotency key directory: ", err)
+	}
+	go idempotencyKeys.prune()
+
 	host := os.Getenv("HOST")
 	port := os.Getenv("PORT")
 
 	address := host + ":" + port
 	http.HandleFunc("/", handler)
+	registerProfiles(http.DefaultServeMux, currentUser.Username)
+	err = registerTriage(http.DefaultServeMux)
+	if err != nil {
+		log.Fatal("Failed to open the triage database: ", err)
+	}
 	log.Fatal(http.ListenAndServe(address, nil))
 }
 
@@ -69,12 +100,32 @@ func handler(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	key := r.Header.Get("Idempotency-Key")
+	if key != "" {
+		process, err := idempotencyKeys.begin(key)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !process {
+			// Replayed by an agent that missed the acknowledgement
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+	}
+
 	go processRequest(r, done, errCh)
 
 	select {
 	case <-done:
+		if key != "" {
+			idempotencyKeys.end(key, true)
+		}
 		w.WriteHeader(http.StatusOK)
 	case err := <-errCh:
+		if key != "" {
+			idempotencyKeys.end(key, false)
+		}
 		go logError(err)
 		w.WriteHeader(http.StatusInternalServerError)
 	}
@@ -163,7 +214,10 @@ func combineReports(data *ScanRequest) error {
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 	cmd.Env = os.Environ()
-	cmd.Args = append(cmd.Args, data.Metadata.IPv4Address)
+	cmd.Args = append(cmd.Args, data.Metadata.IPv4Address, data.Metadata.ScanID)
+	if data.Metadata.Profile != "" {
+		cmd.Args = append(cmd.Args, data.Metadata.Profile, data.Metadata.ProfileVersion)
+	}
 
 	err := cmd.Run()
 	if err != nil {
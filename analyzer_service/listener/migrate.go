@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"os"
+
+	"common/migrations"
+)
+
+// runMigrate implements "listener migrate up|status" against the database
+// in listener.env.
+func runMigrate(args []string) error {
+	if len(args) != 1 || (args[0] != "up" && args[0] != "status") {
+		return errors.New("usage: listener migrate up|status")
+	}
+	if os.Getenv("DB_HOST") == "" {
+		return errors.New("DB_HOST is not set in listener.env")
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if args[0] == "up" {
+		return migrations.PrintUp(os.Stdout, db, os.Getenv("DB_SCHEMA"))
+	}
+	return migrations.PrintStatus(os.Stdout, db)
+}
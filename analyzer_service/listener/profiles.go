@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"common/hashes"
+)
+
+// ScanProfile tells agents what to scan. Profiles are JSON files named
+// <name>.json in PROFILES_DIR, read on every request so edits apply to the
+// next scan. The version is derived from the file, so it changes with
+// every edit.
+type ScanProfile struct {
+	Name           string          `json:"name"`
+	Version        string          `json:"version"`
+	Directories    []string        `json:"directories"`
+	Rules          json.RawMessage `json:"rules,omitempty"`
+	HashAlgorithms []string        `json:"hashAlgorithms,omitempty"`
+	Schedule       string          `json:"schedule,omitempty"`
+	InspectELF     *bool           `json:"inspectElf,omitempty"`
+}
+
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+func registerProfiles(mux *http.ServeMux, username string) {
+	dir := os.Getenv("PROFILES_DIR")
+	if dir == "" {
+		dir = fmt.Sprintf("/home/%s/.sys-check/profiles", username)
+	}
+	mux.HandleFunc("/profiles/", func(w http.ResponseWriter, r *http.Request) {
+		serveProfile(dir, w, r)
+	})
+}
+
+// serveProfile serves GET /profiles/<name>.
+func serveProfile(dir string, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/profiles/")
+	if !profileNamePattern.MatchString(name) || strings.HasPrefix(name, ".") {
+		http.Error(w, fmt.Sprintf("invalid profile name %q", name), http.StatusBadRequest)
+		return
+	}
+	profile, err := readProfile(filepath.Join(dir, name+".json"))
+	if errors.Is(err, os.ErrNotExist) {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		go logError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	profile.Name = name
+	writeJSON(w, profile)
+}
+
+func readProfile(path string) (*ScanProfile, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var profile ScanProfile
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&profile); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", path, err)
+	}
+	if err := validateProfile(&profile); err != nil {
+		return nil, fmt.Errorf("invalid profile %s: %v", path, err)
+	}
+	digest := sha256.Sum256(data)
+	profile.Version = hex.EncodeToString(digest[:6])
+	return &profile, nil
+}
+
+// validateProfile checks what the agent cannot check before it starts
+// scanning. The rules are checked by the agent, like rule files.
+func validateProfile(profile *ScanProfile) error {
+	if profile.Name != "" || profile.Version != "" {
+		return errors.New("name and version are set by the listener")
+	}
+	if len(profile.Directories) == 0 {
+		return errors.New("no directories")
+	}
+	for _, dir := range profile.Directories {
+		if !filepath.IsAbs(dir) {
+			return fmt.Errorf("directory %q is not absolute", dir)
+		}
+	}
+	if len(profile.Rules) > 0 && !bytes.HasPrefix(bytes.TrimSpace(profile.Rules), []byte("{")) {
+		return errors.New("rules must be an object")
+	}
+	exact := len(profile.HashAlgorithms) == 0
+	for _, algorithm := range profile.HashAlgorithms {
+		if !hashes.Known(algorithm) {
+			return fmt.Errorf("unsupported hash algorithm %q", algorithm)
+		}
+		exact = exact || !hashes.Fuzzy(algorithm)
+	}
+	if !exact {
+		// Files are looked up by the other algorithms
+		return errors.New("hashAlgorithms only has fuzzy hashes")
+	}
+	if profile.Schedule != "" && len(strings.Fields(profile.Schedule)) != 5 {
+		return fmt.Errorf("schedule %q is not a cron expression", profile.Schedule)
+	}
+	return nil
+}
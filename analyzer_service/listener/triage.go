@@ -0,0 +1,262 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"common/hashes"
+	"common/history"
+	"common/migrations"
+	"common/triage"
+	"common/views"
+
+	_ "github.com/lib/pq"
+)
+
+type DecisionRequest struct {
+	triage.Decision
+	Hash   string `json:"hash"`
+	Prefix string `json:"prefix"`
+	ScanID string `json:"scanId"`
+}
+
+type DecisionResponse struct {
+	Changed int64 `json:"changed"`
+}
+
+// registerTriage serves the triage and lineage API when the listener is
+// configured with a database and reviewer tokens.
+func registerTriage(mux *http.ServeMux) error {
+	if os.Getenv("DB_HOST") == "" {
+		return nil
+	}
+	tokens, err := triageTokens(os.Getenv("TRIAGE_TOKENS"))
+	if err != nil {
+		return err
+	}
+
+	db, err := openDB()
+	if err != nil {
+		return err
+	}
+	if err := migrations.Check(db); err != nil {
+		return err
+	}
+
+	interval, err := views.Interval()
+	if err != nil {
+		return err
+	}
+	go refreshViews(db, interval)
+
+	// The listener port is open to every scanned computer, which must not
+	// be able to decide what is malicious.
+	if len(tokens) == 0 {
+		log.Println("TRIAGE_TOKENS is not set, not serving the triage API")
+		return nil
+	}
+	mux.HandleFunc("/triage/candidates", triageAuth(tokens, func(w http.ResponseWriter, r *http.Request, reviewer string) {
+		listCandidates(db, w, r)
+	}))
+	mux.HandleFunc("/triage/decisions", triageAuth(tokens, func(w http.ResponseWriter, r *http.Request, reviewer string) {
+		decide(db, w, r, reviewer)
+	}))
+	mux.HandleFunc("/lineage/", triageAuth(tokens, func(w http.ResponseWriter, r *http.Request, reviewer string) {
+		lineage(db, w, r)
+	}))
+	return nil
+}
+
+// triageTokens parses TRIAGE_TOKENS, a comma separated list of
+// <reviewer>:<token> pairs, into the reviewers by token.
+func triageTokens(setting string) (map[string]string, error) {
+	tokens := make(map[string]string)
+	for _, pair := range strings.Split(setting, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		reviewer, token, ok := strings.Cut(pair, ":")
+		reviewer, token = strings.TrimSpace(reviewer), strings.TrimSpace(token)
+		if !ok || reviewer == "" || token == "" {
+			return nil, fmt.Errorf("invalid TRIAGE_TOKENS entry %q, want <reviewer>:<token>", pair)
+		}
+		if _, ok := tokens[token]; ok {
+			return nil, fmt.Errorf("TRIAGE_TOKENS has the token of %s twice", reviewer)
+		}
+		tokens[token] = reviewer
+	}
+	return tokens, nil
+}
+
+// openDB connects to the database configured with the DB_* settings.
+func openDB() (*sql.DB, error) {
+	port, _ := strconv.Atoi(os.Getenv("DB_PORT"))
+	psqlInfo := fmt.Sprintf("host=%s port=%d dbname=%s search_path=%s user=%s password=%s sslmode=disable",
+		os.Getenv("DB_HOST"), port, os.Getenv("DB_NAME"), os.Getenv("DB_SCHEMA"), os.Getenv("DB_USER"), os.Getenv("DB_PASSWORD"))
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// refreshViews refreshes the materialized views after the analyzer, the
+// uploaders or reviewers changed the files table, once no refresh happened
+// for interval.
+func refreshViews(db *sql.DB, interval time.Duration) {
+	ticker := time.NewTicker(10 * time.Second)
+	defer ticker.Stop()
+	for range ticker.C {
+		if _, err := views.RefreshPending(db, interval); err != nil {
+			logError(err)
+		}
+	}
+}
+
+// triageAuth requires the bearer token of a reviewer and passes the
+// reviewer on to next.
+func triageAuth(tokens map[string]string, next func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		given := []byte(r.Header.Get("Authorization"))
+		reviewer := ""
+		// Every token is compared so the time taken does not tell which
+		// one was close.
+		for token, name := range tokens {
+			if subtle.ConstantTimeCompare(given, []byte("Bearer "+token)) == 1 {
+				reviewer = name
+			}
+		}
+		if reviewer == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		next(w, r, reviewer)
+	}
+}
+
+func listCandidates(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	query := r.URL.Query()
+	filter := triage.Filter{Prefix: query.Get("prefix"), ScanID: query.Get("scan")}
+	if limit := query.Get("limit"); limit != "" {
+		var err error
+		filter.Limit, err = strconv.Atoi(limit)
+		if err != nil {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+
+	candidates, err := triage.ListCandidates(db, filter)
+	if err != nil {
+		go logError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	writeJSON(w, candidates)
+}
+
+// decide records a decision by reviewer, whatever reviewer the request
+// names.
+func decide(db *sql.DB, w http.ResponseWriter, r *http.Request, reviewer string) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	var request DecisionRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		http.Error(w, "failed to parse JSON data", http.StatusBadRequest)
+		return
+	}
+	if (request.Hash == "") == (request.Prefix == "") {
+		http.Error(w, "either hash or prefix is required", http.StatusBadRequest)
+		return
+	}
+	request.Reviewer = reviewer
+
+	tx, err := db.Begin()
+	if err != nil {
+		go logError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var changed int64
+	if request.Hash != "" {
+		changed, err = triage.Decide(tx, request.Hash, request.Decision)
+	} else {
+		changed, err = triage.DecidePrefix(tx, request.Prefix, request.ScanID, request.Decision)
+	}
+	if errors.Is(err, triage.ErrInvalidDecision) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err == nil {
+		err = tx.Commit()
+	}
+	if err != nil {
+		go logError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	if changed > 0 {
+		if err := views.Request(db); err != nil {
+			go logError(err)
+		}
+	}
+	writeJSON(w, DecisionResponse{Changed: changed})
+}
+
+// lineage serves the status history of every file matching the hash in
+// GET /lineage/<hash>.
+func lineage(db *sql.DB, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	hash := strings.TrimPrefix(r.URL.Path, "/lineage/")
+	if _, err := hashes.Column(hash); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	files, err := history.Lineage(db, hash)
+	if err != nil {
+		go logError(err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if len(files) == 0 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	writeJSON(w, files)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		go logError(err)
+	}
+}
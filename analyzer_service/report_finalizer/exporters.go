@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+type reportExporter struct {
+	extension string
+	write     func(report *Report, w io.Writer) error
+}
+
+var reportExporters = map[string]reportExporter{
+	"stix":    {"stix.json", writeSTIXBundle},
+	"misp":    {"misp.json", writeMISPEvent},
+	"html":    {"html", writeHTMLReport},
+	"sarif":   {"sarif", writeSARIF},
+	"junit":   {"junit.xml", writeJUnit},
+	"csv":     {"csv", writeCSVTable},
+	"parquet": {"parquet", writeParquetTable},
+}
+
+// writeReportExports writes the final report in every format listed in the
+// comma separated REPORT_FORMATS variable next to final-report.json.
+func writeReportExports(dirPath string, report Report) {
+	formats := os.Getenv("REPORT_FORMATS")
+	for _, format := range strings.Split(formats, ",") {
+		format = strings.TrimSpace(format)
+		if format == "" {
+			continue
+		}
+		outputPath := fmt.Sprintf("%s/final-report.%s", dirPath, reportExporters[format].extension)
+		err := exportReport(format, &report, outputPath)
+		if err != nil {
+			fmt.Printf("error exporting report as %s: %v\n", format, err)
+		}
+	}
+}
+
+func exportReport(format string, report *Report, outputPath string) error {
+	exporter, ok := reportExporters[format]
+	if !ok {
+		return fmt.Errorf("unknown report format %q", format)
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	err = exporter.write(report, writer)
+	if err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// runExport converts an existing final report: export <format> <final report> [<output file>]
+func runExport(args []string) {
+	if len(args) < 2 || len(args) > 3 {
+		fmt.Println("Usage: ./report_finalizer export <format> <full path to final report> [<output file>]")
+		fmt.Println("Formats:", strings.Join(exportFormats(), ", "))
+		os.Exit(2)
+	}
+
+	format, reportPath := args[0], args[1]
+	exporter, ok := reportExporters[format]
+	if !ok {
+		fmt.Printf("unknown report format %q, expected one of: %s\n", format, strings.Join(exportFormats(), ", "))
+		os.Exit(2)
+	}
+	outputPath := strings.TrimSuffix(reportPath, ".json") + "." + exporter.extension
+	if len(args) == 3 {
+		outputPath = args[2]
+	}
+
+	report, err := readJSONFile(reportPath)
+	if err != nil {
+		fmt.Printf("error reading JSON file %s: %v\n", reportPath, err)
+		os.Exit(1)
+	}
+
+	err = exportReport(format, &report, outputPath)
+	if err != nil {
+		fmt.Printf("error exporting report as %s: %v\n", format, err)
+		os.Exit(1)
+	}
+	fmt.Println("Report written to", outputPath)
+}
+
+func exportFormats() []string {
+	var formats []string
+	for format := range reportExporters {
+		formats = append(formats, format)
+	}
+	sort.Strings(formats)
+	return formats
+}
+
+// scanTime returns the time the report's scan was finalized, or the
+// current time for reports written before it was recorded.
+func scanTime(report *Report) time.Time {
+	if t, err := time.Parse(time.RFC3339, report.Metadata.ScanTime); err == nil {
+		return t.UTC()
+	}
+	return time.Now().UTC()
+}
+
+// uuidV5 derives a name based UUID (RFC 4122 version 5), so exporting the
+// same report twice yields the same identifiers.
+func uuidV5(namespace [16]byte, name string) string {
+	h := sha1.New()
+	h.Write(namespace[:])
+	h.Write([]byte(name))
+	sum := h.Sum(nil)
+
+	var u [16]byte
+	copy(u[:], sum[:16])
+	u[6] = (u[6] & 0x0f) | 0x50
+	u[8] = (u[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+func mustParseUUID(s string) [16]byte {
+	var u [16]byte
+	b, err := hex.DecodeString(strings.ReplaceAll(s, "-", ""))
+	if err != nil || len(b) != len(u) {
+		panic("invalid UUID " + s)
+	}
+	copy(u[:], b)
+	return u
+}
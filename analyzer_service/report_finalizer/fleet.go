@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"common/store"
+)
+
+type FleetReport struct {
+	GeneratedAt    string                `json:"generatedAt"`
+	StaleAfter     string                `json:"staleAfter"`
+	Hosts          []FleetHost           `json:"hosts"`
+	TopCandidates  []CandidatePrevalence `json:"topCandidates"`
+	RareCandidates []CandidatePrevalence `json:"rareCandidates"`
+	RareTotal      int                   `json:"rareCandidatesTotal"`
+	MaliciousHosts []MaliciousHost       `json:"maliciousHosts"`
+	StaleHosts     []string              `json:"staleHosts"`
+	// Totals of the hosts scanned with the analyzer lookup filter.
+	LookupFilter *store.FilterMetrics `json:"lookupFilter,omitempty"`
+}
+
+type FleetHost struct {
+	Host             string               `json:"host"`
+	ScanID           string               `json:"scanId"`
+	ScanTime         string               `json:"scanTime"`
+	Profile          string               `json:"profile,omitempty"`
+	ProfileVersion   string               `json:"profileVersion,omitempty"`
+	Stale            bool                 `json:"stale"`
+	Verified         int                  `json:"verified"`
+	Candidate        int                  `json:"candidate"`
+	Similar          int                  `json:"suspiciousSimilar"`
+	Malicious        int                  `json:"malicious"`
+	UniqueCandidates int                  `json:"uniqueCandidates"`
+	LookupFilter     *store.FilterMetrics `json:"lookupFilter,omitempty"`
+}
+
+type CandidatePrevalence struct {
+	Hash  string   `json:"hash"`
+	Hosts int      `json:"hosts"`
+	Share float64  `json:"share"`
+	Paths []string `json:"paths"`
+	Host  string   `json:"host,omitempty"`
+}
+
+type MaliciousHost struct {
+	Host  string         `json:"host"`
+	Files []ScannedFiles `json:"files"`
+}
+
+// Number of example paths kept for every candidate hash.
+const fleetCandidatePaths = 5
+
+type candidateHosts struct {
+	hosts map[string]bool
+	paths []string
+}
+
+// runFleet aggregates the latest final report of every host in REPORTS_DIR:
+// fleet [-stale <duration>] [-top <n>] [-rare <n>] [-output <file>]
+func runFleet(args []string) {
+	fs := flag.NewFlagSet("fleet", flag.ExitOnError)
+	defaultStale, err := time.ParseDuration(envOrDefault("FLEET_STALE_AFTER", "168h"))
+	if err != nil {
+		fmt.Println("invalid FLEET_STALE_AFTER:", err)
+		os.Exit(2)
+	}
+	staleAfter := fs.Duration("stale", defaultStale, "hosts whose last scan is older than this are stale")
+	top := fs.Int("top", 50, "number of candidate hashes to rank by prevalence")
+	rare := fs.Int("rare", 500, "number of single-host candidate hashes to list")
+	output := fs.String("output", "", "fleet report path (default <REPORTS_DIR>/fleet-report.json)")
+	fs.Parse(args)
+
+	reportsDir := os.Getenv("REPORTS_DIR")
+	if *output == "" {
+		*output = filepath.Join(reportsDir, "fleet-report.json")
+	}
+	reportPaths, err := filepath.Glob(filepath.Join(reportsDir, "*", "final-report.json"))
+	if err != nil || len(reportPaths) == 0 {
+		fmt.Println("no final reports found in REPORTS_DIR")
+		os.Exit(1)
+	}
+
+	fleet, err := buildFleetReport(reportPaths, *staleAfter, *top, *rare, time.Now().UTC())
+	if err != nil {
+		fmt.Println("error building fleet report:", err)
+		os.Exit(1)
+	}
+
+	file, err := os.Create(*output)
+	if err != nil {
+		fmt.Println("error creating file:", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(fleet); err != nil {
+		fmt.Println("error encoding JSON:", err)
+		os.Exit(1)
+	}
+
+	fmt.Printf("%d hosts, %d with malicious files, %d stale, %d single-host candidates\n",
+		len(fleet.Hosts), len(fleet.MaliciousHosts), len(fleet.StaleHosts), fleet.RareTotal)
+	if fleet.LookupFilter != nil {
+		fmt.Printf("lookup filter: %d of %d lookups answered without the database\n",
+			fleet.LookupFilter.Misses, fleet.LookupFilter.Hits+fleet.LookupFilter.Misses)
+	}
+	fmt.Println("Fleet report written to", *output)
+}
+
+func buildFleetReport(reportPaths []string, staleAfter time.Duration, top, rare int, now time.Time) (*FleetReport, error) {
+	fleet := &FleetReport{
+		GeneratedAt:    now.Format(time.RFC3339),
+		StaleAfter:     staleAfter.String(),
+		Hosts:          []FleetHost{},
+		TopCandidates:  []CandidatePrevalence{},
+		RareCandidates: []CandidatePrevalence{},
+		MaliciousHosts: []MaliciousHost{},
+		StaleHosts:     []string{},
+	}
+	candidates := make(map[string]*candidateHosts)
+
+	for _, reportPath := range reportPaths {
+		var host FleetHost
+		var malicious []ScannedFiles
+		var lookupFilter store.FilterMetrics
+		err := streamReport(reportPath, func(metadata Metadata, status string, file ScannedFiles) error {
+			switch status {
+			case "verified":
+				host.Verified++
+			case "candidate":
+				host.Candidate++
+				if file.Similar != nil {
+					host.Similar++
+				}
+				hash := strings.ToLower(file.fileHash())
+				if hash == "" {
+					return nil
+				}
+				c, ok := candidates[hash]
+				if !ok {
+					c = &candidateHosts{hosts: make(map[string]bool)}
+					candidates[hash] = c
+				}
+				c.hosts[metadata.IPv4Address] = true
+				if len(c.paths) < fleetCandidatePaths && !containsString(c.paths, file.Path) {
+					c.paths = append(c.paths, file.Path)
+				}
+			case "malicious":
+				host.Malicious++
+				malicious = append(malicious, file)
+			}
+			host.Host = metadata.IPv4Address
+			host.ScanID = metadata.ScanID
+			host.ScanTime = metadata.ScanTime
+			host.Profile = metadata.Profile
+			host.ProfileVersion = metadata.ProfileVersion
+			return nil
+		}, &lookupFilter)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", reportPath, err)
+		}
+		if host.Host == "" {
+			// Reports without any files still identify their host by directory.
+			host.Host = filepath.Base(filepath.Dir(reportPath))
+			if info, err := os.Stat(reportPath); err == nil {
+				host.ScanTime = info.ModTime().UTC().Format(time.RFC3339)
+			}
+		}
+
+		scanned, err := time.Parse(time.RFC3339, host.ScanTime)
+		host.Stale = err != nil || now.Sub(scanned) > staleAfter
+		if host.Stale {
+			fleet.StaleHosts = append(fleet.StaleHosts, host.Host)
+		}
+		if lookupFilter != (store.FilterMetrics{}) {
+			host.LookupFilter = &lookupFilter
+			if fleet.LookupFilter == nil {
+				fleet.LookupFilter = &store.FilterMetrics{}
+			}
+			fleet.LookupFilter.Add(lookupFilter)
+		}
+		if len(malicious) > 0 {
+			fleet.MaliciousHosts = append(fleet.MaliciousHosts, MaliciousHost{Host: host.Host, Files: malicious})
+		}
+		fleet.Hosts = append(fleet.Hosts, host)
+	}
+
+	unique := make(map[string]int)
+	for hash, c := range candidates {
+		prevalence := CandidatePrevalence{
+			Hash:  hash,
+			Hosts: len(c.hosts),
+			Share: float64(len(c.hosts)) / float64(len(reportPaths)),
+			Paths: c.paths,
+		}
+		fleet.TopCandidates = append(fleet.TopCandidates, prevalence)
+		// A candidate seen on a single host of many is the interesting one.
+		if len(c.hosts) == 1 && len(reportPaths) > 1 {
+			for host := range c.hosts {
+				unique[host]++
+				prevalence.Host = host
+			}
+			fleet.RareCandidates = append(fleet.RareCandidates, prevalence)
+		}
+	}
+	for i := range fleet.Hosts {
+		fleet.Hosts[i].UniqueCandidates = unique[fleet.Hosts[i].Host]
+	}
+
+	sort.Slice(fleet.TopCandidates, func(i, j int) bool {
+		a, b := fleet.TopCandidates[i], fleet.TopCandidates[j]
+		if a.Hosts != b.Hosts {
+			return a.Hosts > b.Hosts
+		}
+		return a.Hash < b.Hash
+	})
+	sort.Slice(fleet.RareCandidates, func(i, j int) bool {
+		a, b := fleet.RareCandidates[i], fleet.RareCandidates[j]
+		if a.Host != b.Host {
+			return a.Host < b.Host
+		}
+		return a.Hash < b.Hash
+	})
+	if top >= 0 && len(fleet.TopCandidates) > top {
+		fleet.TopCandidates = fleet.TopCandidates[:top]
+	}
+	fleet.RareTotal = len(fleet.RareCandidates)
+	if rare >= 0 && len(fleet.RareCandidates) > rare {
+		fleet.RareCandidates = fleet.RareCandidates[:rare]
+	}
+	sort.Slice(fleet.Hosts, func(i, j int) bool { return fleet.Hosts[i].Host < fleet.Hosts[j].Host })
+	sort.Strings(fleet.StaleHosts)
+	return fleet, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
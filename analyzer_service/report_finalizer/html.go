@@ -0,0 +1,229 @@
+package main
+
+import (
+	_ "embed"
+	"html/template"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+//go:embed report.html.tmpl
+var htmlReportTemplate string
+
+// Directories deeper than this are only expanded when they contain
+// candidate, malicious or conflicting files.
+const htmlTreeSummaryDepth = 2
+
+type htmlReport struct {
+	Host           string
+	ScanTime       string
+	Generated      string
+	Total          int
+	Counts         []htmlStatusCount
+	Malicious      []htmlFile
+	Candidates     []htmlFile
+	Conflicts      []htmlConflict
+	RejectedValues []string
+	Tree           *htmlDir
+	ListVerified   bool
+	Verified       []htmlFile
+	SummaryDepth   int
+}
+
+type htmlStatusCount struct {
+	Status string
+	Count  int
+}
+
+type htmlFile struct {
+	ScannedFiles
+	Status string
+}
+
+type htmlConflict struct {
+	Path     string
+	Statuses string
+	Hashes   string
+}
+
+type htmlDir struct {
+	Name      string
+	Path      string
+	Depth     int
+	Verified  int
+	Candidate int
+	Similar   int
+	Malicious int
+	Dirs      []*htmlDir
+	Files     []htmlFile
+	children  map[string]*htmlDir
+}
+
+func (d *htmlDir) HasFindings() bool {
+	return d.Candidate > 0 || d.Similar > 0 || d.Malicious > 0
+}
+
+func (d *htmlDir) Expanded() bool {
+	return d.HasFindings() || d.Depth < htmlTreeSummaryDepth
+}
+
+// writeHTMLReport writes the report as a single self-contained HTML page.
+// Verified files are summarized per directory unless HTML_LIST_VERIFIED
+// is set to true.
+func writeHTMLReport(report *Report, w io.Writer) error {
+	tmpl, err := template.New("report").Parse(htmlReportTemplate)
+	if err != nil {
+		return err
+	}
+	return tmpl.Execute(w, newHTMLReport(report, os.Getenv("HTML_LIST_VERIFIED") == "true"))
+}
+
+func newHTMLReport(report *Report, listVerified bool) *htmlReport {
+	data := &htmlReport{
+		Host:           report.Metadata.IPv4Address,
+		ScanTime:       scanTime(report).Format(time.RFC1123),
+		Generated:      time.Now().UTC().Format(time.RFC1123),
+		RejectedValues: report.MaliciousVars,
+		Tree:           &htmlDir{Name: "/", Path: "/", children: make(map[string]*htmlDir)},
+		ListVerified:   listVerified,
+		SummaryDepth:   htmlTreeSummaryDepth,
+	}
+	data.Counts = []htmlStatusCount{
+		{"malicious", len(report.MaliciousFiles)},
+		{"suspicious-similar", 0},
+		{"candidate", 0},
+		{"verified", len(report.VerifiedFiles)},
+		{"conflict", 0},
+		{"rejected", len(report.MaliciousVars)},
+	}
+	data.Total = len(report.MaliciousFiles) + len(report.CandidateFiles) + len(report.VerifiedFiles)
+
+	statuses := make(map[string][]htmlFile)
+	add := func(files []ScannedFiles, status string) []htmlFile {
+		var result []htmlFile
+		for _, file := range files {
+			f := htmlFile{ScannedFiles: file, Status: file.status(status)}
+			result = append(result, f)
+			statuses[file.Path] = append(statuses[file.Path], f)
+			data.Tree.add(f, status != "verified" || listVerified)
+		}
+		return result
+	}
+	data.Malicious = add(report.MaliciousFiles, "malicious")
+	data.Candidates = add(report.CandidateFiles, "candidate")
+	verified := add(report.VerifiedFiles, "verified")
+	if listVerified {
+		data.Verified = verified
+	}
+
+	for _, f := range data.Candidates {
+		if f.Status == "suspicious-similar" {
+			data.Counts[1].Count++
+		} else {
+			data.Counts[2].Count++
+		}
+	}
+	data.Conflicts = findConflicts(statuses)
+	data.Counts[4].Count = len(data.Conflicts)
+	data.Tree.sort()
+	return data
+}
+
+// findConflicts returns the paths that were reported more than once with
+// different statuses or hashes, for example when a file changed while it
+// was being scanned.
+func findConflicts(byPath map[string][]htmlFile) []htmlConflict {
+	var conflicts []htmlConflict
+	for filePath, files := range byPath {
+		if len(files) < 2 {
+			continue
+		}
+		statusSet := make(map[string]bool)
+		hashSet := make(map[string]bool)
+		for _, f := range files {
+			statusSet[f.Status] = true
+			hashSet[f.fileHash()] = true
+		}
+		if len(statusSet) < 2 && len(hashSet) < 2 {
+			continue
+		}
+		conflicts = append(conflicts, htmlConflict{
+			Path:     filePath,
+			Statuses: strings.Join(sortedKeys(statusSet), ", "),
+			Hashes:   strings.Join(sortedKeys(hashSet), ", "),
+		})
+	}
+	sort.Slice(conflicts, func(i, j int) bool { return conflicts[i].Path < conflicts[j].Path })
+	return conflicts
+}
+
+func (d *htmlDir) add(file htmlFile, listed bool) {
+	dir := path.Dir(path.Clean("/" + file.Path))
+	node := d
+	node.count(file.Status)
+	if dir != "/" {
+		for _, name := range strings.Split(strings.TrimPrefix(dir, "/"), "/") {
+			child, ok := node.children[name]
+			if !ok {
+				child = &htmlDir{
+					Name:     name,
+					Path:     path.Join(node.Path, name),
+					Depth:    node.Depth + 1,
+					children: make(map[string]*htmlDir),
+				}
+				node.children[name] = child
+				node.Dirs = append(node.Dirs, child)
+			}
+			node = child
+			node.count(file.Status)
+		}
+	}
+	if listed {
+		node.Files = append(node.Files, file)
+	}
+}
+
+func (d *htmlDir) count(status string) {
+	switch status {
+	case "verified":
+		d.Verified++
+	case "candidate":
+		d.Candidate++
+	case "suspicious-similar":
+		d.Similar++
+	case "malicious":
+		d.Malicious++
+	}
+}
+
+func (d *htmlDir) sort() {
+	sort.Slice(d.Dirs, func(i, j int) bool { return d.Dirs[i].Name < d.Dirs[j].Name })
+	sort.Slice(d.Files, func(i, j int) bool { return d.Files[i].Path < d.Files[j].Path })
+	for _, child := range d.Dirs {
+		child.sort()
+	}
+}
+
+func sortedKeys(set map[string]bool) []string {
+	var keys []string
+	for key := range set {
+		if key != "" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
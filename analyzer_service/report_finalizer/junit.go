@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name       string          `xml:"name,attr"`
+	Tests      int             `xml:"tests,attr"`
+	Failures   int             `xml:"failures,attr"`
+	Timestamp  string          `xml:"timestamp,attr"`
+	Hostname   string          `xml:"hostname,attr"`
+	Properties []junitProperty `xml:"properties>property"`
+	Cases      []junitTestCase `xml:"testcase"`
+}
+
+type junitProperty struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"value,attr"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Text    string `xml:",chardata"`
+}
+
+type junitDirectory struct {
+	files    int
+	failures []string
+	findings []string
+}
+
+// writeJUnit writes a JUnit XML report with one test case per scanned
+// directory. A directory fails when it holds a finding at or above
+// FAIL_LEVEL. Reports without the scanned directories are grouped by the
+// top directories of the files.
+func writeJUnit(report *Report, w io.Writer) error {
+	config, err := loadSeverityConfig()
+	if err != nil {
+		return err
+	}
+
+	directories := make(map[string]*junitDirectory)
+	directory := func(file ScannedFiles) *junitDirectory {
+		dir := junitDirectoryOf(file, report.Metadata.Directories)
+		d, ok := directories[dir]
+		if !ok {
+			d = &junitDirectory{}
+			directories[dir] = d
+		}
+		return d
+	}
+	for _, file := range report.VerifiedFiles {
+		directory(file).files++
+	}
+	for _, f := range config.findings(report) {
+		d := directory(f.file)
+		d.files++
+		line := fmt.Sprintf("%s: %s file %s", f.level, f.status, f.file.Path)
+		if f.status == "malicious" {
+			if label := firstNonEmpty(f.file.ThreatLabel, f.file.Family); label != "" {
+				line += " (" + label + ")"
+			}
+		}
+		if f.file.Similar != nil {
+			line += ", similar to " + f.file.Similar.Describe()
+		}
+		if config.fails(f.level) {
+			d.failures = append(d.failures, line)
+		} else {
+			d.findings = append(d.findings, line)
+		}
+	}
+
+	host := report.Metadata.IPv4Address
+	suite := junitTestSuite{
+		Name:      "sys-check " + host,
+		Timestamp: scanTime(report).Format(time.RFC3339),
+		Hostname:  host,
+		Properties: []junitProperty{
+			{"failLevel", config.failLevel},
+			{"severityMalicious", config.malicious},
+			{"severityCandidate", config.candidate},
+			{"severitySimilar", config.similar},
+		},
+	}
+
+	var names []string
+	for dir := range directories {
+		names = append(names, dir)
+	}
+	sort.Strings(names)
+	for _, dir := range names {
+		d := directories[dir]
+		testCase := junitTestCase{
+			Name:      dir,
+			ClassName: "sys-check." + strings.ReplaceAll(host, ".", "_"),
+			SystemOut: fmt.Sprintf("%d files scanned\n%s", d.files, strings.Join(d.findings, "\n")),
+		}
+		if len(d.failures) > 0 {
+			testCase.Failure = &junitFailure{
+				Message: fmt.Sprintf("%d findings at level %s or above", len(d.failures), config.failLevel),
+				Type:    "integrity",
+				Text:    strings.Join(d.failures, "\n"),
+			}
+			suite.Failures++
+		}
+		suite.Cases = append(suite.Cases, testCase)
+	}
+	suite.Tests = len(suite.Cases)
+
+	suites := junitTestSuites{
+		Name:     suite.Name,
+		Tests:    suite.Tests,
+		Failures: suite.Failures,
+		Suites:   []junitTestSuite{suite},
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err = io.WriteString(w, "\n")
+	return err
+}
+
+// junitDirectoryOf returns the scanned directory holding a file, the
+// innermost if they are nested. Archive members are in the directory of
+// the archive on disk.
+func junitDirectoryOf(file ScannedFiles, scanned []string) string {
+	filePath := file.Path
+	if file.Container != "" {
+		filePath, _, _ = strings.Cut(file.Container, "!/")
+	}
+	filePath = path.Clean("/" + filePath)
+	dir := ""
+	for _, root := range scanned {
+		root = path.Clean("/" + root)
+		inside := filePath == root || strings.HasPrefix(filePath, strings.TrimSuffix(root, "/")+"/")
+		if inside && len(root) > len(dir) {
+			dir = root
+		}
+	}
+	if dir != "" {
+		return dir
+	}
+	top, rest, nested := strings.Cut(strings.TrimPrefix(filePath, "/"), "/")
+	if !nested || rest == "" {
+		return "/"
+	}
+	return "/" + top
+}
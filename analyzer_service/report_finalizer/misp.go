@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// UUID of the MISP "file" object template.
+const mispFileTemplateUUID = "688c46fb-5edb-40a3-8273-1af7923e2215"
+
+type mispEvent struct {
+	Event mispEventBody `json:"Event"`
+}
+
+type mispEventBody struct {
+	UUID          string          `json:"uuid"`
+	Info          string          `json:"info"`
+	Date          string          `json:"date"`
+	Timestamp     string          `json:"timestamp"`
+	ThreatLevelID string          `json:"threat_level_id"`
+	Analysis      string          `json:"analysis"`
+	Distribution  string          `json:"distribution"`
+	Published     bool            `json:"published"`
+	Attribute     []mispAttribute `json:"Attribute"`
+	Object        []mispObject    `json:"Object"`
+	Tag           []mispTag       `json:"Tag,omitempty"`
+}
+
+type mispObject struct {
+	UUID            string          `json:"uuid"`
+	Name            string          `json:"name"`
+	MetaCategory    string          `json:"meta-category"`
+	TemplateUUID    string          `json:"template_uuid"`
+	TemplateVersion string          `json:"template_version"`
+	Comment         string          `json:"comment,omitempty"`
+	Attribute       []mispAttribute `json:"Attribute"`
+}
+
+type mispAttribute struct {
+	UUID           string    `json:"uuid"`
+	Type           string    `json:"type"`
+	Category       string    `json:"category"`
+	ObjectRelation string    `json:"object_relation,omitempty"`
+	Value          string    `json:"value"`
+	ToIDS          bool      `json:"to_ids"`
+	Comment        string    `json:"comment,omitempty"`
+	Tag            []mispTag `json:"Tag,omitempty"`
+}
+
+type mispTag struct {
+	Name string `json:"name"`
+}
+
+// writeMISPEvent writes the report's malicious files as a MISP event with
+// one file object per malicious file.
+func writeMISPEvent(report *Report, w io.Writer) error {
+	scanned := scanTime(report)
+	host := report.Metadata.IPv4Address
+	eventKey := "misp|" + host + "|" + scanned.Format(stixTimeFormat)
+
+	event := mispEventBody{
+		UUID:          uuidV5(sysCheckNamespace, eventKey),
+		Info:          fmt.Sprintf("sys-check: %d malicious files on %s", len(report.MaliciousFiles), host),
+		Date:          scanned.Format("2006-01-02"),
+		Timestamp:     strconv.FormatInt(scanned.Unix(), 10),
+		ThreatLevelID: "1",
+		Analysis:      "2",
+		Distribution:  "0",
+		Attribute:     []mispAttribute{},
+		Object:        []mispObject{},
+		Tag:           []mispTag{{Name: "tlp:amber"}},
+	}
+	event.Attribute = append(event.Attribute, mispAttribute{
+		UUID:     uuidV5(sysCheckNamespace, eventKey+"|host"),
+		Type:     "text",
+		Category: "Other",
+		Value:    fmt.Sprintf("Scanned host %s, scan finalized at %s", host, scanned.Format(stixTimeFormat)),
+	})
+
+	families := make(map[string]bool)
+	for _, file := range report.MaliciousFiles {
+		objectKey := eventKey + "|" + file.Path + "|" + file.Hashes["SHA256"] + file.Hashes["SHA1"] + file.Hashes["MD5"]
+		object := mispObject{
+			UUID:            uuidV5(sysCheckNamespace, objectKey),
+			Name:            "file",
+			MetaCategory:    "file",
+			TemplateUUID:    mispFileTemplateUUID,
+			TemplateVersion: "24",
+			Comment:         fmt.Sprintf("Found at %s on %s", file.Path, host),
+		}
+
+		attribute := func(relation, attributeType, value string, toIDS bool) {
+			if value == "" {
+				return
+			}
+			a := mispAttribute{
+				UUID:           uuidV5(sysCheckNamespace, objectKey+"|"+relation),
+				Type:           attributeType,
+				Category:       "Payload delivery",
+				ObjectRelation: relation,
+				Value:          value,
+				ToIDS:          toIDS,
+			}
+			if toIDS && file.Source != "" {
+				a.Comment = "reported by " + file.Source
+			}
+			object.Attribute = append(object.Attribute, a)
+		}
+		attribute("filename", "filename", file.Name, false)
+		attribute("md5", "md5", file.Hashes["MD5"], true)
+		attribute("sha1", "sha1", file.Hashes["SHA1"], true)
+		attribute("sha256", "sha256", file.Hashes["SHA256"], true)
+		attribute("sha512", "sha512", file.Hashes["SHA512"], true)
+		attribute("ssdeep", "ssdeep", file.Hashes["SSDEEP"], false)
+		attribute("tlsh", "tlsh", file.Hashes["TLSH"], false)
+		if file.Size > 0 {
+			attribute("size-in-bytes", "size-in-bytes", strconv.Itoa(file.Size), false)
+		}
+		if file.ThreatLabel != "" {
+			attribute("text", "text", file.ThreatLabel, false)
+		}
+
+		if file.Family != "" && !families[file.Family] {
+			families[file.Family] = true
+			event.Tag = append(event.Tag, mispTag{Name: fmt.Sprintf("malware_family=%q", file.Family)})
+		}
+		event.Object = append(event.Object, object)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(mispEvent{Event: event})
+}
@@ -7,58 +7,168 @@ import (
 	"os"
 	"os/user"
 	"path/filepath"
+	"strings"
+	"time"
+
+	"common/elfinfo"
+	"common/store"
 
 	"github.com/joho/godotenv"
 )
 
 type Report struct {
-	Metadata       Metadata       `json:"metadata"`
-	VerifiedFiles  []ScannedFiles `json:"verifiedFiles"`
-	CandidateFiles []ScannedFiles `json:"candidateFiles"`
-	MaliciousFiles []ScannedFiles `json:"maliciousFiles"`
-	MaliciousVars  []string       `json:"maliciousVariables"`
+	Metadata       Metadata             `json:"metadata"`
+	VerifiedFiles  []ScannedFiles       `json:"verifiedFiles"`
+	CandidateFiles []ScannedFiles       `json:"candidateFiles"`
+	MaliciousFiles []ScannedFiles       `json:"maliciousFiles"`
+	MaliciousVars  []string             `json:"maliciousVariables"`
+	LookupFilter   *store.FilterMetrics `json:"lookupFilter,omitempty"`
 }
 
 type ScannedFiles struct {
-	Name     string `json:"name"`
-	Path     string `json:"path"`
-	Size     int    `json:"size"`
-	Owner    string `json:"owner"`
-	Perm     string `json:"perm"`
-	Accessed string `json:"accessed"`
-	Created  string `json:"created"`
-	Group    string `json:"group"`
-	Modified string `json:"modified"`
-	MD5      string `json:"MD5"`
-	SHA1     string `json:"SHA1"`
-	SHA256   string `json:"SHA256"`
-	SHA512   string `json:"SHA512"`
+	Name        string            `json:"name"`
+	Path        string            `json:"path"`
+	Container   string            `json:"container,omitempty"`
+	Size        int               `json:"size"`
+	Owner       string            `json:"owner"`
+	Perm        string            `json:"perm"`
+	Accessed    string            `json:"accessed"`
+	Created     string            `json:"created"`
+	Group       string            `json:"group"`
+	Modified    string            `json:"modified"`
+	Hashes      map[string]string `json:"hashes,omitempty"`
+	MD5         string            `json:"MD5,omitempty"`
+	SHA1        string            `json:"SHA1,omitempty"`
+	SHA256      string            `json:"SHA256,omitempty"`
+	SHA512      string            `json:"SHA512,omitempty"`
+	Family      string            `json:"family,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	FirstSeen   string            `json:"firstSeen,omitempty"`
+	ThreatLabel string            `json:"threatLabel,omitempty"`
+	Similar     *SimilarFile      `json:"similar,omitempty"`
+	ELF         *elfinfo.Info     `json:"elf,omitempty"`
+}
+
+// SimilarFile is the known malicious file a candidate is similar to by its
+// fuzzy hashes. Score is the TLSH distance or the ssdeep score.
+type SimilarFile struct {
+	Path        string            `json:"path,omitempty"`
+	Hashes      map[string]string `json:"hashes"`
+	Family      string            `json:"family,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	ThreatLabel string            `json:"threatLabel,omitempty"`
+	Algorithm   string            `json:"algorithm"`
+	Score       int               `json:"score"`
+}
+
+func (s SimilarFile) hash() string {
+	return firstNonEmpty(s.Hashes["SHA256"], s.Hashes["SHA1"], s.Hashes["MD5"], s.Hashes["SHA512"], s.Hashes["BLAKE3"], s.Hashes[s.Algorithm])
+}
+
+// Describe names the similar file and how close it is, for reviewers.
+func (s SimilarFile) Describe() string {
+	description := firstNonEmpty(s.Path, s.hash())
+	if label := firstNonEmpty(s.ThreatLabel, s.Family); label != "" {
+		description += " (" + label + ")"
+	}
+	if s.Algorithm == "TLSH" {
+		return fmt.Sprintf("%s, TLSH distance %d", description, s.Score)
+	}
+	return fmt.Sprintf("%s, %s score %d", description, s.Algorithm, s.Score)
+}
+
+// status returns the status of a file of a report section, where
+// candidates similar to malware are suspicious-similar.
+func (f ScannedFiles) status(section string) string {
+	if section == "candidate" && f.Similar != nil {
+		return "suspicious-similar"
+	}
+	return section
+}
+
+// normalizeHashes moves the digests of reports written before hashes were
+// kept by algorithm into Hashes.
+func (f *ScannedFiles) normalizeHashes() {
+	for algorithm, digest := range map[string]string{"MD5": f.MD5, "SHA1": f.SHA1, "SHA256": f.SHA256, "SHA512": f.SHA512} {
+		if digest == "" {
+			continue
+		}
+		if f.Hashes == nil {
+			f.Hashes = make(map[string]string)
+		}
+		if f.Hashes[algorithm] == "" {
+			f.Hashes[algorithm] = digest
+		}
+	}
+	f.MD5, f.SHA1, f.SHA256, f.SHA512 = "", "", "", ""
+}
+
+// fileHash returns the digest a file is identified by across reports.
+func (f ScannedFiles) fileHash() string {
+	return firstNonEmpty(f.Hashes["SHA256"], f.Hashes["SHA1"], f.Hashes["MD5"], f.Hashes["SHA512"], f.Hashes["BLAKE3"])
 }
 
 type Metadata struct {
 	IPv4Address string `json:"ipv4"`
+	ScanTime    string `json:"scanTime,omitempty"`
+	ScanID      string `json:"scanId,omitempty"`
+	// Scan profile the agent was configured with, if any.
+	Profile        string `json:"profile,omitempty"`
+	ProfileVersion string `json:"profileVersion,omitempty"`
+	// Directories the agent scanned, if it sent them.
+	Directories []string `json:"directories,omitempty"`
 }
 
-func main() {
-	var metadata Metadata
-	if len(os.Args) != 2 {
-		fmt.Println("missing ipv4_address")
-		return
-	}
+var subcommands = map[string]func(args []string){
+	"export": runExport,
+	"check":  runCheck,
+	"table":  runTable,
+	"fleet":  runFleet,
+}
 
+func main() {
 	currentUser, err := user.Current()
 	if err != nil {
 		fmt.Println("Failed to get the current user:", err)
 		os.Exit(1)
 	}
-
 	envPath := fmt.Sprintf("/home/%s/.sys-check/.env/report_finalizer.env", currentUser.Username)
+
+	// Conversions also run outside the backend server, e.g. in CI, where
+	// settings come from the environment instead of the .env file.
+	if len(os.Args) > 1 {
+		if subcommand, ok := subcommands[os.Args[1]]; ok {
+			godotenv.Load(envPath)
+			subcommand(os.Args[2:])
+			return
+		}
+	}
+
+	var metadata Metadata
+	if len(os.Args) < 2 || len(os.Args) > 5 {
+		fmt.Println("missing ipv4_address")
+		return
+	}
+
 	err = godotenv.Load(envPath)
 	if err != nil {
 		log.Fatal("Error loading .env file")
 	}
 
 	metadata.IPv4Address = os.Args[1]
+	metadata.ScanTime = time.Now().UTC().Format(time.RFC3339)
+	metadata.ScanID = newScanID(metadata.IPv4Address, metadata.ScanTime)
+	// Agents name their scan, so sightings recorded by the analyzer can be
+	// traced back to this report.
+	if len(os.Args) >= 3 && os.Args[2] != "" {
+		metadata.ScanID = os.Args[2]
+	}
+	if len(os.Args) >= 4 {
+		metadata.Profile = os.Args[3]
+	}
+	if len(os.Args) == 5 {
+		metadata.ProfileVersion = os.Args[4]
+	}
 	reportsDir := os.Getenv("REPORTS_DIR")
 	dirPath := fmt.Sprintf("%s/%s", reportsDir, metadata.IPv4Address)
 
@@ -79,12 +189,24 @@ func main() {
 		combinedReport.CandidateFiles = append(combinedReport.CandidateFiles, report.CandidateFiles...)
 		combinedReport.MaliciousFiles = append(combinedReport.MaliciousFiles, report.MaliciousFiles...)
 		combinedReport.MaliciousVars = append(combinedReport.MaliciousVars, report.MaliciousVars...)
+		for _, dir := range report.Metadata.Directories {
+			if !containsString(metadata.Directories, dir) {
+				metadata.Directories = append(metadata.Directories, dir)
+			}
+		}
+		if report.LookupFilter != nil {
+			if combinedReport.LookupFilter == nil {
+				combinedReport.LookupFilter = &store.FilterMetrics{}
+			}
+			combinedReport.LookupFilter.Add(*report.LookupFilter)
+		}
 	}
 	combinedReport.Metadata = metadata
 
 	RemoveReports(filePaths)
 
 	WriteFinalReport(dirPath, combinedReport)
+	writeReportExports(dirPath, combinedReport)
 }
 
 func findJSONFiles(directory string) ([]string, error) {
@@ -94,7 +216,7 @@ func findJSONFiles(directory string) ([]string, error) {
 		if err != nil {
 			return err
 		}
-		if !info.IsDir() {
+		if !info.IsDir() && isPartialReport(info.Name()) {
 			filePaths = append(filePaths, path)
 		}
 		return nil
@@ -105,6 +227,12 @@ func findJSONFiles(directory string) ([]string, error) {
 	return filePaths, nil
 }
 
+// isPartialReport reports whether name is one of the
+// report-<timestamp>-<batch>.json files the analyzer writes for each batch.
+func isPartialReport(name string) bool {
+	return strings.HasPrefix(name, "report-") && strings.HasSuffix(name, ".json")
+}
+
 func readJSONFile(filePath string) (Report, error) {
 	var report Report
 
@@ -118,6 +246,11 @@ func readJSONFile(filePath string) (Report, error) {
 	if err != nil {
 		return report, err
 	}
+	for _, files := range [][]ScannedFiles{report.VerifiedFiles, report.CandidateFiles, report.MaliciousFiles} {
+		for i := range files {
+			files[i].normalizeHashes()
+		}
+	}
 	return report, nil
 }
 
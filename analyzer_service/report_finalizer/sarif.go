@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+const sarifSchema = "https://json.schemastore.org/sarif-2.1.0.json"
+
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool        sarifTool              `json:"tool"`
+	Invocations []sarifInvocation      `json:"invocations"`
+	Results     []sarifResult          `json:"results"`
+	Properties  map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifTool struct {
+	Driver sarifDriver `json:"driver"`
+}
+
+type sarifDriver struct {
+	Name           string      `json:"name"`
+	InformationURI string      `json:"informationUri"`
+	Rules          []sarifRule `json:"rules"`
+}
+
+type sarifRule struct {
+	ID                   string             `json:"id"`
+	Name                 string             `json:"name"`
+	ShortDescription     sarifMessage       `json:"shortDescription"`
+	DefaultConfiguration sarifConfiguration `json:"defaultConfiguration"`
+}
+
+type sarifConfiguration struct {
+	Level string `json:"level"`
+}
+
+type sarifInvocation struct {
+	ExecutionSuccessful bool   `json:"executionSuccessful"`
+	EndTimeUTC          string `json:"endTimeUtc"`
+}
+
+type sarifMessage struct {
+	Text string `json:"text"`
+}
+
+type sarifResult struct {
+	RuleID              string                 `json:"ruleId"`
+	RuleIndex           int                    `json:"ruleIndex"`
+	Level               string                 `json:"level"`
+	Message             sarifMessage           `json:"message"`
+	Locations           []sarifLocation        `json:"locations"`
+	PartialFingerprints map[string]string      `json:"partialFingerprints,omitempty"`
+	Properties          map[string]interface{} `json:"properties,omitempty"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation sarifPhysicalLocation `json:"physicalLocation"`
+}
+
+type sarifPhysicalLocation struct {
+	ArtifactLocation sarifArtifactLocation `json:"artifactLocation"`
+}
+
+type sarifArtifactLocation struct {
+	URI string `json:"uri"`
+}
+
+var sarifRules = []sarifRule{
+	{ID: "SC001", Name: "MaliciousFile", ShortDescription: sarifMessage{"File matches a known malicious hash"}},
+	{ID: "SC002", Name: "CandidateFile", ShortDescription: sarifMessage{"File is not a known verified file"}},
+	{ID: "SC003", Name: "SimilarFile", ShortDescription: sarifMessage{"File is similar to a known malicious file"}},
+}
+
+// writeSARIF writes a SARIF 2.1.0 log with one result per malicious or
+// candidate file, leveled by SEVERITY_MALICIOUS, SEVERITY_CANDIDATE and
+// SEVERITY_SIMILAR.
+func writeSARIF(report *Report, w io.Writer) error {
+	config, err := loadSeverityConfig()
+	if err != nil {
+		return err
+	}
+
+	rules := make([]sarifRule, len(sarifRules))
+	copy(rules, sarifRules)
+	rules[0].DefaultConfiguration.Level = config.malicious
+	rules[1].DefaultConfiguration.Level = config.candidate
+	rules[2].DefaultConfiguration.Level = config.similar
+
+	run := sarifRun{
+		Tool: sarifTool{Driver: sarifDriver{
+			Name:           "sys-check",
+			InformationURI: "https://github.com/shmitzas/sys-check",
+			Rules:          rules,
+		}},
+		Invocations: []sarifInvocation{{
+			ExecutionSuccessful: true,
+			EndTimeUTC:          scanTime(report).Format(time.RFC3339),
+		}},
+		Results:    []sarifResult{},
+		Properties: map[string]interface{}{"host": report.Metadata.IPv4Address},
+	}
+
+	for _, f := range config.findings(report) {
+		ruleIndex := 1
+		message := fmt.Sprintf("%s is not a known verified file", f.file.Path)
+		if f.status == "malicious" {
+			ruleIndex = 0
+			message = fmt.Sprintf("%s matches a known malicious hash", f.file.Path)
+			if label := firstNonEmpty(f.file.ThreatLabel, f.file.Family); label != "" {
+				message += " (" + label + ")"
+			}
+		}
+		if f.status == "suspicious-similar" {
+			ruleIndex = 2
+			message = fmt.Sprintf("%s is similar to %s", f.file.Path, f.file.Similar.Describe())
+		}
+
+		result := sarifResult{
+			RuleID:    rules[ruleIndex].ID,
+			RuleIndex: ruleIndex,
+			Level:     f.level,
+			Message:   sarifMessage{message},
+			Locations: []sarifLocation{{sarifPhysicalLocation{sarifArtifactLocation{fileURI(f.file.Path)}}}},
+			Properties: map[string]interface{}{
+				"host":   report.Metadata.IPv4Address,
+				"status": f.status,
+				"size":   f.file.Size,
+				"owner":  f.file.Owner,
+				"perm":   f.file.Perm,
+			},
+		}
+		if hash := f.file.fileHash(); hash != "" {
+			result.PartialFingerprints = map[string]string{"fileHash/v1": strings.ToLower(hash)}
+		}
+		if f.file.Source != "" {
+			result.Properties["source"] = f.file.Source
+		}
+		if f.file.Similar != nil {
+			result.Properties["similarTo"] = f.file.Similar.hash()
+			result.Properties["similarity"] = map[string]interface{}{"algorithm": f.file.Similar.Algorithm, "score": f.file.Similar.Score}
+		}
+		if f.file.ELF != nil {
+			result.Properties["elf"] = f.file.ELF
+		}
+		run.Results = append(run.Results, result)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(sarifLog{Schema: sarifSchema, Version: "2.1.0", Runs: []sarifRun{run}})
+}
+
+func fileURI(filePath string) string {
+	u := url.URL{Scheme: "file", Path: path.Clean("/" + filePath)}
+	return u.String()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Finding levels, ordered by severity, as used by SARIF.
+var severityLevels = []string{"none", "note", "warning", "error"}
+
+type severityConfig struct {
+	malicious string
+	candidate string
+	similar   string
+	failLevel string
+}
+
+type finding struct {
+	file   ScannedFiles
+	status string
+	level  string
+}
+
+// loadSeverityConfig reads the level given to malicious, candidate and
+// suspicious-similar files from SEVERITY_MALICIOUS, SEVERITY_CANDIDATE and
+// SEVERITY_SIMILAR, and the lowest level that counts as a failure from
+// FAIL_LEVEL.
+func loadSeverityConfig() (severityConfig, error) {
+	config := severityConfig{
+		malicious: envOrDefault("SEVERITY_MALICIOUS", "error"),
+		candidate: envOrDefault("SEVERITY_CANDIDATE", "warning"),
+		similar:   envOrDefault("SEVERITY_SIMILAR", "error"),
+		failLevel: envOrDefault("FAIL_LEVEL", "error"),
+	}
+	for name, level := range map[string]string{
+		"SEVERITY_MALICIOUS": config.malicious,
+		"SEVERITY_CANDIDATE": config.candidate,
+		"SEVERITY_SIMILAR":   config.similar,
+		"FAIL_LEVEL":         config.failLevel,
+	} {
+		if severityRank(level) < 0 {
+			return config, fmt.Errorf("invalid %s %q, expected one of: %s", name, level, strings.Join(severityLevels, ", "))
+		}
+	}
+	return config, nil
+}
+
+func (config severityConfig) findings(report *Report) []finding {
+	var findings []finding
+	for _, file := range report.MaliciousFiles {
+		findings = append(findings, finding{file: file, status: "malicious", level: config.malicious})
+	}
+	for _, file := range report.CandidateFiles {
+		if file.Similar != nil {
+			findings = append(findings, finding{file: file, status: "suspicious-similar", level: config.similar})
+			continue
+		}
+		findings = append(findings, finding{file: file, status: "candidate", level: config.candidate})
+	}
+	return findings
+}
+
+// fails reports whether a finding of the given level fails the scan. A
+// FAIL_LEVEL of none never fails.
+func (config severityConfig) fails(level string) bool {
+	if config.failLevel == "none" {
+		return false
+	}
+	return severityRank(level) >= severityRank(config.failLevel)
+}
+
+func severityRank(level string) int {
+	for i, l := range severityLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+func envOrDefault(name, value string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return value
+}
+
+// runCheck exits with status 1 when the final report contains findings at
+// or above FAIL_LEVEL: check <final report>
+func runCheck(args []string) {
+	if len(args) != 1 {
+		fmt.Println("Usage: ./report_finalizer check <full path to final report>")
+		os.Exit(2)
+	}
+
+	config, err := loadSeverityConfig()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	report, err := readJSONFile(args[0])
+	if err != nil {
+		fmt.Printf("error reading JSON file %s: %v\n", args[0], err)
+		os.Exit(2)
+	}
+
+	failures := 0
+	for _, f := range config.findings(&report) {
+		if config.fails(f.level) {
+			failures++
+			fmt.Printf("%s: %s file %s\n", f.level, f.status, f.file.Path)
+		}
+	}
+	fmt.Printf("%d malicious, %d candidate, %d verified files, %d failures at level %s or above\n",
+		len(report.MaliciousFiles), len(report.CandidateFiles), len(report.VerifiedFiles), failures, config.failLevel)
+	if failures > 0 {
+		os.Exit(1)
+	}
+}
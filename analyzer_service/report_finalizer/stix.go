@@ -0,0 +1,275 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const stixTimeFormat = "2006-01-02T15:04:05.000Z"
+
+var (
+	// Namespace defined by STIX 2.1 for deterministic cyber observable IDs.
+	stixObservableNamespace = mustParseUUID("00abedb4-aa42-466c-9c01-fed23315a9b7")
+	// RFC 4122 DNS namespace, used to derive a namespace for sys-check objects.
+	dnsNamespace      = mustParseUUID("6ba7b810-9dad-11d1-80b4-00c04fd430c8")
+	sysCheckNamespace = mustParseUUID(uuidV5(dnsNamespace, "sys-check"))
+)
+
+type stixBundle struct {
+	Type    string        `json:"type"`
+	ID      string        `json:"id"`
+	Objects []interface{} `json:"objects"`
+}
+
+type stixIdentity struct {
+	Type          string `json:"type"`
+	SpecVersion   string `json:"spec_version"`
+	ID            string `json:"id"`
+	Created       string `json:"created"`
+	Modified      string `json:"modified"`
+	Name          string `json:"name"`
+	IdentityClass string `json:"identity_class"`
+}
+
+type stixFile struct {
+	Type        string            `json:"type"`
+	SpecVersion string            `json:"spec_version"`
+	ID          string            `json:"id"`
+	Hashes      map[string]string `json:"hashes"`
+	Size        int               `json:"size,omitempty"`
+	Name        string            `json:"name,omitempty"`
+}
+
+type stixIndicator struct {
+	Type           string   `json:"type"`
+	SpecVersion    string   `json:"spec_version"`
+	ID             string   `json:"id"`
+	CreatedByRef   string   `json:"created_by_ref"`
+	Created        string   `json:"created"`
+	Modified       string   `json:"modified"`
+	Name           string   `json:"name"`
+	Description    string   `json:"description,omitempty"`
+	IndicatorTypes []string `json:"indicator_types"`
+	Pattern        string   `json:"pattern"`
+	PatternType    string   `json:"pattern_type"`
+	ValidFrom      string   `json:"valid_from"`
+	Labels         []string `json:"labels,omitempty"`
+}
+
+type stixObservedData struct {
+	Type           string   `json:"type"`
+	SpecVersion    string   `json:"spec_version"`
+	ID             string   `json:"id"`
+	CreatedByRef   string   `json:"created_by_ref"`
+	Created        string   `json:"created"`
+	Modified       string   `json:"modified"`
+	FirstObserved  string   `json:"first_observed"`
+	LastObserved   string   `json:"last_observed"`
+	NumberObserved int      `json:"number_observed"`
+	ObjectRefs     []string `json:"object_refs"`
+}
+
+type stixSighting struct {
+	Type             string   `json:"type"`
+	SpecVersion      string   `json:"spec_version"`
+	ID               string   `json:"id"`
+	CreatedByRef     string   `json:"created_by_ref"`
+	Created          string   `json:"created"`
+	Modified         string   `json:"modified"`
+	Description      string   `json:"description,omitempty"`
+	FirstSeen        string   `json:"first_seen"`
+	LastSeen         string   `json:"last_seen"`
+	Count            int      `json:"count"`
+	SightingOfRef    string   `json:"sighting_of_ref"`
+	ObservedDataRefs []string `json:"observed_data_refs"`
+	WhereSightedRefs []string `json:"where_sighted_refs"`
+}
+
+// writeSTIXBundle writes the report's malicious files as a STIX 2.1 bundle
+// with a file observable, an indicator and a sighting on the scanned host
+// for each of them.
+func writeSTIXBundle(report *Report, w io.Writer) error {
+	scanned := scanTime(report)
+	timestamp := scanned.Format(stixTimeFormat)
+	host := report.Metadata.IPv4Address
+	sightingKey := host + "|" + timestamp
+
+	producer := stixIdentity{
+		Type:          "identity",
+		SpecVersion:   "2.1",
+		ID:            "identity--" + uuidV5(sysCheckNamespace, "producer"),
+		Created:       timestamp,
+		Modified:      timestamp,
+		Name:          "sys-check",
+		IdentityClass: "system",
+	}
+	hostIdentity := stixIdentity{
+		Type:          "identity",
+		SpecVersion:   "2.1",
+		ID:            "identity--" + uuidV5(sysCheckNamespace, "host|"+host),
+		Created:       timestamp,
+		Modified:      timestamp,
+		Name:          host,
+		IdentityClass: "system",
+	}
+
+	bundle := stixBundle{
+		Type:    "bundle",
+		ID:      "bundle--" + uuidV5(sysCheckNamespace, "bundle|"+sightingKey),
+		Objects: []interface{}{producer, hostIdentity},
+	}
+
+	for _, file := range report.MaliciousFiles {
+		hashes := stixHashes(file)
+		if len(hashes) == 0 {
+			continue
+		}
+
+		observable := stixFile{
+			Type:        "file",
+			SpecVersion: "2.1",
+			ID:          "file--" + stixObservableID(hashes, file.Name),
+			Hashes:      hashes,
+			Size:        file.Size,
+			Name:        file.Name,
+		}
+
+		validFrom := timestamp
+		if firstSeen, err := time.Parse(time.RFC3339, file.FirstSeen); err == nil {
+			validFrom = firstSeen.UTC().Format(stixTimeFormat)
+		}
+		indicator := stixIndicator{
+			Type:           "indicator",
+			SpecVersion:    "2.1",
+			ID:             "indicator--" + uuidV5(sysCheckNamespace, "indicator|"+stixPattern(hashes)),
+			CreatedByRef:   producer.ID,
+			Created:        timestamp,
+			Modified:       timestamp,
+			Name:           indicatorName(file),
+			Description:    indicatorDescription(file),
+			IndicatorTypes: []string{"malicious-activity"},
+			Pattern:        stixPattern(hashes),
+			PatternType:    "stix",
+			ValidFrom:      validFrom,
+		}
+		if file.Family != "" {
+			indicator.Labels = []string{file.Family}
+		}
+
+		observed := stixObservedData{
+			Type:           "observed-data",
+			SpecVersion:    "2.1",
+			ID:             "observed-data--" + uuidV5(sysCheckNamespace, "observed|"+sightingKey+"|"+file.Path+"|"+observable.ID),
+			CreatedByRef:   producer.ID,
+			Created:        timestamp,
+			Modified:       timestamp,
+			FirstObserved:  timestamp,
+			LastObserved:   timestamp,
+			NumberObserved: 1,
+			ObjectRefs:     []string{observable.ID},
+		}
+
+		sighting := stixSighting{
+			Type:             "sighting",
+			SpecVersion:      "2.1",
+			ID:               "sighting--" + uuidV5(sysCheckNamespace, "sighting|"+sightingKey+"|"+file.Path+"|"+observable.ID),
+			CreatedByRef:     producer.ID,
+			Created:          timestamp,
+			Modified:         timestamp,
+			Description:      fmt.Sprintf("%s found on %s", file.Path, host),
+			FirstSeen:        timestamp,
+			LastSeen:         timestamp,
+			Count:            1,
+			SightingOfRef:    indicator.ID,
+			ObservedDataRefs: []string{observed.ID},
+			WhereSightedRefs: []string{hostIdentity.ID},
+		}
+
+		bundle.Objects = append(bundle.Objects, observable, indicator, observed, sighting)
+	}
+
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(bundle)
+}
+
+func stixHashes(file ScannedFiles) map[string]string {
+	hashes := make(map[string]string)
+	for algorithm, value := range map[string]string{
+		"MD5":     file.Hashes["MD5"],
+		"SHA-1":   file.Hashes["SHA1"],
+		"SHA-256": file.Hashes["SHA256"],
+		"SHA-512": file.Hashes["SHA512"],
+	} {
+		if value != "" {
+			hashes[algorithm] = strings.ToLower(value)
+		}
+	}
+	// Fuzzy hashes are not hex digests and keep their case
+	for algorithm, value := range map[string]string{"SSDEEP": file.Hashes["SSDEEP"], "TLSH": file.Hashes["TLSH"]} {
+		if value != "" {
+			hashes[algorithm] = value
+		}
+	}
+	return hashes
+}
+
+// stixObservableID computes the deterministic file ID from its ID
+// contributing properties: the name and the first available of the MD5,
+// SHA-1, SHA-256 and SHA-512 hashes.
+func stixObservableID(hashes map[string]string, name string) string {
+	contributing := make(map[string]interface{})
+	for _, algorithm := range []string{"MD5", "SHA-1", "SHA-256", "SHA-512"} {
+		if value, ok := hashes[algorithm]; ok {
+			contributing["hashes"] = map[string]string{algorithm: value}
+			break
+		}
+	}
+	if name != "" {
+		contributing["name"] = name
+	}
+
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(contributing)
+	return uuidV5(stixObservableNamespace, strings.TrimSpace(buf.String()))
+}
+
+func stixPattern(hashes map[string]string) string {
+	var comparisons []string
+	for _, algorithm := range []string{"SHA-256", "SHA-512", "SHA-1", "MD5"} {
+		if value, ok := hashes[algorithm]; ok {
+			comparisons = append(comparisons, fmt.Sprintf("file:hashes.'%s' = '%s'", algorithm, value))
+		}
+	}
+	return "[" + strings.Join(comparisons, " OR ") + "]"
+}
+
+func indicatorName(file ScannedFiles) string {
+	if file.ThreatLabel != "" {
+		return file.ThreatLabel
+	}
+	if file.Family != "" {
+		return file.Family
+	}
+	return "Known malicious file " + file.Name
+}
+
+func indicatorDescription(file ScannedFiles) string {
+	var parts []string
+	if file.Family != "" {
+		parts = append(parts, "family "+file.Family)
+	}
+	if file.Source != "" {
+		parts = append(parts, "reported by "+file.Source)
+	}
+	if len(parts) == 0 {
+		return ""
+	}
+	return "Known malicious file, " + strings.Join(parts, ", ")
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"common/store"
+
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/writer"
+)
+
+// Parquet buffers a row group in memory before writing it out.
+const parquetRowGroupSize = 32 * 1024 * 1024
+
+type tableRow struct {
+	Host        string `parquet:"name=host, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ScanID      string `parquet:"name=scan_id, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ScanTime    string `parquet:"name=scan_time, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Status      string `parquet:"name=status, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Path        string `parquet:"name=path, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Name        string `parquet:"name=name, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Size        int64  `parquet:"name=size, type=INT64"`
+	Owner       string `parquet:"name=owner, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Group       string `parquet:"name=group, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Perm        string `parquet:"name=perm, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Accessed    string `parquet:"name=accessed, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Created     string `parquet:"name=created, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Modified    string `parquet:"name=modified, type=BYTE_ARRAY, convertedtype=UTF8"`
+	MD5         string `parquet:"name=md5, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SHA1        string `parquet:"name=sha1, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SHA256      string `parquet:"name=sha256, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SHA512      string `parquet:"name=sha512, type=BYTE_ARRAY, convertedtype=UTF8"`
+	BLAKE3      string `parquet:"name=blake3, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SSDEEP      string `parquet:"name=ssdeep, type=BYTE_ARRAY, convertedtype=UTF8"`
+	TLSH        string `parquet:"name=tlsh, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Family      string `parquet:"name=family, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Source      string `parquet:"name=source, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	ThreatLabel string `parquet:"name=threat_label, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Container   string `parquet:"name=container, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SimilarTo   string `parquet:"name=similar_to, type=BYTE_ARRAY, convertedtype=UTF8"`
+	SimilarBy   string `parquet:"name=similar_algorithm, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Similarity  *int64 `parquet:"name=similar_score, type=INT64, repetitiontype=OPTIONAL"`
+
+	// ELF facts, only set for ELF files the agent inspected.
+	Arch        string   `parquet:"name=elf_architecture, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Interpreter string   `parquet:"name=elf_interpreter, type=BYTE_ARRAY, convertedtype=UTF8, encoding=PLAIN_DICTIONARY"`
+	Libraries   string   `parquet:"name=elf_libraries, type=BYTE_ARRAY, convertedtype=UTF8"`
+	BuildID     string   `parquet:"name=elf_build_id, type=BYTE_ARRAY, convertedtype=UTF8"`
+	Stripped    *bool    `parquet:"name=elf_stripped, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	Static      *bool    `parquet:"name=elf_static, type=BOOLEAN, repetitiontype=OPTIONAL"`
+	MaxEntropy  *float64 `parquet:"name=elf_max_entropy, type=DOUBLE, repetitiontype=OPTIONAL"`
+	KnownBuild  *bool    `parquet:"name=elf_known_build_id, type=BOOLEAN, repetitiontype=OPTIONAL"`
+}
+
+var tableColumns = []string{
+	"host", "scan_id", "scan_time", "status", "path", "name", "size", "owner", "group", "perm",
+	"accessed", "created", "modified", "md5", "sha1", "sha256", "sha512", "family", "source", "threat_label", "container",
+	"blake3", "ssdeep", "tlsh", "similar_to", "similar_algorithm", "similar_score",
+	"elf_architecture", "elf_interpreter", "elf_libraries", "elf_build_id", "elf_stripped", "elf_static", "elf_max_entropy",
+	"elf_known_build_id",
+}
+
+func newTableRow(metadata Metadata, status string, file ScannedFiles) tableRow {
+	row := tableRow{
+		Host:        metadata.IPv4Address,
+		ScanID:      metadata.ScanID,
+		ScanTime:    metadata.ScanTime,
+		Status:      file.status(status),
+		Path:        file.Path,
+		Name:        file.Name,
+		Size:        int64(file.Size),
+		Owner:       file.Owner,
+		Group:       file.Group,
+		Perm:        file.Perm,
+		Accessed:    file.Accessed,
+		Created:     file.Created,
+		Modified:    file.Modified,
+		MD5:         file.Hashes["MD5"],
+		SHA1:        file.Hashes["SHA1"],
+		SHA256:      file.Hashes["SHA256"],
+		SHA512:      file.Hashes["SHA512"],
+		BLAKE3:      file.Hashes["BLAKE3"],
+		SSDEEP:      file.Hashes["SSDEEP"],
+		TLSH:        file.Hashes["TLSH"],
+		Family:      file.Family,
+		Source:      file.Source,
+		ThreatLabel: file.ThreatLabel,
+		Container:   file.Container,
+	}
+	if file.Similar != nil {
+		score := int64(file.Similar.Score)
+		row.SimilarTo = file.Similar.hash()
+		row.SimilarBy = file.Similar.Algorithm
+		row.Similarity = &score
+	}
+	if elf := file.ELF; elf != nil {
+		row.Arch = elf.Architecture
+		row.Interpreter = elf.Interpreter
+		row.Libraries = strings.Join(elf.Libraries, " ")
+		row.BuildID = elf.BuildID
+		row.Stripped = &elf.Stripped
+		row.Static = &elf.Static
+		row.MaxEntropy = &elf.MaxEntropy
+		row.KnownBuild = elf.KnownBuild
+	}
+	return row
+}
+
+type tableWriter interface {
+	Write(row tableRow) error
+	Close() error
+}
+
+func newTableWriter(format string, w io.Writer) (tableWriter, error) {
+	switch format {
+	case "csv":
+		return newCSVTableWriter(w)
+	case "parquet":
+		return newParquetTableWriter(w)
+	}
+	return nil, fmt.Errorf("unknown table format %q, expected csv or parquet", format)
+}
+
+type csvTableWriter struct {
+	writer *csv.Writer
+	record []string
+}
+
+func newCSVTableWriter(w io.Writer) (*csvTableWriter, error) {
+	writer := csv.NewWriter(w)
+	if err := writer.Write(tableColumns); err != nil {
+		return nil, err
+	}
+	return &csvTableWriter{writer: writer, record: make([]string, len(tableColumns))}, nil
+}
+
+func (t *csvTableWriter) Write(row tableRow) error {
+	t.record = append(t.record[:0],
+		row.Host, row.ScanID, row.ScanTime, row.Status, row.Path, row.Name, strconv.FormatInt(row.Size, 10),
+		row.Owner, row.Group, row.Perm, row.Accessed, row.Created, row.Modified,
+		row.MD5, row.SHA1, row.SHA256, row.SHA512, row.Family, row.Source, row.ThreatLabel, row.Container,
+		row.BLAKE3, row.SSDEEP, row.TLSH, row.SimilarTo, row.SimilarBy, optionalInt(row.Similarity),
+		row.Arch, row.Interpreter, row.Libraries, row.BuildID, optionalBool(row.Stripped), optionalBool(row.Static),
+		optionalFloat(row.MaxEntropy), optionalBool(row.KnownBuild))
+	return t.writer.Write(t.record)
+}
+
+// Missing optional values are empty in CSV.
+func optionalInt(v *int64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatInt(*v, 10)
+}
+
+func optionalBool(v *bool) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatBool(*v)
+}
+
+func optionalFloat(v *float64) string {
+	if v == nil {
+		return ""
+	}
+	return strconv.FormatFloat(*v, 'f', -1, 64)
+}
+
+func (t *csvTableWriter) Close() error {
+	t.writer.Flush()
+	return t.writer.Error()
+}
+
+type parquetTableWriter struct {
+	writer *writer.ParquetWriter
+}
+
+func newParquetTableWriter(w io.Writer) (*parquetTableWriter, error) {
+	pw, err := writer.NewParquetWriterFromWriter(w, new(tableRow), 1)
+	if err != nil {
+		return nil, err
+	}
+	pw.RowGroupSize = parquetRowGroupSize
+	pw.CompressionType = parquet.CompressionCodec_SNAPPY
+	return &parquetTableWriter{writer: pw}, nil
+}
+
+func (t *parquetTableWriter) Write(row tableRow) error {
+	return t.writer.Write(row)
+}
+
+func (t *parquetTableWriter) Close() error {
+	return t.writer.WriteStop()
+}
+
+func writeCSVTable(report *Report, w io.Writer) error {
+	return writeTable("csv", report, w)
+}
+
+func writeParquetTable(report *Report, w io.Writer) error {
+	return writeTable("parquet", report, w)
+}
+
+func writeTable(format string, report *Report, w io.Writer) error {
+	table, err := newTableWriter(format, w)
+	if err != nil {
+		return err
+	}
+	metadata := tableMetadata(report.Metadata)
+	for _, section := range []struct {
+		status string
+		files  []ScannedFiles
+	}{
+		{"malicious", report.MaliciousFiles},
+		{"candidate", report.CandidateFiles},
+		{"verified", report.VerifiedFiles},
+	} {
+		for _, file := range section.files {
+			if err := table.Write(newTableRow(metadata, section.status, file)); err != nil {
+				return err
+			}
+		}
+	}
+	return table.Close()
+}
+
+// tableMetadata fills in the scan ID of reports finalized before it was
+// recorded.
+func tableMetadata(metadata Metadata) Metadata {
+	if metadata.ScanID == "" {
+		metadata.ScanID = newScanID(metadata.IPv4Address, metadata.ScanTime)
+	}
+	return metadata
+}
+
+func newScanID(host, scanTime string) string {
+	return uuidV5(sysCheckNamespace, "scan|"+host+"|"+scanTime)
+}
+
+// runTable streams one row per file of many final reports into a single
+// table: table <csv|parquet> <output file> [<final report>...]. Without
+// report arguments the latest final report of every host in REPORTS_DIR
+// is exported.
+func runTable(args []string) {
+	if len(args) < 2 {
+		fmt.Println("Usage: ./report_finalizer table <csv|parquet> <output file> [<full path to final report>...]")
+		os.Exit(2)
+	}
+	format, outputPath, reportPaths := args[0], args[1], args[2:]
+
+	if len(reportPaths) == 0 {
+		var err error
+		reportPaths, err = filepath.Glob(filepath.Join(os.Getenv("REPORTS_DIR"), "*", "final-report.json"))
+		if err != nil || len(reportPaths) == 0 {
+			fmt.Println("no final reports found in REPORTS_DIR")
+			os.Exit(1)
+		}
+	}
+
+	file, err := os.Create(outputPath)
+	if err != nil {
+		fmt.Println("error creating file:", err)
+		os.Exit(1)
+	}
+	defer file.Close()
+	buffered := bufio.NewWriter(file)
+
+	table, err := newTableWriter(format, buffered)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(2)
+	}
+
+	rows := 0
+	for _, reportPath := range reportPaths {
+		err := streamReport(reportPath, func(metadata Metadata, status string, file ScannedFiles) error {
+			rows++
+			return table.Write(newTableRow(metadata, status, file))
+		}, nil)
+		if err != nil {
+			fmt.Printf("error exporting %s: %v\n", reportPath, err)
+			os.Exit(1)
+		}
+	}
+	if err := table.Close(); err != nil {
+		fmt.Println("error writing table:", err)
+		os.Exit(1)
+	}
+	if err := buffered.Flush(); err != nil {
+		fmt.Println("error writing table:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d files from %d reports to %s\n", rows, len(reportPaths), outputPath)
+}
+
+// streamReport decodes a final report one file at a time, so reports do
+// not need to fit in memory. The metadata object must come before the file
+// lists, as written by WriteFinalReport. The lookup filter metrics of the
+// report are decoded into lookupFilter unless it is nil.
+func streamReport(reportPath string, onFile func(metadata Metadata, status string, file ScannedFiles) error, lookupFilter *store.FilterMetrics) error {
+	file, err := os.Open(reportPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReaderSize(file, 1<<20))
+	if err := expectDelim(decoder, '{'); err != nil {
+		return err
+	}
+
+	var metadata Metadata
+	haveMetadata := false
+	sections := map[string]string{
+		"verifiedFiles":  "verified",
+		"candidateFiles": "candidate",
+		"maliciousFiles": "malicious",
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
+		if err != nil {
+			return err
+		}
+		key, _ := token.(string)
+
+		if key == "metadata" {
+			if err := decoder.Decode(&metadata); err != nil {
+				return err
+			}
+			if metadata.ScanTime == "" {
+				if info, err := file.Stat(); err == nil {
+					metadata.ScanTime = info.ModTime().UTC().Format(time.RFC3339)
+				}
+			}
+			metadata = tableMetadata(metadata)
+			haveMetadata = true
+			continue
+		}
+
+		if key == "lookupFilter" && lookupFilter != nil {
+			if err := decoder.Decode(lookupFilter); err != nil {
+				return err
+			}
+			continue
+		}
+
+		status, ok := sections[key]
+		if !ok {
+			var skip json.RawMessage
+			if err := decoder.Decode(&skip); err != nil {
+				return err
+			}
+			continue
+		}
+		if !haveMetadata {
+			return errors.New("report metadata must precede the file lists")
+		}
+
+		token, err = decoder.Token()
+		if err != nil {
+			return err
+		}
+		if token == nil {
+			continue
+		}
+		if delim, ok := token.(json.Delim); !ok || delim != '[' {
+			return fmt.Errorf("expected an array of files in %s", key)
+		}
+		for decoder.More() {
+			var scanned ScannedFiles
+			if err := decoder.Decode(&scanned); err != nil {
+				return err
+			}
+			scanned.normalizeHashes()
+			if err := onFile(metadata, status, scanned); err != nil {
+				return err
+			}
+		}
+		if err := expectDelim(decoder, ']'); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func expectDelim(decoder *json.Decoder, delim json.Delim) error {
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if d, ok := token.(json.Delim); !ok || d != delim {
+		return fmt.Errorf("unexpected JSON token %v, expected %s", token, strings.TrimSpace(string(delim)))
+	}
+	return nil
+}
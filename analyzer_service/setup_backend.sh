@@ -8,8 +8,10 @@ mkdir "/home/${user}/.sys-check/"
 mkdir "/home/${user}/.sys-check/.env/"
 mkdir "/home/${user}/.sys-check/reports/"
 mkdir "/home/${user}/.sys-check/logs/"
+mkdir "/home/${user}/.sys-check/profiles/"
 cp "${sys_check_repo_location}/analyzer_service/analyzer/.env.example" "/home/${user}/.sys-check/.env/analyzer.env"
 cp "${sys_check_repo_location}/analyzer_service/listener/.env.example" "/home/${user}/.sys-check/.env/listener.env"
 cp "${sys_check_repo_location}/analyzer_service/report_finalizer/.env.example" "/home/${user}/.sys-check/.env/report_finalizer.env"
+cp "${sys_check_repo_location}/analyzer_service/listener/profile.json.example" "/home/${user}/.sys-check/profiles/default.json"
 
 sudo apt install -y golang-go
\ No newline at end of file
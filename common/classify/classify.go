@@ -0,0 +1,114 @@
+// Package classify holds the rules that turn the known files matching a
+// scanned file into the status it is reported with. The analyzer applies
+// them to its store and the scanning agent's verifier to a snapshot.
+package classify
+
+import (
+	"context"
+	"time"
+
+	"common/store"
+)
+
+// Result is how a scanned file is reported, with the threat intelligence
+// of the known file it matched.
+type Result struct {
+	Status      string
+	Family      string
+	Source      string
+	FirstSeen   string
+	ThreatLabel string
+}
+
+// Classify returns the result of a scanned file from its matches, of
+// which the oldest known file decides, and whether the file is known at
+// all. Unknown files are candidates.
+func Classify(matches []store.File) (Result, bool) {
+	if len(matches) == 0 {
+		return Result{Status: "candidate"}, false
+	}
+	known := matches[0]
+	result := Result{
+		Status:      known.Status,
+		Family:      known.Family,
+		Source:      known.Source,
+		ThreatLabel: known.ThreatLabel,
+	}
+	if known.FirstSeen != nil {
+		result.FirstSeen = known.FirstSeen.Format(time.RFC3339)
+	}
+	if result.Status == "" {
+		result.Status = "candidate"
+		return result, false
+	}
+	return result, true
+}
+
+// Valid reports whether the hashes of a scanned file can be looked up.
+// Files with invalid hashes are candidates without a lookup.
+func Valid(h store.Hashes) error {
+	return h.Validate()
+}
+
+// Match holds the known files matching the hashes of a scanned file.
+type Match struct {
+	Files []store.File
+	// Invalid is why the hashes could not be looked up.
+	Invalid error
+	// Filtered is set when the lookup filter ruled the hashes out, so
+	// they were not looked up.
+	Filtered bool
+}
+
+// Lookup looks up the valid hashes of scanned files with a single query.
+// With a filter, only hashes it may know are looked up and metrics counts
+// how often it was right.
+func Lookup(ctx context.Context, st store.Operations, hs []store.Hashes, filter *store.Filter, metrics *store.FilterMetrics) ([]Match, error) {
+	matches := make([]Match, len(hs))
+	var queried []int
+	var lookups []store.Hashes
+	for i, h := range hs {
+		if err := Valid(h); err != nil {
+			matches[i].Invalid = err
+			continue
+		}
+		if filter != nil && !filter.MayContain(h) {
+			matches[i].Filtered = true
+			metrics.Misses++
+			continue
+		}
+		if filter != nil {
+			metrics.Hits++
+		}
+		queried = append(queried, i)
+		lookups = append(lookups, h)
+	}
+	if len(lookups) == 0 {
+		return matches, nil
+	}
+	found, err := st.BulkLookup(ctx, lookups)
+	if err != nil {
+		return nil, err
+	}
+	for n, i := range queried {
+		matches[i].Files = found[n]
+		if filter != nil && len(found[n]) == 0 {
+			metrics.FalsePositives++
+		}
+	}
+	return matches, nil
+}
+
+// Files classifies scanned files by their hashes with a single lookup,
+// without changing the store.
+func Files(ctx context.Context, st store.Operations, hs []store.Hashes) ([]Result, error) {
+	matches, err := Lookup(ctx, st, hs, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	results := make([]Result, len(hs))
+	for i, m := range matches {
+		results[i], _ = Classify(m.Files)
+	}
+	return results, nil
+}
@@ -0,0 +1,250 @@
+// Package elfinfo extracts what reviewers look at first in an unknown
+// Linux binary from its ELF headers: the architecture, how it is linked,
+// its GNU build ID, whether it is stripped and how random its sections
+// are. Packed or encrypted code has an entropy close to 8 bits per byte.
+package elfinfo
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// Sections with at least this many bits of entropy per byte hold
+// compressed or encrypted data, rarely code or tables.
+const HighEntropy = 7.2
+
+// Note type of the GNU build ID.
+const ntGNUBuildID = 3
+
+// Info describes an ELF file.
+type Info struct {
+	Class        string    `json:"class"`
+	Architecture string    `json:"architecture"`
+	Type         string    `json:"type"`
+	Interpreter  string    `json:"interpreter,omitempty"`
+	Libraries    []string  `json:"libraries,omitempty"`
+	BuildID      string    `json:"buildId,omitempty"`
+	Stripped     bool      `json:"stripped"`
+	Static       bool      `json:"static"`
+	Sections     []Section `json:"sections,omitempty"`
+	// Highest entropy of the sections, or of the loadable segments of
+	// files without section headers, as packers like UPX leave them.
+	MaxEntropy  float64 `json:"maxEntropy"`
+	HighEntropy bool    `json:"highEntropy"`
+	// Whether a debuginfod server of the distributions knows BuildID, as
+	// the analyzer looks it up. Unset when it was not looked up.
+	KnownBuild *bool `json:"knownBuildId,omitempty"`
+}
+
+// Section is a section with contents in the file and its entropy in bits
+// per byte.
+type Section struct {
+	Name    string  `json:"name"`
+	Size    uint64  `json:"size"`
+	Entropy float64 `json:"entropy"`
+}
+
+// Describe summarizes the ELF facts in one line, for reviewers.
+func (e Info) Describe() string {
+	facts := []string{e.Architecture + " " + e.Type}
+	if e.Static {
+		facts = append(facts, "static")
+	} else {
+		facts = append(facts, fmt.Sprintf("dynamic with %d libraries", len(e.Libraries)))
+	}
+	if e.Stripped {
+		facts = append(facts, "stripped")
+	}
+	if e.BuildID != "" {
+		buildID := "build ID " + e.BuildID
+		if e.KnownBuild != nil && *e.KnownBuild {
+			buildID += " (known to debuginfod)"
+		}
+		if e.KnownBuild != nil && !*e.KnownBuild {
+			buildID += " (unknown to debuginfod)"
+		}
+		facts = append(facts, buildID)
+	}
+	entropy := fmt.Sprintf("max entropy %.2f", e.MaxEntropy)
+	if e.HighEntropy {
+		entropy += " (high, packed or encrypted)"
+	}
+	return strings.Join(append(facts, entropy), ", ")
+}
+
+var architectures = map[elf.Machine]string{
+	elf.EM_386:     "i386",
+	elf.EM_X86_64:  "x86_64",
+	elf.EM_ARM:     "arm",
+	elf.EM_AARCH64: "aarch64",
+	elf.EM_RISCV:   "riscv",
+	elf.EM_PPC:     "ppc",
+	elf.EM_PPC64:   "ppc64",
+	elf.EM_S390:    "s390",
+	elf.EM_MIPS:    "mips",
+}
+
+// IsELF reports whether the file at path starts with the ELF magic number.
+func IsELF(path string) bool {
+	f, err := os.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	magic := make([]byte, len(elf.ELFMAG))
+	_, err = io.ReadFull(f, magic)
+	return err == nil && string(magic) == elf.ELFMAG
+}
+
+// Inspect reads the ELF file at path.
+func Inspect(path string) (info *Info, err error) {
+	// Malware is crafted to break parsers, which must not take the
+	// scan down with it.
+	defer func() {
+		if r := recover(); r != nil {
+			info, err = nil, fmt.Errorf("malformed ELF file: %v", r)
+		}
+	}()
+	f, err := elf.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	info = &Info{
+		Class:        strings.TrimPrefix(f.Class.String(), "ELFCLASS"),
+		Architecture: architectures[f.Machine],
+		Type:         strings.TrimPrefix(f.Type.String(), "ET_"),
+	}
+	if info.Architecture == "" {
+		info.Architecture = strings.ToLower(strings.TrimPrefix(f.Machine.String(), "EM_"))
+	}
+	for _, p := range f.Progs {
+		if p.Type != elf.PT_INTERP {
+			continue
+		}
+		interpreter, err := io.ReadAll(p.Open())
+		if err != nil {
+			return nil, fmt.Errorf("invalid interpreter: %v", err)
+		}
+		info.Interpreter = string(bytes.TrimRight(interpreter, "\x00"))
+	}
+	// Files without a dynamic section have no libraries.
+	info.Libraries, _ = f.ImportedLibraries()
+	info.Static = info.Interpreter == "" && len(info.Libraries) == 0
+	info.Stripped = f.Section(".symtab") == nil
+	info.BuildID = buildID(f)
+
+	// Sections and segments reaching past the end of the file are
+	// skipped.
+	for _, s := range f.Sections {
+		if s.Type == elf.SHT_NOBITS || s.Size == 0 {
+			continue
+		}
+		entropy, err := entropyOf(s.Open())
+		if err != nil {
+			continue
+		}
+		info.Sections = append(info.Sections, Section{Name: s.Name, Size: s.Size, Entropy: entropy})
+		info.MaxEntropy = math.Max(info.MaxEntropy, entropy)
+	}
+	if len(f.Sections) == 0 {
+		for _, p := range f.Progs {
+			if p.Type != elf.PT_LOAD || p.Filesz == 0 {
+				continue
+			}
+			entropy, err := entropyOf(p.Open())
+			if err != nil {
+				continue
+			}
+			info.MaxEntropy = math.Max(info.MaxEntropy, entropy)
+		}
+	}
+	info.HighEntropy = info.MaxEntropy >= HighEntropy
+	return info, nil
+}
+
+// buildID returns the GNU build ID note of f in hex, looked up in the
+// notes segments as stripped files may lack the section.
+func buildID(f *elf.File) string {
+	var notes []io.Reader
+	if s := f.Section(".note.gnu.build-id"); s != nil {
+		notes = append(notes, s.Open())
+	}
+	for _, p := range f.Progs {
+		if p.Type == elf.PT_NOTE {
+			notes = append(notes, p.Open())
+		}
+	}
+	for _, r := range notes {
+		data, err := io.ReadAll(io.LimitReader(r, 1<<20))
+		if err != nil {
+			continue
+		}
+		if id, err := findBuildID(data, f.ByteOrder); err == nil {
+			return id
+		}
+	}
+	return ""
+}
+
+func findBuildID(data []byte, order binary.ByteOrder) (string, error) {
+	for len(data) >= 12 {
+		nameSize, descSize, noteType := order.Uint32(data), order.Uint32(data[4:]), order.Uint32(data[8:])
+		nameEnd := 12 + align4(uint64(nameSize))
+		descEnd := nameEnd + align4(uint64(descSize))
+		if descEnd > uint64(len(data)) {
+			break
+		}
+		name := bytes.TrimRight(data[12:12+uint64(nameSize)], "\x00")
+		if noteType == ntGNUBuildID && string(name) == "GNU" {
+			return hex.EncodeToString(data[nameEnd : nameEnd+uint64(descSize)]), nil
+		}
+		data = data[descEnd:]
+	}
+	return "", errors.New("no build ID note")
+}
+
+func align4(n uint64) uint64 {
+	return (n + 3) &^ 3
+}
+
+// entropyOf returns the Shannon entropy of the data of r in bits per
+// byte, rounded to two decimals.
+func entropyOf(r io.Reader) (float64, error) {
+	var counts [256]int64
+	var total int64
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := r.Read(buf)
+		for _, b := range buf[:n] {
+			counts[b]++
+		}
+		total += int64(n)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if total == 0 {
+		return 0, nil
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / float64(total)
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return math.Round(entropy*100) / 100, nil
+}
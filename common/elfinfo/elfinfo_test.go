@@ -0,0 +1,158 @@
+package elfinfo
+
+import (
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+var goArchitectures = map[string]string{
+	"386":     "i386",
+	"amd64":   "x86_64",
+	"arm":     "arm",
+	"arm64":   "aarch64",
+	"riscv64": "riscv",
+	"ppc64le": "ppc64",
+	"s390x":   "s390",
+}
+
+func TestInspectTestBinary(t *testing.T) {
+	path, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsELF(path) {
+		t.Skipf("%s is no ELF file on %s", path, runtime.GOOS)
+	}
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want, ok := goArchitectures[runtime.GOARCH]; ok && info.Architecture != want {
+		t.Errorf("Architecture = %q, want %q", info.Architecture, want)
+	}
+	if info.Type != "EXEC" && info.Type != "DYN" {
+		t.Errorf("Type = %q, want an executable", info.Type)
+	}
+	if len(info.Sections) == 0 {
+		t.Fatal("no sections")
+	}
+	for _, s := range info.Sections {
+		if s.Entropy < 0 || s.Entropy > 8 {
+			t.Errorf("section %s has an entropy of %v bits per byte", s.Name, s.Entropy)
+		}
+		if s.Name == ".symtab" && info.Stripped {
+			t.Error("file with a symbol table is reported stripped")
+		}
+	}
+	// Compiled Go code is far from random.
+	if info.HighEntropy {
+		t.Errorf("MaxEntropy = %v, want below %v", info.MaxEntropy, HighEntropy)
+	}
+}
+
+func TestInspectSystemBinary(t *testing.T) {
+	// Distributions build their binaries with a GNU build ID.
+	const path = "/bin/ls"
+	if !IsELF(path) {
+		t.Skipf("%s is no ELF file", path)
+	}
+	info, err := Inspect(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(info.BuildID) != 40 {
+		t.Errorf("BuildID = %q, want a SHA-1 in hex", info.BuildID)
+	}
+	if info.Static || info.Interpreter == "" || len(info.Libraries) == 0 {
+		t.Errorf("%s is reported static with interpreter %q and libraries %v", path, info.Interpreter, info.Libraries)
+	}
+}
+
+func TestInspectInvalidFiles(t *testing.T) {
+	dir := t.TempDir()
+	text := filepath.Join(dir, "script.sh")
+	if err := os.WriteFile(text, []byte("#!/bin/sh\necho hello\n"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if IsELF(text) {
+		t.Error("IsELF of a shell script = true")
+	}
+	if _, err := Inspect(text); err == nil {
+		t.Error("Inspect of a shell script succeeded, want an error")
+	}
+
+	self, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(self)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, []byte("\x7fELF")) {
+		t.Skip("test binary is no ELF file")
+	}
+	// A file cut inside the program headers still starts with the magic
+	// number, but must not crash the scan.
+	truncated := filepath.Join(dir, "truncated")
+	if err := os.WriteFile(truncated, data[:100], 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if !IsELF(truncated) {
+		t.Error("IsELF of a truncated ELF file = false")
+	}
+	if _, err := Inspect(truncated); err == nil {
+		t.Error("Inspect of a truncated ELF file succeeded, want an error")
+	}
+	if IsELF(filepath.Join(dir, "missing")) {
+		t.Error("IsELF of a missing file = true")
+	}
+}
+
+func TestFindBuildID(t *testing.T) {
+	note := func(name string, noteType uint32, desc []byte) []byte {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, []uint32{uint32(len(name) + 1), uint32(len(desc)), noteType})
+		b.WriteString(name + "\x00")
+		b.Write(make([]byte, align4(uint64(len(name)+1))-uint64(len(name)+1)))
+		b.Write(desc)
+		b.Write(make([]byte, align4(uint64(len(desc)))-uint64(len(desc))))
+		return b.Bytes()
+	}
+	// The build ID follows a note of another type and another owner.
+	data := append(note("GNU", 1, []byte{0, 0, 0, 0, 3, 2, 0, 0}), note("Go", ntGNUBuildID, []byte("go build id"))...)
+	data = append(data, note("GNU", ntGNUBuildID, []byte{0xde, 0xad, 0xbe, 0xef, 0x01})...)
+	id, err := findBuildID(data, binary.LittleEndian)
+	if err != nil || id != "deadbeef01" {
+		t.Errorf("findBuildID = %q, %v, want deadbeef01", id, err)
+	}
+	if _, err := findBuildID(data[:len(data)-4], binary.LittleEndian); err == nil {
+		t.Error("findBuildID of a cut note succeeded, want an error")
+	}
+}
+
+func TestEntropyOf(t *testing.T) {
+	all := make([]byte, 256*4)
+	for i := range all {
+		all[i] = byte(i)
+	}
+	tests := []struct {
+		data []byte
+		want float64
+	}{
+		{nil, 0},
+		{bytes.Repeat([]byte{0x90}, 1000), 0},
+		{[]byte("abababab"), 1},
+		{all, 8},
+	}
+	for _, tt := range tests {
+		got, err := entropyOf(bytes.NewReader(tt.data))
+		if err != nil || got != tt.want {
+			t.Errorf("entropyOf(%d bytes) = %v, %v, want %v", len(tt.data), got, err, tt.want)
+		}
+	}
+}
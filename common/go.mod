@@ -0,0 +1,10 @@
+module common
+
+go 1.19
+
+require (
+	github.com/lib/pq v1.10.9
+	go.etcd.io/bbolt v1.3.7
+)
+
+require golang.org/x/sys v0.4.0 // indirect
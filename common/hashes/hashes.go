@@ -0,0 +1,150 @@
+// Package hashes maps hex digests to the files table columns storing them.
+// The table stores digests as bytea, so hex digests are decoded on the way
+// in and read back with encode(column, 'hex'), which makes every
+// comparison case-insensitive and every digest printed lowercase.
+//
+// Algorithms without a column are stored as text in file_digests, in the
+// form Normalize returns.
+package hashes
+
+import (
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Algorithms scanned files can be hashed with, by the names used in scan
+// requests, reports and scan profiles.
+const (
+	MD5    = "MD5"
+	SHA1   = "SHA1"
+	SHA256 = "SHA256"
+	SHA512 = "SHA512"
+	BLAKE3 = "BLAKE3"
+	SSDEEP = "SSDEEP"
+	TLSH   = "TLSH"
+)
+
+// Algorithms lists every algorithm, those with a files column first, in
+// column order.
+var Algorithms = []string{MD5, SHA1, SHA256, SHA512, BLAKE3, SSDEEP, TLSH}
+
+var (
+	ssdeepPattern = regexp.MustCompile(`^[0-9]+:[0-9A-Za-z+/]*:[0-9A-Za-z+/]*$`)
+	tlshPattern   = regexp.MustCompile(`^(?:T1)?[0-9A-F]{70}$`)
+)
+
+// Known reports whether algorithm is one of Algorithms.
+func Known(algorithm string) bool {
+	for _, a := range Algorithms {
+		if a == algorithm {
+			return true
+		}
+	}
+	return false
+}
+
+// Fuzzy reports whether digests of algorithm are compared by similarity.
+// Files are only looked up by the digests of the other algorithms.
+func Fuzzy(algorithm string) bool {
+	return algorithm == SSDEEP || algorithm == TLSH
+}
+
+// Normalize checks a digest of algorithm and returns it the way it is
+// stored: hex digests lowercase, TLSH digests uppercase with the T1
+// version prefix.
+func Normalize(algorithm, digest string) (string, error) {
+	switch algorithm {
+	case MD5, SHA1, SHA256, SHA512, BLAKE3:
+		length := map[string]int{MD5: 32, SHA1: 40, SHA256: 64, SHA512: 128, BLAKE3: 64}[algorithm]
+		if len(digest) != length {
+			return "", fmt.Errorf("%s digest %q is not %d characters long", algorithm, digest, length)
+		}
+		if strings.Trim(digest, "0123456789abcdefABCDEF") != "" {
+			return "", fmt.Errorf("hash %q is not hexadecimal", digest)
+		}
+		return strings.ToLower(digest), nil
+	case SSDEEP:
+		if !ssdeepPattern.MatchString(digest) {
+			return "", fmt.Errorf("%q is not an ssdeep digest", digest)
+		}
+		return digest, nil
+	case TLSH:
+		digest = strings.ToUpper(digest)
+		if !tlshPattern.MatchString(digest) {
+			return "", fmt.Errorf("%q is not a TLSH digest", digest)
+		}
+		if !strings.HasPrefix(digest, "T1") {
+			digest = "T1" + digest
+		}
+		return digest, nil
+	}
+	return "", fmt.Errorf("unknown hash algorithm %q", algorithm)
+}
+
+// Column returns the files table column that stores a hex digest of the
+// given length.
+func Column(hash string) (string, error) {
+	var column string
+	switch len(hash) {
+	case 32:
+		column = "md5"
+	case 40:
+		column = "sha1"
+	case 64:
+		column = "sha256"
+	case 128:
+		column = "sha512"
+	default:
+		return "", fmt.Errorf("unrecognized hash length %d for %q", len(hash), hash)
+	}
+	if strings.Trim(hash, "0123456789abcdefABCDEF") != "" {
+		return "", fmt.Errorf("hash %q is not hexadecimal", hash)
+	}
+	return column, nil
+}
+
+// Parse returns the column storing hash and the digest to compare it with.
+func Parse(hash string) (string, []byte, error) {
+	column, err := Column(hash)
+	if err != nil {
+		return "", nil, err
+	}
+	digest, err := hex.DecodeString(hash)
+	if err != nil {
+		return "", nil, fmt.Errorf("hash %q is not hexadecimal", hash)
+	}
+	return column, digest, nil
+}
+
+// Digests decodes the MD5, SHA1, SHA256 and SHA512 hex digests of a file
+// into query arguments, in that order. Missing digests become NULL.
+func Digests(md5, sha1, sha256, sha512 string) ([]interface{}, error) {
+	args := make([]interface{}, 4)
+	for i, hash := range []string{md5, sha1, sha256, sha512} {
+		if hash == "" {
+			continue
+		}
+		digest, err := hex.DecodeString(hash)
+		if err != nil {
+			return nil, fmt.Errorf("hash %q is not hexadecimal", hash)
+		}
+		args[i] = digest
+	}
+	return args, nil
+}
+
+// MatchQuery returns a query selecting the id of every file matching one of
+// the MD5, SHA1, SHA256 and SHA512 digests in the parameters numbered from
+// first, as returned by Digests. Each digest is looked up on its own index.
+func MatchQuery(first int) string {
+	return fmt.Sprintf(`
+		SELECT id FROM files WHERE md5 = $%d
+		UNION
+		SELECT id FROM files WHERE sha1 = $%d
+		UNION
+		SELECT id FROM files WHERE sha256 = $%d
+		UNION
+		SELECT id FROM files WHERE sha512 = $%d`, first, first+1, first+2, first+3)
+}
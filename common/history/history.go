@@ -0,0 +1,147 @@
+// Package history records every change made to the files table in
+// file_status_history and reads it back as the lineage of a hash.
+package history
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"strings"
+	"time"
+
+	"common/hashes"
+)
+
+// Manual is the source of changes made by a reviewer.
+const Manual = "manual"
+
+func ScanSource(scanID string) string {
+	return "scan:" + scanID
+}
+
+func ImportSource(importID string) string {
+	return "import:" + importID
+}
+
+func PromotionSource(promotionID int64) string {
+	return fmt.Sprintf("promotion:%d", promotionID)
+}
+
+// NewImportID returns a random identifier for one run of an uploader.
+func NewImportID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// InsertFrom returns an INSERT statement recording one entry per row of
+// relation, which must have id, old_status and new_status columns. actor,
+// source and reason are the numbers of the query parameters holding them,
+// so the statement can be used as the last part of a data modifying WITH
+// query.
+func InsertFrom(relation string, actor, source, reason int) string {
+	return fmt.Sprintf(`
+		INSERT INTO file_status_history (file_id, old_status, new_status, actor, source, reason)
+		SELECT id, old_status, new_status, $%d, $%d, NULLIF($%d, '')
+		FROM %s`, actor, source, reason, relation)
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Record writes a single entry. An empty oldStatus records a new file.
+func Record(db execer, fileID int64, oldStatus, newStatus, actor, source, reason string) error {
+	_, err := db.Exec(`
+		INSERT INTO file_status_history (file_id, old_status, new_status, actor, source, reason)
+		VALUES ($1, NULLIF($2, ''), $3, $4, $5, NULLIF($6, ''));
+	`, fileID, oldStatus, newStatus, actor, source, reason)
+	if err != nil {
+		return fmt.Errorf("failed to record status history: %v", err)
+	}
+	return nil
+}
+
+type Event struct {
+	OldStatus string    `json:"oldStatus,omitempty"`
+	NewStatus string    `json:"newStatus"`
+	Actor     string    `json:"actor"`
+	Source    string    `json:"source"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+type FileLineage struct {
+	ID     int64    `json:"id"`
+	MD5    string   `json:"MD5"`
+	SHA1   string   `json:"SHA1"`
+	SHA256 string   `json:"SHA256"`
+	SHA512 string   `json:"SHA512"`
+	Paths  []string `json:"paths"`
+	Status string   `json:"status"`
+	Events []Event  `json:"events"`
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// Lineage returns every file matching hash with its status changes, oldest
+// first.
+func Lineage(db querier, hash string) ([]FileLineage, error) {
+	column, digest, err := hashes.Parse(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(fmt.Sprintf(`
+		SELECT f.id, COALESCE(encode(f.md5, 'hex'), ''), COALESCE(encode(f.sha1, 'hex'), ''),
+			COALESCE(encode(f.sha256, 'hex'), ''), COALESCE(encode(f.sha512, 'hex'), ''),
+			COALESCE((SELECT string_agg(p.filepath, E'\n' ORDER BY p.added_at, p.filepath) FROM file_paths p WHERE p.file_id = f.id), ''),
+			COALESCE(f.status, ''),
+			h.old_status, h.new_status, h.actor, h.source, h.reason, h.changed_at
+		FROM files f
+		LEFT JOIN file_status_history h ON h.file_id = f.id
+		WHERE f.%s = $1
+		ORDER BY f.id, h.changed_at, h.id;
+	`, column), digest)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	lineage := []FileLineage{}
+	for rows.Next() {
+		var file FileLineage
+		var paths string
+		var oldStatus, newStatus, actor, source, reason sql.NullString
+		var changedAt sql.NullTime
+		err := rows.Scan(&file.ID, &file.MD5, &file.SHA1, &file.SHA256, &file.SHA512, &paths, &file.Status,
+			&oldStatus, &newStatus, &actor, &source, &reason, &changedAt)
+		if err != nil {
+			return nil, fmt.Errorf("error checking query results: %v", err)
+		}
+		if len(lineage) == 0 || lineage[len(lineage)-1].ID != file.ID {
+			file.Paths = []string{}
+			if paths != "" {
+				file.Paths = strings.Split(paths, "\n")
+			}
+			file.Events = []Event{}
+			lineage = append(lineage, file)
+		}
+		if !changedAt.Valid {
+			continue
+		}
+		last := &lineage[len(lineage)-1]
+		last.Events = append(last.Events, Event{
+			OldStatus: oldStatus.String,
+			NewStatus: newStatus.String,
+			Actor:     actor.String,
+			Source:    source.String,
+			Reason:    reason.String,
+			ChangedAt: changedAt.Time,
+		})
+	}
+	return lineage, rows.Err()
+}
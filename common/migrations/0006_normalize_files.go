@@ -0,0 +1,419 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migration 6 stores digests as bytea, sizes as bigint and the known paths
+// of a file in file_paths.
+//
+// Digests used to be compared case-sensitively, so the same file could be
+// stored twice, e.g. uppercase from an NSRL import and lowercase from a
+// scan. Such rows are merged into the one whose status ranks highest
+// (malicious, verified, candidate), and the others are kept with the
+// merged status, no digests and merged_into pointing at the row they were
+// merged into. Every lookup of a stored digest returns the same status
+// after the migration as before, which is verified before committing.
+func init() {
+	register(6, "normalize_files", normalizeFiles)
+}
+
+const migrationSource = "migration:6"
+
+var digestColumns = []struct {
+	name   string
+	length int
+}{
+	{"md5", 16},
+	{"sha1", 20},
+	{"sha256", 32},
+	{"sha512", 64},
+}
+
+var statusRank = map[string]int{"malicious": 3, "verified": 2, "candidate": 1}
+
+func normalizeFiles(tx *sql.Tx) error {
+	if err := checkConvertible(tx); err != nil {
+		return err
+	}
+
+	_, err := tx.Exec(`
+		ALTER TABLE files ADD COLUMN IF NOT EXISTS merged_into INTEGER REFERENCES files (id);
+
+		CREATE TABLE IF NOT EXISTS file_paths (
+			file_id INTEGER NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+			filepath TEXT NOT NULL,
+			added_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+			PRIMARY KEY (file_id, filepath)
+		);
+		CREATE INDEX IF NOT EXISTS idx_file_paths_filepath ON file_paths (filepath);
+	`)
+	if err != nil {
+		return err
+	}
+
+	if err := mergeCaseDuplicates(tx); err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(`
+		CREATE TEMPORARY TABLE files_before ON COMMIT DROP AS
+		SELECT id, status,
+			lower(NULLIF(trim(md5), '')) AS md5,
+			lower(NULLIF(trim(sha1), '')) AS sha1,
+			lower(NULLIF(trim(sha256), '')) AS sha256,
+			lower(NULLIF(trim(sha512), '')) AS sha512
+		FROM files
+		WHERE merged_into IS NULL;
+
+		INSERT INTO file_paths (file_id, filepath)
+		SELECT COALESCE(merged_into, id), filepath
+		FROM files
+		WHERE NULLIF(filepath, '') IS NOT NULL
+		ON CONFLICT DO NOTHING;
+		COMMENT ON COLUMN files.filepath IS 'Replaced by file_paths, kept so upgrading loses no data';
+
+		-- The views depend on the column types
+		DROP MATERIALIZED VIEW IF EXISTS verified;
+		DROP MATERIALIZED VIEW IF EXISTS candidates;
+		DROP MATERIALIZED VIEW IF EXISTS malicious;
+
+		ALTER TABLE files
+			ALTER COLUMN md5 TYPE BYTEA USING decode(NULLIF(trim(md5), ''), 'hex'),
+			ALTER COLUMN sha1 TYPE BYTEA USING decode(NULLIF(trim(sha1), ''), 'hex'),
+			ALTER COLUMN sha256 TYPE BYTEA USING decode(NULLIF(trim(sha256), ''), 'hex'),
+			ALTER COLUMN sha512 TYPE BYTEA USING decode(NULLIF(trim(sha512), ''), 'hex'),
+			ALTER COLUMN filesize TYPE BIGINT USING NULLIF(trim(filesize), '')::BIGINT,
+			ADD CONSTRAINT files_md5_length CHECK (octet_length(md5) = 16),
+			ADD CONSTRAINT files_sha1_length CHECK (octet_length(sha1) = 20),
+			ADD CONSTRAINT files_sha256_length CHECK (octet_length(sha256) = 32),
+			ADD CONSTRAINT files_sha512_length CHECK (octet_length(sha512) = 64),
+			ADD CONSTRAINT files_filesize_positive CHECK (filesize >= 0);
+
+		CREATE MATERIALIZED VIEW verified AS
+		SELECT *
+		FROM files
+		WHERE status='verified';
+
+		CREATE MATERIALIZED VIEW candidates AS
+		SELECT *
+		FROM files
+		WHERE status='candidate';
+
+		CREATE MATERIALIZED VIEW malicious AS
+		SELECT *
+		FROM files
+		WHERE status='malicious';
+
+		CREATE UNIQUE INDEX idx_verified_id ON verified (id);
+		CREATE UNIQUE INDEX idx_candidates_id ON candidates (id);
+		CREATE UNIQUE INDEX idx_malicious_id ON malicious (id);
+		UPDATE view_refreshes SET refreshed_at = now();
+	`)
+	if err != nil {
+		return err
+	}
+
+	return verifyLookups(tx)
+}
+
+// checkConvertible fails with the offending values when a digest is not
+// hexadecimal or has the wrong length, or a size is not a number, instead
+// of dropping them.
+func checkConvertible(tx *sql.Tx) error {
+	var checks []string
+	for _, c := range digestColumns {
+		checks = append(checks, fmt.Sprintf(`
+			SELECT id, '%[1]s', %[1]s
+			FROM files
+			WHERE NULLIF(trim(%[1]s), '') !~ '^[0-9a-fA-F]{%[2]d}$'`, c.name, c.length*2))
+	}
+	checks = append(checks, `
+		SELECT id, 'filesize', filesize
+		FROM files
+		WHERE NULLIF(trim(filesize), '') !~ '^[0-9]{1,18}$'`)
+
+	rows, err := tx.Query(strings.Join(checks, "\nUNION ALL") + "\nLIMIT 20;")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var invalid []string
+	for rows.Next() {
+		var id int64
+		var column, value string
+		if err := rows.Scan(&id, &column, &value); err != nil {
+			return err
+		}
+		invalid = append(invalid, fmt.Sprintf("file %d %s %q", id, column, value))
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(invalid) > 0 {
+		return fmt.Errorf("values that cannot be converted, correct them and run migrate up again: %s", strings.Join(invalid, ", "))
+	}
+	return nil
+}
+
+type mergedFile struct {
+	id      int64
+	status  string
+	digests [4]sql.NullString
+}
+
+// mergeCaseDuplicates merges the rows whose digests only differ in case or
+// surrounding whitespace.
+func mergeCaseDuplicates(tx *sql.Tx) error {
+	var duplicates [][]int64
+	for _, c := range digestColumns {
+		rows, err := tx.Query(fmt.Sprintf(`
+			SELECT string_agg(id::TEXT, ',' ORDER BY id)
+			FROM files
+			WHERE NULLIF(trim(%[1]s), '') IS NOT NULL
+			GROUP BY lower(trim(%[1]s))
+			HAVING COUNT(*) > 1;
+		`, c.name))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var list string
+			if err := rows.Scan(&list); err != nil {
+				rows.Close()
+				return err
+			}
+			ids, err := parseIDs(list)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			duplicates = append(duplicates, ids)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	for _, ids := range mergeGroups(duplicates) {
+		if err := mergeGroup(tx, ids); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeGroups joins the lists of files sharing a digest into the groups of
+// files that are the same, as rows can share one digest with a row and
+// another with a third. Groups and their files are sorted by id.
+func mergeGroups(duplicates [][]int64) [][]int64 {
+	parent := map[int64]int64{}
+	var find func(id int64) int64
+	find = func(id int64) int64 {
+		p, ok := parent[id]
+		if !ok || p == id {
+			parent[id] = id
+			return id
+		}
+		root := find(p)
+		parent[id] = root
+		return root
+	}
+	for _, ids := range duplicates {
+		for _, id := range ids[1:] {
+			parent[find(id)] = find(ids[0])
+		}
+	}
+
+	byRoot := map[int64][]int64{}
+	for id := range parent {
+		root := find(id)
+		byRoot[root] = append(byRoot[root], id)
+	}
+	groups := make([][]int64, 0, len(byRoot))
+	for _, ids := range byRoot {
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		groups = append(groups, ids)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i][0] < groups[j][0] })
+	return groups
+}
+
+func mergeGroup(tx *sql.Tx, ids []int64) error {
+	rows, err := tx.Query(`
+		SELECT id, COALESCE(status, ''),
+			lower(NULLIF(trim(md5), '')), lower(NULLIF(trim(sha1), '')),
+			lower(NULLIF(trim(sha256), '')), lower(NULLIF(trim(sha512), ''))
+		FROM files
+		WHERE id = ANY($1::INTEGER[])
+		ORDER BY id;
+	`, intArray(ids))
+	if err != nil {
+		return err
+	}
+	var group []mergedFile
+	for rows.Next() {
+		var f mergedFile
+		if err := rows.Scan(&f.id, &f.status, &f.digests[0], &f.digests[1], &f.digests[2], &f.digests[3]); err != nil {
+			rows.Close()
+			return err
+		}
+		group = append(group, f)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	survivor, digests, err := mergeFiles(group)
+	if err != nil {
+		return err
+	}
+	var merged []int64
+	var mergedDesc []string
+	for _, f := range group {
+		if f.id != survivor.id {
+			merged = append(merged, f.id)
+			mergedDesc = append(mergedDesc, fmt.Sprintf("%d (%s)", f.id, f.status))
+		}
+	}
+
+	// The merged rows give up their digests first, so the survivor can take
+	// them without breaking the unique constraints.
+	_, err = tx.Exec(`
+		UPDATE files
+		SET md5 = NULL, sha1 = NULL, sha256 = NULL, sha512 = NULL, status = 'merged', merged_into = $1
+		WHERE id = ANY($2::INTEGER[]);
+	`, survivor.id, intArray(merged))
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`
+		UPDATE files f
+		SET md5 = $2, sha1 = $3, sha256 = $4, sha512 = $5,
+			filesize = COALESCE(NULLIF(trim(f.filesize), ''),
+				(SELECT NULLIF(trim(m.filesize), '') FROM files m WHERE m.merged_into = $1 AND NULLIF(trim(m.filesize), '') IS NOT NULL ORDER BY m.id LIMIT 1)),
+			family = COALESCE(f.family, (SELECT m.family FROM files m WHERE m.merged_into = $1 AND m.family IS NOT NULL ORDER BY m.id LIMIT 1)),
+			source = COALESCE(f.source, (SELECT m.source FROM files m WHERE m.merged_into = $1 AND m.source IS NOT NULL ORDER BY m.id LIMIT 1)),
+			threat_label = COALESCE(f.threat_label, (SELECT m.threat_label FROM files m WHERE m.merged_into = $1 AND m.threat_label IS NOT NULL ORDER BY m.id LIMIT 1)),
+			first_seen = LEAST(f.first_seen, (SELECT MIN(m.first_seen) FROM files m WHERE m.merged_into = $1))
+		WHERE f.id = $1;
+	`, survivor.id, digests[0], digests[1], digests[2], digests[3])
+	if err != nil {
+		return err
+	}
+
+	// Sightings the survivor already has stay with the merged row, so one
+	// merged row is moved at a time.
+	for _, id := range merged {
+		for _, query := range []string{
+			`UPDATE file_sightings s
+			SET file_id = $1
+			WHERE s.file_id = $2 AND NOT EXISTS (
+				SELECT 1
+				FROM file_sightings t
+				WHERE t.file_id = $1 AND t.filepath = s.filepath AND t.host = s.host AND t.scan_id = s.scan_id
+			);`,
+			`UPDATE promotions SET file_id = $1 WHERE file_id = $2;`,
+			`UPDATE triage_decisions SET file_id = $1 WHERE file_id = $2;`,
+			`UPDATE file_status_history SET file_id = $1 WHERE file_id = $2;`,
+		} {
+			if _, err := tx.Exec(query, survivor.id, id); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, f := range group {
+		reason := fmt.Sprintf("merged into file %d, its digests only differed in case", survivor.id)
+		newStatus := "merged"
+		if f.id == survivor.id {
+			reason = "merged files " + strings.Join(mergedDesc, ", ") + ", their digests only differed in case"
+			newStatus = f.status
+		}
+		_, err := tx.Exec(`
+			INSERT INTO file_status_history (file_id, old_status, new_status, actor, source, reason)
+			VALUES ($1, NULLIF($2, ''), $3, 'migrate', $4, $5);
+		`, f.id, f.status, newStatus, migrationSource, reason)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergeFiles picks the file of a group that survives, the first one with
+// the highest ranking status, and the digests it takes over from the
+// group. Files with different digests of one algorithm are no duplicates.
+func mergeFiles(group []mergedFile) (mergedFile, [4]sql.NullString, error) {
+	survivor := group[0]
+	var digests [4]sql.NullString
+	for _, f := range group {
+		if statusRank[f.status] > statusRank[survivor.status] {
+			survivor = f
+		}
+		for i, d := range f.digests {
+			if !d.Valid {
+				continue
+			}
+			if digests[i].Valid && digests[i].String != d.String {
+				ids := make([]int64, len(group))
+				for j, f := range group {
+					ids[j] = f.id
+				}
+				return survivor, digests, fmt.Errorf("files %s share a digest but have different %s digests, correct them and run migrate up again",
+					intArray(ids), digestColumns[i].name)
+			}
+			digests[i] = d
+		}
+	}
+	return survivor, digests, nil
+}
+
+// verifyLookups checks that every digest stored before the conversion still
+// finds the same file with the same status.
+func verifyLookups(tx *sql.Tx) error {
+	for _, c := range digestColumns {
+		var mismatched int64
+		err := tx.QueryRow(fmt.Sprintf(`
+			SELECT COUNT(*)
+			FROM files_before b
+			LEFT JOIN files f ON f.%[1]s = decode(b.%[1]s, 'hex')
+			WHERE b.%[1]s IS NOT NULL AND (f.id IS DISTINCT FROM b.id OR f.status IS DISTINCT FROM b.status);
+		`, c.name)).Scan(&mismatched)
+		if err != nil {
+			return err
+		}
+		if mismatched > 0 {
+			return fmt.Errorf("%d %s lookups would change after the conversion", mismatched, c.name)
+		}
+	}
+	return nil
+}
+
+func parseIDs(list string) ([]int64, error) {
+	var ids []int64
+	for _, field := range strings.Split(list, ",") {
+		id, err := strconv.ParseInt(field, 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// intArray formats ids as a PostgreSQL array literal.
+func intArray(ids []int64) string {
+	fields := make([]string, len(ids))
+	for i, id := range ids {
+		fields[i] = strconv.FormatInt(id, 10)
+	}
+	return "{" + strings.Join(fields, ",") + "}"
+}
@@ -0,0 +1,321 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	_ "github.com/lib/pq"
+)
+
+func TestMergeGroups(t *testing.T) {
+	tests := []struct {
+		name       string
+		duplicates [][]int64
+		want       [][]int64
+	}{
+		{"none", nil, [][]int64{}},
+		{"one digest", [][]int64{{3, 7}}, [][]int64{{3, 7}}},
+		{"separate", [][]int64{{5, 9}, {1, 2}}, [][]int64{{1, 2}, {5, 9}}},
+		// 1 and 4 share an MD5, 4 and 2 a SHA-256.
+		{"chained", [][]int64{{1, 4}, {2, 4}}, [][]int64{{1, 2, 4}}},
+		{"chained late", [][]int64{{8, 9}, {3, 6}, {6, 9}, {1, 2}}, [][]int64{{1, 2}, {3, 6, 8, 9}}},
+		{"same pair twice", [][]int64{{2, 5}, {2, 5}, {2, 5, 6}}, [][]int64{{2, 5, 6}}},
+	}
+	for _, tt := range tests {
+		if got := mergeGroups(tt.duplicates); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: mergeGroups = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func fileOf(id int64, status string, digests ...string) mergedFile {
+	f := mergedFile{id: id, status: status}
+	for i, d := range digests {
+		f.digests[i] = sql.NullString{String: d, Valid: d != ""}
+	}
+	return f
+}
+
+func TestMergeFiles(t *testing.T) {
+	tests := []struct {
+		name     string
+		group    []mergedFile
+		survivor int64
+		digests  []string
+		err      string
+	}{
+		{
+			name:     "highest status",
+			group:    []mergedFile{fileOf(1, "candidate", "aa"), fileOf(2, "malicious", "aa"), fileOf(3, "verified", "aa")},
+			survivor: 2,
+			digests:  []string{"aa", "", "", ""},
+		},
+		{
+			name:     "first of equal status",
+			group:    []mergedFile{fileOf(4, "verified", "aa"), fileOf(5, "verified", "aa")},
+			survivor: 4,
+			digests:  []string{"aa", "", "", ""},
+		},
+		{
+			name:     "unknown status",
+			group:    []mergedFile{fileOf(6, "", "aa"), fileOf(7, "candidate", "aa")},
+			survivor: 7,
+			digests:  []string{"aa", "", "", ""},
+		},
+		{
+			name:     "digests combined",
+			group:    []mergedFile{fileOf(1, "verified", "aa", "", "cc"), fileOf(2, "candidate", "", "bb", "cc", "dd")},
+			survivor: 1,
+			digests:  []string{"aa", "bb", "cc", "dd"},
+		},
+		{
+			name:  "conflicting digests",
+			group: []mergedFile{fileOf(1, "verified", "aa", "bb"), fileOf(2, "candidate", "aa", "ff")},
+			err:   "files {1,2} share a digest but have different sha1 digests",
+		},
+	}
+	for _, tt := range tests {
+		survivor, digests, err := mergeFiles(tt.group)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if survivor.id != tt.survivor {
+			t.Errorf("%s: file %d survived, want %d", tt.name, survivor.id, tt.survivor)
+		}
+		for i, d := range digests {
+			if d.String != tt.digests[i] || d.Valid != (tt.digests[i] != "") {
+				t.Errorf("%s: %s digest %+v, want %q", tt.name, digestColumns[i].name, d, tt.digests[i])
+			}
+		}
+	}
+}
+
+// testDB connects to the PostgreSQL database in MIGRATIONS_TEST_DB, a
+// key=value connection string of a database the tests may write to, and
+// creates an empty schema dropped at the end of the test.
+func testDB(t *testing.T) (*sql.DB, string) {
+	dsn := os.Getenv("MIGRATIONS_TEST_DB")
+	if dsn == "" {
+		t.Skip("MIGRATIONS_TEST_DB is not set")
+	}
+	schema := strings.ToLower(fmt.Sprintf("migrations_test_%d_%s", os.Getpid(), t.Name()))
+	db, err := sql.Open("postgres", dsn+" search_path="+schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`CREATE SCHEMA ` + quoteIdentifier(schema) + `;`); err != nil {
+		db.Close()
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		db.Exec(`DROP SCHEMA ` + quoteIdentifier(schema) + ` CASCADE;`)
+		db.Close()
+	})
+	return db, schema
+}
+
+// migrateTo applies the migrations up to version, like Up does with all of
+// them.
+func migrateTo(t *testing.T, db *sql.DB, version int) {
+	all, err := All()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(128) NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+		);
+	`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	current, err := Version(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, m := range all[current:version] {
+		if err := apply(ctx, conn, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+const (
+	emptyMD5    = "d41d8cd98f00b204e9800998ecf8427e"
+	emptySHA256 = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	aMD5        = "0cc175b9c0f1b6a831c399e269772661"
+)
+
+func TestNormalizeFiles(t *testing.T) {
+	db, schema := testDB(t)
+	migrateTo(t, db, 5)
+
+	// Files 1 and 2 share an MD5 in different case, 2 and 3 a SHA-256.
+	_, err := db.Exec(`
+		INSERT INTO files (id, md5, sha256, filesize, filepath, status, family) VALUES
+			(1, upper($1), NULL, '10', '/usr/bin/empty', 'verified', NULL),
+			(2, $1 || ' ', $2, '', '/tmp/empty', 'malicious', 'Mirai'),
+			(3, NULL, upper($2), '10', '/opt/empty', 'candidate', NULL),
+			(4, $3, NULL, '1', '/usr/bin/a', 'candidate', NULL);
+		INSERT INTO file_sightings (file_id, filepath, host, scan_id) VALUES
+			(2, '/opt/empty', 'host1', 'scan1'),
+			(3, '/opt/empty', 'host1', 'scan1'),
+			(3, '/opt/empty', 'host2', 'scan1');
+	`, emptyMD5, emptySHA256, aMD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Up(db, schema); err != nil {
+		t.Fatal(err)
+	}
+
+	type row struct {
+		status     string
+		md5        string
+		sha256     string
+		filesize   sql.NullInt64
+		family     sql.NullString
+		mergedInto sql.NullInt64
+	}
+	want := map[int64]row{
+		1: {status: "merged", mergedInto: sql.NullInt64{Int64: 2, Valid: true}},
+		2: {status: "malicious", md5: emptyMD5, sha256: emptySHA256, filesize: sql.NullInt64{Int64: 10, Valid: true}, family: sql.NullString{String: "Mirai", Valid: true}},
+		3: {status: "merged", mergedInto: sql.NullInt64{Int64: 2, Valid: true}},
+		4: {status: "candidate", md5: aMD5, filesize: sql.NullInt64{Int64: 1, Valid: true}},
+	}
+	for id, w := range want {
+		var got row
+		err := db.QueryRow(`
+			SELECT status, COALESCE(encode(md5, 'hex'), ''), COALESCE(encode(sha256, 'hex'), ''), filesize, family, merged_into
+			FROM files
+			WHERE id = $1;
+		`, id).Scan(&got.status, &got.md5, &got.sha256, &got.filesize, &got.family, &got.mergedInto)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != w {
+			t.Errorf("file %d = %+v, want %+v", id, got, w)
+		}
+	}
+
+	counts := []struct {
+		query string
+		want  int
+	}{
+		{`SELECT COUNT(*) FROM file_paths WHERE file_id = 2;`, 3},
+		{`SELECT COUNT(*) FROM file_paths WHERE file_id = 4;`, 1},
+		// The sighting file 2 already had stays with file 3.
+		{`SELECT COUNT(*) FROM file_sightings WHERE file_id = 2;`, 2},
+		{`SELECT COUNT(*) FROM file_sightings WHERE file_id = 3;`, 1},
+		{`SELECT COUNT(*) FROM file_status_history WHERE actor = 'migrate' AND file_id IN (1, 2, 3);`, 3},
+		{`SELECT COUNT(*) FROM malicious;`, 1},
+		{`SELECT COUNT(*) FROM candidates;`, 1},
+	}
+	for _, c := range counts {
+		var got int
+		if err := db.QueryRow(c.query).Scan(&got); err != nil {
+			t.Fatal(err)
+		}
+		if got != c.want {
+			t.Errorf("%s = %d, want %d", c.query, got, c.want)
+		}
+	}
+
+	// Migration 7 keeps one digest per file and algorithm.
+	tlsh := "T1" + strings.Repeat("00", 35)
+	if _, err := db.Exec(`INSERT INTO file_digests (file_id, algorithm, digest) VALUES (2, 'TLSH', $1);`, tlsh); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec(`INSERT INTO file_digests (file_id, algorithm, digest) VALUES (2, 'TLSH', 'other');`); err == nil {
+		t.Error("second TLSH digest of file 2 was stored")
+	}
+	var id int64
+	if err := db.QueryRow(`SELECT file_id FROM file_digests WHERE algorithm = 'TLSH' AND digest = $1;`, tlsh).Scan(&id); err != nil || id != 2 {
+		t.Errorf("lookup by TLSH = %d, %v, want file 2", id, err)
+	}
+}
+
+func TestNormalizeFilesInvalidValues(t *testing.T) {
+	db, schema := testDB(t)
+	migrateTo(t, db, 5)
+
+	_, err := db.Exec(`INSERT INTO files (id, md5, filesize, status) VALUES (1, 'not hex', '10', 'verified'), (2, $1, 'ten', 'verified');`, aMD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Up(db, schema)
+	if err == nil || !strings.Contains(err.Error(), `file 1 md5 "not hex"`) || !strings.Contains(err.Error(), `file 2 filesize "ten"`) {
+		t.Errorf("Up with invalid values = %v, want both listed", err)
+	}
+	if version, err := Version(db); err != nil || version != 5 {
+		t.Errorf("version after the failed upgrade = %d, %v, want 5", version, err)
+	}
+}
+
+func TestVerifyLookups(t *testing.T) {
+	db, schema := testDB(t)
+	if _, err := Up(db, schema); err != nil {
+		t.Fatal(err)
+	}
+	_, err := db.Exec(`
+		INSERT INTO files (id, md5, sha256, status) VALUES
+			(1, decode($1, 'hex'), decode($2, 'hex'), 'malicious'),
+			(2, decode($3, 'hex'), NULL, 'verified');
+	`, emptyMD5, emptySHA256, aMD5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		before  string
+		wantErr string
+	}{
+		{"unchanged", fmt.Sprintf(`(1, 'malicious', '%s', NULL, '%s', NULL), (2, 'verified', '%s', NULL, NULL, NULL)`, emptyMD5, emptySHA256, aMD5), ""},
+		{"status changed", fmt.Sprintf(`(1, 'candidate', '%s', NULL, NULL, NULL)`, emptyMD5), "1 md5 lookups"},
+		{"other file", fmt.Sprintf(`(2, 'malicious', NULL, NULL, '%s', NULL)`, emptySHA256), "1 sha256 lookups"},
+		{"digest lost", `(3, 'verified', NULL, 'da39a3ee5e6b4b0d3255bfef95601890afd80709', NULL, NULL)`, "1 sha1 lookups"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := db.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			_, err = tx.Exec(`
+				CREATE TEMPORARY TABLE files_before (id INTEGER, status TEXT, md5 TEXT, sha1 TEXT, sha256 TEXT, sha512 TEXT) ON COMMIT DROP;
+				INSERT INTO files_before VALUES ` + tt.before + `;`)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = verifyLookups(tx)
+			if tt.wantErr == "" && err != nil {
+				t.Errorf("verifyLookups = %v, want nil", err)
+			}
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Errorf("verifyLookups = %v, want %q", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,329 @@
+// Package migrations creates and upgrades the database schema. Every
+// migration is a numbered SQL file in sql/ compiled into the programs, or a
+// Go function registered under its number when the data has to be
+// converted, and the versions applied to a database are recorded in
+// schema_migrations.
+//
+// Migrations only ever add to the schema: statements that drop tables,
+// columns or rows are rejected, so an upgrade never loses data. Views and
+// indexes hold no data of their own and may be dropped to recreate them.
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+//go:embed sql/*.sql
+var files embed.FS
+
+// Key of the advisory lock that keeps two processes from migrating at once.
+const migrateLock = 0x6d696772
+
+// ErrIncompatible is returned by Check when the database schema is older or
+// newer than the one this program was built for.
+var ErrIncompatible = errors.New("incompatible database schema")
+
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+
+	run func(tx *sql.Tx) error
+}
+
+// goMigrations holds the migrations written in Go, by version.
+var goMigrations = map[int]Migration{}
+
+func register(version int, name string, run func(tx *sql.Tx) error) {
+	goMigrations[version] = Migration{Version: version, Name: name, run: run}
+}
+
+// State is a migration known to this program, to the database or both.
+type State struct {
+	Version   int
+	Name      string
+	AppliedAt *time.Time
+	// False for versions applied by a newer program.
+	Known bool
+}
+
+var (
+	loadOnce sync.Once
+	loaded   []Migration
+	loadErr  error
+)
+
+// All returns every migration in version order.
+func All() ([]Migration, error) {
+	loadOnce.Do(func() {
+		loaded, loadErr = load()
+	})
+	return loaded, loadErr
+}
+
+// Latest returns the schema version this program was built for.
+func Latest() (int, error) {
+	all, err := All()
+	if err != nil {
+		return 0, err
+	}
+	if len(all) == 0 {
+		return 0, nil
+	}
+	return all[len(all)-1].Version, nil
+}
+
+func load() ([]Migration, error) {
+	entries, err := files.ReadDir("sql")
+	if err != nil {
+		return nil, err
+	}
+
+	var all []Migration
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		number, title, ok := strings.Cut(name, "_")
+		version, err := strconv.Atoi(number)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s", entry.Name())
+		}
+		content, err := files.ReadFile(path.Join("sql", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		if err := checkDestructive(string(content)); err != nil {
+			return nil, fmt.Errorf("migration %s: %v", entry.Name(), err)
+		}
+		all = append(all, Migration{Version: version, Name: title, SQL: string(content)})
+	}
+
+	for version, m := range goMigrations {
+		for _, other := range all {
+			if other.Version == version {
+				return nil, fmt.Errorf("migration %d is both %s and %s", version, other.Name, m.Name)
+			}
+		}
+		all = append(all, m)
+	}
+
+	sort.Slice(all, func(i, j int) bool { return all[i].Version < all[j].Version })
+	for i, m := range all {
+		if m.Version != i+1 {
+			return nil, fmt.Errorf("migration versions must run from 1 without gaps, found %d after %d", m.Version, i)
+		}
+	}
+	return all, nil
+}
+
+var (
+	sqlComment = regexp.MustCompile(`--[^\n]*`)
+	dropTarget = regexp.MustCompile(`(?i)\bDROP\s+(\w+(?:\s+\w+)?)`)
+	removeRows = regexp.MustCompile(`(?i)\b(TRUNCATE|DELETE\s+FROM)\b`)
+)
+
+// Objects a migration may drop, because they can be recreated from the
+// tables.
+var droppable = []string{"MATERIALIZED VIEW", "VIEW", "INDEX", "CONSTRAINT", "DEFAULT", "NOT NULL", "TRIGGER", "FUNCTION"}
+
+// checkDestructive rejects statements that would lose data.
+func checkDestructive(statements string) error {
+	statements = sqlComment.ReplaceAllString(statements, "")
+	if match := removeRows.FindString(statements); match != "" {
+		return fmt.Errorf("%s would remove rows", strings.ToUpper(match))
+	}
+	for _, match := range dropTarget.FindAllStringSubmatch(statements, -1) {
+		target := strings.ToUpper(strings.Join(strings.Fields(match[1]), " "))
+		allowed := false
+		for _, d := range droppable {
+			if target == d || strings.HasPrefix(target, d+" ") {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return fmt.Errorf("DROP %s would remove data", target)
+		}
+	}
+	return nil
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+// Version returns the latest version applied to the database, or 0 when no
+// migration was ever applied.
+func Version(db querier) (int, error) {
+	ctx := context.Background()
+	var exists bool
+	err := db.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL;`).Scan(&exists)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the schema version: %v", err)
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, `SELECT COALESCE(MAX(version), 0) FROM schema_migrations;`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read the schema version: %v", err)
+	}
+	return version, nil
+}
+
+// Check returns ErrIncompatible unless the database schema is exactly the
+// version this program was built for. Programs call it before touching the
+// database.
+func Check(db *sql.DB) error {
+	latest, err := Latest()
+	if err != nil {
+		return err
+	}
+	current, err := Version(db)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case current < latest:
+		return fmt.Errorf("%w: the database is at version %d but this program needs version %d, run migrate up", ErrIncompatible, current, latest)
+	case current > latest:
+		return fmt.Errorf("%w: the database is at version %d but this program only knows version %d, upgrade this program", ErrIncompatible, current, latest)
+	}
+	return nil
+}
+
+// Status returns every migration with the time it was applied, if it was.
+func Status(db *sql.DB) ([]State, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	states := make([]State, 0, len(all))
+	for _, m := range all {
+		states = append(states, State{Version: m.Version, Name: m.Name, Known: true})
+	}
+
+	current, err := Version(db)
+	if err != nil || current == 0 {
+		return states, err
+	}
+
+	rows, err := db.Query(`SELECT version, name, applied_at FROM schema_migrations ORDER BY version;`)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version int
+		var name string
+		var appliedAt time.Time
+		if err := rows.Scan(&version, &name, &appliedAt); err != nil {
+			return nil, fmt.Errorf("error checking query results: %v", err)
+		}
+		if version <= len(all) {
+			states[version-1].AppliedAt = &appliedAt
+			continue
+		}
+		states = append(states, State{Version: version, Name: name, AppliedAt: &appliedAt})
+	}
+	return states, rows.Err()
+}
+
+// Up creates schema when it is not empty and applies every migration the
+// database is missing, each in its own transaction. It returns the
+// migrations it applied.
+func Up(db *sql.DB, schema string) ([]Migration, error) {
+	all, err := All()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if schema != "" {
+		_, err := conn.ExecContext(ctx, `CREATE SCHEMA IF NOT EXISTS `+quoteIdentifier(schema)+`;`)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create schema %s: %v", schema, err)
+		}
+	}
+
+	if _, err := conn.ExecContext(ctx, `SELECT pg_advisory_lock($1);`, migrateLock); err != nil {
+		return nil, fmt.Errorf("failed to lock the schema: %v", err)
+	}
+	defer conn.ExecContext(ctx, `SELECT pg_advisory_unlock($1);`, migrateLock)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name VARCHAR(128) NOT NULL,
+			applied_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+		);
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create schema_migrations: %v", err)
+	}
+
+	current, err := Version(conn)
+	if err != nil {
+		return nil, err
+	}
+	if current > len(all) {
+		return nil, fmt.Errorf("%w: the database is at version %d but this program only knows version %d", ErrIncompatible, current, len(all))
+	}
+
+	var applied []Migration
+	for _, m := range all[current:] {
+		if err := apply(ctx, conn, m); err != nil {
+			return applied, err
+		}
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func apply(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if m.run != nil {
+		err = m.run(tx)
+	} else {
+		_, err = tx.ExecContext(ctx, m.SQL)
+	}
+	if err != nil {
+		return fmt.Errorf("migration %d %s failed: %v", m.Version, m.Name, err)
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, name) VALUES ($1, $2);`, m.Version, m.Name)
+	if err != nil {
+		return fmt.Errorf("failed to record migration %d %s: %v", m.Version, m.Name, err)
+	}
+	return tx.Commit()
+}
+
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
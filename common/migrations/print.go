@@ -0,0 +1,52 @@
+package migrations
+
+import (
+	"database/sql"
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+)
+
+// PrintUp applies the pending migrations like Up and writes which it
+// applied to w, for the migrate up commands of the programs.
+func PrintUp(w io.Writer, db *sql.DB, schema string) error {
+	applied, err := Up(db, schema)
+	for _, m := range applied {
+		fmt.Fprintf(w, "Applied migration %d %s\n", m.Version, m.Name)
+	}
+	if err != nil {
+		return err
+	}
+	if len(applied) == 0 {
+		fmt.Fprintln(w, "The database schema is up to date")
+	}
+	return nil
+}
+
+// PrintStatus writes every migration and when it was applied to w, for the
+// migrate status commands of the programs. It returns the error of Check
+// when the schema is not the one this program was built for.
+func PrintStatus(w io.Writer, db *sql.DB) error {
+	states, err := Status(db)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED")
+	for _, s := range states {
+		applied := "pending"
+		if s.AppliedAt != nil {
+			applied = s.AppliedAt.Format(time.RFC3339)
+		}
+		if !s.Known {
+			applied += " (unknown to this program)"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, applied)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	return Check(db)
+}
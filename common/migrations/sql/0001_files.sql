@@ -0,0 +1,42 @@
+-- Known files and the materialized views over their status
+CREATE TABLE IF NOT EXISTS files (
+    id SERIAL PRIMARY KEY,
+    md5 VARCHAR(32) UNIQUE,
+    sha1 VARCHAR(40) UNIQUE,
+    sha256 VARCHAR(64) UNIQUE,
+    sha512 VARCHAR(128) UNIQUE,
+    filesize VARCHAR(128),
+    filepath VARCHAR(512),
+    status VARCHAR(10) DEFAULT 'candidate',
+    family VARCHAR(128),
+    source VARCHAR(128),
+    first_seen TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    threat_label VARCHAR(256)
+);
+
+-- Databases created before the threat intelligence and ClamAV imports
+ALTER TABLE files ADD COLUMN IF NOT EXISTS family VARCHAR(128);
+ALTER TABLE files ADD COLUMN IF NOT EXISTS source VARCHAR(128);
+ALTER TABLE files ADD COLUMN IF NOT EXISTS first_seen TIMESTAMP WITH TIME ZONE DEFAULT now();
+ALTER TABLE files ADD COLUMN IF NOT EXISTS threat_label VARCHAR(256);
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS verified AS
+SELECT *
+FROM files
+WHERE status='verified';
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS candidates AS
+SELECT *
+FROM files
+WHERE status='candidate';
+
+CREATE MATERIALIZED VIEW IF NOT EXISTS malicious AS
+SELECT *
+FROM files
+WHERE status='malicious';
+
+CREATE INDEX IF NOT EXISTS idx_files_md5 ON files (md5);
+CREATE INDEX IF NOT EXISTS idx_files_sha1 ON files (sha1);
+CREATE INDEX IF NOT EXISTS idx_files_sha256 ON files (sha256);
+CREATE INDEX IF NOT EXISTS idx_files_sha512 ON files (sha512);
+CREATE INDEX IF NOT EXISTS idx_files_status ON files (status);
@@ -0,0 +1,24 @@
+-- Candidate sightings and prevalence promotions
+CREATE TABLE IF NOT EXISTS file_sightings (
+    file_id INTEGER NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+    filepath VARCHAR(512) NOT NULL,
+    host VARCHAR(64) NOT NULL,
+    scan_id VARCHAR(64) NOT NULL,
+    seen_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    PRIMARY KEY (file_id, filepath, host, scan_id)
+);
+
+CREATE TABLE IF NOT EXISTS promotions (
+    id BIGSERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+    filepath VARCHAR(512),
+    old_status VARCHAR(10) NOT NULL,
+    new_status VARCHAR(10) NOT NULL,
+    reason VARCHAR(32) NOT NULL,
+    hosts INTEGER,
+    scans INTEGER,
+    promoted_at TIMESTAMP WITH TIME ZONE DEFAULT now(),
+    reverted_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_sightings_filepath ON file_sightings (filepath);
@@ -0,0 +1,12 @@
+-- Candidate triage decisions
+CREATE TABLE IF NOT EXISTS triage_decisions (
+    id BIGSERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+    old_status VARCHAR(10),
+    new_status VARCHAR(10) NOT NULL,
+    reviewer VARCHAR(128) NOT NULL,
+    comment TEXT,
+    scan_id VARCHAR(64),
+    path_prefix VARCHAR(512),
+    decided_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
@@ -0,0 +1,19 @@
+-- Status change history
+CREATE TABLE IF NOT EXISTS file_status_history (
+    id BIGSERIAL PRIMARY KEY,
+    file_id INTEGER NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+    old_status VARCHAR(10),
+    new_status VARCHAR(10),
+    actor VARCHAR(128) NOT NULL,
+    source VARCHAR(128) NOT NULL,
+    reason TEXT,
+    changed_at TIMESTAMP WITH TIME ZONE DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_status_history_file_id ON file_status_history (file_id);
+
+-- Files stored before the history existed start with their current status
+INSERT INTO file_status_history (file_id, old_status, new_status, actor, source, reason)
+SELECT id, NULL, status, 'db_upgrade', 'baseline', 'status before history was recorded'
+FROM files f
+WHERE NOT EXISTS (SELECT 1 FROM file_status_history h WHERE h.file_id = f.id);
@@ -0,0 +1,15 @@
+-- Materialized view refreshes
+CREATE TABLE IF NOT EXISTS view_refreshes (
+    view_name VARCHAR(64) PRIMARY KEY,
+    requested_at TIMESTAMP WITH TIME ZONE,
+    refreshed_at TIMESTAMP WITH TIME ZONE
+);
+
+-- Unique indexes allow REFRESH MATERIALIZED VIEW CONCURRENTLY
+CREATE UNIQUE INDEX IF NOT EXISTS idx_verified_id ON verified (id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_candidates_id ON candidates (id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_malicious_id ON malicious (id);
+
+INSERT INTO view_refreshes (view_name, refreshed_at)
+VALUES ('verified', now()), ('candidates', now()), ('malicious', now())
+ON CONFLICT (view_name) DO NOTHING;
@@ -0,0 +1,10 @@
+-- Digests of the hash algorithms without a files column, like BLAKE3 and
+-- the ssdeep and TLSH fuzzy hashes
+CREATE TABLE IF NOT EXISTS file_digests (
+    file_id INTEGER NOT NULL REFERENCES files (id) ON DELETE CASCADE,
+    algorithm VARCHAR(16) NOT NULL,
+    digest TEXT NOT NULL,
+    PRIMARY KEY (file_id, algorithm)
+);
+
+CREATE INDEX IF NOT EXISTS idx_file_digests_digest ON file_digests (algorithm, digest);
@@ -0,0 +1,6 @@
+-- Known malicious file a candidate was similar to when it was sighted, as
+-- the analyzer matched their fuzzy digests. Such candidates are never
+-- promoted.
+ALTER TABLE file_sightings ADD COLUMN IF NOT EXISTS similar_to INTEGER REFERENCES files (id) ON DELETE SET NULL;
+
+CREATE INDEX IF NOT EXISTS idx_file_sightings_similar_to ON file_sightings (file_id) WHERE similar_to IS NOT NULL;
@@ -0,0 +1,136 @@
+// Package similarity compares the fuzzy digests of scanned files with
+// those of the known malicious files, so recompiled or lightly modified
+// malware that no exact hash matches is still flagged. TLSH and ssdeep
+// digests are compared the way their reference implementations do.
+package similarity
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+
+	"common/hashes"
+	"common/store"
+)
+
+// Thresholds decide which files are similar: TLSH digests at most
+// MaxTLSHDistance apart, or ssdeep digests scoring at least
+// MinSSDEEPScore.
+type Thresholds struct {
+	MaxTLSHDistance int
+	MinSSDEEPScore  int
+}
+
+// DefaultThresholds flag close variants while rarely matching unrelated
+// files.
+var DefaultThresholds = Thresholds{MaxTLSHDistance: 50, MinSSDEEPScore: 60}
+
+// ThresholdsFromEnv reads the thresholds from FUZZY_TLSH_MAX_DISTANCE and
+// FUZZY_SSDEEP_MIN_SCORE, using the defaults for unset ones.
+func ThresholdsFromEnv() (Thresholds, error) {
+	t := DefaultThresholds
+	for name, value := range map[string]*int{
+		"FUZZY_TLSH_MAX_DISTANCE": &t.MaxTLSHDistance,
+		"FUZZY_SSDEEP_MIN_SCORE":  &t.MinSSDEEPScore,
+	} {
+		setting := os.Getenv(name)
+		if setting == "" {
+			continue
+		}
+		n, err := strconv.Atoi(setting)
+		if err != nil || n < 0 {
+			return t, fmt.Errorf("%s must be a number, not %q", name, setting)
+		}
+		*value = n
+	}
+	if t.MinSSDEEPScore > 100 {
+		return t, fmt.Errorf("FUZZY_SSDEEP_MIN_SCORE must be at most 100")
+	}
+	return t, nil
+}
+
+// Match is the known file a scanned file is most similar to. Score is the
+// TLSH distance, lower is closer, or the ssdeep score, higher is closer.
+type Match struct {
+	File      store.File
+	Algorithm string
+	Score     int
+}
+
+type sample struct {
+	file   store.File
+	tlsh   *tlshDigest
+	ssdeep *ssdeepDigest
+}
+
+// Index holds the parsed fuzzy digests of the known malicious files.
+type Index struct {
+	thresholds Thresholds
+	samples    []sample
+}
+
+// Load indexes every malicious file of lister with a fuzzy digest.
+// Digests that cannot be parsed are skipped.
+func Load(ctx context.Context, lister store.FuzzyLister, t Thresholds) (*Index, error) {
+	ix := &Index{thresholds: t}
+	err := lister.ListFuzzy(ctx, "malicious", func(f store.File) error {
+		s := sample{file: f}
+		if d, err := parseTLSH(f.Other[hashes.TLSH]); err == nil {
+			s.tlsh = &d
+		}
+		if d, err := parseSSDEEP(f.Other[hashes.SSDEEP]); err == nil && d.comparable() {
+			s.ssdeep = &d
+		}
+		if s.tlsh != nil || s.ssdeep != nil {
+			ix.samples = append(ix.samples, s)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load fuzzy hashes: %v", err)
+	}
+	return ix, nil
+}
+
+// Len returns the number of indexed files.
+func (ix *Index) Len() int {
+	return len(ix.samples)
+}
+
+// Closest returns the known file closest to a scanned file with digests
+// by algorithm, if any is within the thresholds. TLSH distances tell
+// files apart more reliably, so ssdeep is only used without a TLSH match.
+func (ix *Index) Closest(digests map[string]string) (Match, bool) {
+	if d, err := parseTLSH(digests[hashes.TLSH]); err == nil {
+		best := Match{Score: -1}
+		for _, s := range ix.samples {
+			if s.tlsh == nil {
+				continue
+			}
+			distance := d.distance(*s.tlsh)
+			if distance <= ix.thresholds.MaxTLSHDistance && (best.Score < 0 || distance < best.Score) {
+				best = Match{File: s.file, Algorithm: hashes.TLSH, Score: distance}
+			}
+		}
+		if best.Score >= 0 {
+			return best, true
+		}
+	}
+	if d, err := parseSSDEEP(digests[hashes.SSDEEP]); err == nil && d.comparable() {
+		best := Match{Score: -1}
+		for _, s := range ix.samples {
+			if s.ssdeep == nil {
+				continue
+			}
+			score := d.score(*s.ssdeep)
+			if score > 0 && score >= ix.thresholds.MinSSDEEPScore && score > best.Score {
+				best = Match{File: s.file, Algorithm: hashes.SSDEEP, Score: score}
+			}
+		}
+		if best.Score >= 0 {
+			return best, true
+		}
+	}
+	return Match{}, false
+}
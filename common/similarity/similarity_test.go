@@ -0,0 +1,144 @@
+package similarity
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"common/hashes"
+	"common/store"
+)
+
+// tlshOf builds a TLSH digest from its header bytes as they appear in the
+// hex form, where the nibbles of the length value are swapped, and the
+// first byte of the body, the rest of which is zero.
+func tlshOf(checksum, lvalue, quartiles, body string) string {
+	return "T1" + checksum + lvalue + quartiles + body + strings.Repeat("00", 31)
+}
+
+func TestTLSHDistance(t *testing.T) {
+	base := tlshOf("00", "00", "00", "00")
+	tests := []struct {
+		name  string
+		other string
+		want  int
+	}{
+		{"identical", base, 0},
+		{"checksum", tlshOf("01", "00", "00", "00"), 1},
+		{"length value by 1", tlshOf("00", "10", "00", "00"), 1},
+		{"length value by 3", tlshOf("00", "30", "00", "00"), 36},
+		// The low nibble of the hex form is the high one of the value.
+		{"length value by 16", tlshOf("00", "01", "00", "00"), 192},
+		{"length value around", tlshOf("00", "FF", "00", "00"), 1},
+		{"first quartile ratio by 1", tlshOf("00", "00", "10", "00"), 1},
+		{"first quartile ratio by 3", tlshOf("00", "00", "30", "00"), 24},
+		{"second quartile ratio around", tlshOf("00", "00", "0F", "00"), 1},
+		{"bucket by 1", tlshOf("00", "00", "00", "01"), 1},
+		{"bucket by 2", tlshOf("00", "00", "00", "02"), 2},
+		{"bucket by 3", tlshOf("00", "00", "00", "03"), 6},
+		{"four buckets by 3", tlshOf("00", "00", "00", "FF"), 24},
+		{"everything", tlshOf("01", "30", "30", "FF"), 1 + 36 + 24 + 24},
+	}
+	for _, tt := range tests {
+		got, err := TLSHDistance(base, tt.other)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: distance %d, want %d", tt.name, got, tt.want)
+		}
+		if back, _ := TLSHDistance(tt.other, base); back != got {
+			t.Errorf("%s: distance %d one way and %d the other", tt.name, got, back)
+		}
+	}
+
+	// Digests of other TLSH versions lack the T1 prefix, and case does
+	// not matter.
+	if got, err := TLSHDistance(strings.ToLower(base), strings.TrimPrefix(base, "T1")); err != nil || got != 0 {
+		t.Errorf("distance without prefix = %d, %v, want 0", got, err)
+	}
+	for _, invalid := range []string{"", "T1", base[:len(base)-2], "T1" + strings.Repeat("ZZ", 35)} {
+		if _, err := TLSHDistance(base, invalid); err == nil {
+			t.Errorf("distance to %q succeeded, want an error", invalid)
+		}
+	}
+}
+
+func TestSSDEEPScore(t *testing.T) {
+	tests := []struct {
+		name string
+		a, b string
+		want int
+	}{
+		// The example of the python-ssdeep documentation.
+		{"reference", "3:AXGBicFlgVNhBGcL6wCrFQEv:AXGHsNhxLsr2C", "3:AXGBicFlIHBGcL6wCrFQEv:AXGH6xLsr2C", 22},
+		{"identical", "96:abcdefghijklmnop:abcdefgh", "96:abcdefghijklmnop:abcdefgh", 100},
+		{"no common substring", "96:abcdefghijklmnop:abcdefgh", "96:qrstuvwxyzABCDEF:qrstuvwx", 0},
+		{"block sizes too far apart", "96:abcdefghijklmnop:abcdefgh", "384:abcdefghijklmnop:abcdefgh", 0},
+		// The second signature of a digest is for twice its block size.
+		{"double block size", "96:qrstuvwxyzABCDEF:abcdefghijklmnop", "192:abcdefghijklmnop:qrstuvwx", 100},
+		// Runs of more than three equal characters are shortened.
+		{"sequences", "96:abcdefggggggghijk:abc", "96:abcdefggghijk:abc", 100},
+		{"file name", "96:abcdefghijklmnop:abcdefgh,\"/bin/ls\"", "96:abcdefghijklmnop:abcdefgh", 100},
+	}
+	for _, tt := range tests {
+		got, err := SSDEEPScore(tt.a, tt.b)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if got != tt.want {
+			t.Errorf("%s: score %d, want %d", tt.name, got, tt.want)
+		}
+	}
+	for _, invalid := range []string{"", "abc", "0:abc:abc", "x:abc:abc"} {
+		if _, err := SSDEEPScore("3:abc:abc", invalid); err == nil {
+			t.Errorf("score of %q succeeded, want an error", invalid)
+		}
+	}
+}
+
+type fuzzyFiles []store.File
+
+func (f fuzzyFiles) ListFuzzy(ctx context.Context, status string, fn func(store.File) error) error {
+	for _, file := range f {
+		if file.Status != status {
+			continue
+		}
+		if err := fn(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestClosest(t *testing.T) {
+	near := tlshOf("00", "00", "00", "01")
+	far := tlshOf("00", "30", "30", "FF")
+	ssdeep := "96:abcdefghijklmnop:abcdefgh"
+	known := fuzzyFiles{
+		{ID: 1, Status: "malicious", Other: map[string]string{hashes.TLSH: far}},
+		{ID: 2, Status: "malicious", Other: map[string]string{hashes.TLSH: near, hashes.SSDEEP: ssdeep}},
+		{ID: 3, Status: "verified", Other: map[string]string{hashes.TLSH: tlshOf("00", "00", "00", "00")}},
+		{ID: 4, Status: "malicious", Other: map[string]string{hashes.TLSH: "invalid"}},
+	}
+	ix, err := Load(context.Background(), known, Thresholds{MaxTLSHDistance: 50, MinSSDEEPScore: 60})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ix.Len() != 2 {
+		t.Errorf("indexed %d files, want the 2 malicious ones with valid digests", ix.Len())
+	}
+
+	match, ok := ix.Closest(map[string]string{hashes.TLSH: tlshOf("00", "00", "00", "00")})
+	if !ok || match.File.ID != 2 || match.Algorithm != hashes.TLSH || match.Score != 1 {
+		t.Errorf("Closest by TLSH = %+v, %v, want file 2 at distance 1", match, ok)
+	}
+	// TLSH digests beyond the threshold fall back to ssdeep.
+	match, ok = ix.Closest(map[string]string{hashes.TLSH: tlshOf("00", "90", "00", "00"), hashes.SSDEEP: ssdeep})
+	if !ok || match.File.ID != 2 || match.Algorithm != hashes.SSDEEP || match.Score != 100 {
+		t.Errorf("Closest by ssdeep = %+v, %v, want file 2 with score 100", match, ok)
+	}
+	if match, ok := ix.Closest(map[string]string{hashes.TLSH: tlshOf("00", "90", "00", "00")}); ok {
+		t.Errorf("Closest beyond the thresholds = %+v, want no match", match)
+	}
+}
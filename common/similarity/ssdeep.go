@@ -0,0 +1,160 @@
+package similarity
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Constants of the ssdeep reference implementation.
+const (
+	spamsumLength = 64
+	rollingWindow = 7
+	minBlockSize  = 3
+)
+
+// ssdeepDigest is a parsed ssdeep digest: the block size and the
+// signatures for it and for twice the block size, with runs of more than
+// three equal characters shortened to three, as they are compared.
+type ssdeepDigest struct {
+	blockSize uint64
+	first     string
+	second    string
+}
+
+func parseSSDEEP(digest string) (ssdeepDigest, error) {
+	parts := strings.SplitN(digest, ":", 3)
+	if len(parts) != 3 {
+		return ssdeepDigest{}, fmt.Errorf("invalid ssdeep digest %q", digest)
+	}
+	blockSize, err := strconv.ParseUint(parts[0], 10, 64)
+	if err != nil || blockSize == 0 {
+		return ssdeepDigest{}, fmt.Errorf("invalid ssdeep digest %q", digest)
+	}
+	// ssdeep may append the file name after a comma.
+	second, _, _ := strings.Cut(parts[2], ",")
+	return ssdeepDigest{blockSize: blockSize, first: eliminateSequences(parts[1]), second: eliminateSequences(second)}, nil
+}
+
+// SSDEEPScore returns the match score of two ssdeep digests, as computed
+// by the reference implementation, from 0 for no similarity to 100.
+func SSDEEPScore(a, b string) (int, error) {
+	x, err := parseSSDEEP(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := parseSSDEEP(b)
+	if err != nil {
+		return 0, err
+	}
+	return x.score(y), nil
+}
+
+func (x ssdeepDigest) score(y ssdeepDigest) int {
+	switch {
+	case x.blockSize == y.blockSize:
+		if x.first == y.first {
+			return 100
+		}
+		first := scoreStrings(x.first, y.first, x.blockSize)
+		second := scoreStrings(x.second, y.second, x.blockSize*2)
+		if second > first {
+			return second
+		}
+		return first
+	case x.blockSize*2 == y.blockSize:
+		return scoreStrings(x.second, y.first, y.blockSize)
+	case y.blockSize*2 == x.blockSize:
+		return scoreStrings(x.first, y.second, x.blockSize)
+	}
+	// Signatures of block sizes further apart cannot be compared.
+	return 0
+}
+
+// comparable reports whether the signature is long enough to tell files
+// apart. Those of tiny files are identical for many unrelated files.
+func (x ssdeepDigest) comparable() bool {
+	return len(x.first) >= rollingWindow
+}
+
+func scoreStrings(a, b string, blockSize uint64) int {
+	if len(a) > spamsumLength || len(b) > spamsumLength || !commonSubstring(a, b) {
+		return 0
+	}
+	score := editDistance(a, b) * spamsumLength / (len(a) + len(b))
+	score = 100 * score / spamsumLength
+	if score >= 100 {
+		return 0
+	}
+	score = 100 - score
+	// Short signatures of small block sizes match too easily, so their
+	// score is capped.
+	if blockSize >= (99+rollingWindow)/rollingWindow*minBlockSize {
+		return score
+	}
+	shorter := len(a)
+	if len(b) < shorter {
+		shorter = len(b)
+	}
+	if limit := int(blockSize/minBlockSize) * shorter; score > limit {
+		return limit
+	}
+	return score
+}
+
+// commonSubstring reports whether a and b share a run of rollingWindow
+// characters, without which ssdeep does not consider them related.
+func commonSubstring(a, b string) bool {
+	if len(a) < rollingWindow || len(b) < rollingWindow {
+		return false
+	}
+	windows := make(map[string]bool, len(a))
+	for i := 0; i+rollingWindow <= len(a); i++ {
+		windows[a[i:i+rollingWindow]] = true
+	}
+	for i := 0; i+rollingWindow <= len(b); i++ {
+		if windows[b[i:i+rollingWindow]] {
+			return true
+		}
+	}
+	return false
+}
+
+// editDistance is the Levenshtein distance of a and b, with a
+// substitution costing as much as a deletion and an insertion.
+func editDistance(a, b string) int {
+	previous := make([]int, len(b)+1)
+	current := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := previous[j-1]
+			if a[i-1] != b[j-1] {
+				cost += 2
+			}
+			if previous[j]+1 < cost {
+				cost = previous[j] + 1
+			}
+			if current[j-1]+1 < cost {
+				cost = current[j-1] + 1
+			}
+			current[j] = cost
+		}
+		previous, current = current, previous
+	}
+	return previous[len(b)]
+}
+
+func eliminateSequences(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if i >= 3 && s[i] == s[i-1] && s[i] == s[i-2] && s[i] == s[i-3] {
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,92 @@
+package similarity
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// tlshDigest is a decoded TLSH digest: checksum, length value, quartile
+// ratios and the 32 byte body of 2 bit bucket codes.
+type tlshDigest struct {
+	checksum byte
+	lvalue   byte
+	q1, q2   byte
+	body     []byte
+}
+
+func parseTLSH(digest string) (tlshDigest, error) {
+	raw, err := hex.DecodeString(strings.TrimPrefix(strings.ToUpper(digest), "T1"))
+	if err != nil || len(raw) != 35 {
+		return tlshDigest{}, fmt.Errorf("invalid TLSH digest %q", digest)
+	}
+	// The nibbles of the header bytes are swapped in the hex form.
+	return tlshDigest{
+		checksum: raw[0],
+		lvalue:   raw[1]<<4 | raw[1]>>4,
+		q1:       raw[2] >> 4,
+		q2:       raw[2] & 0x0f,
+		body:     raw[3:],
+	}, nil
+}
+
+// TLSHDistance returns the distance of two TLSH digests, as computed by
+// the reference implementation including the file length. 0 means
+// identical, files below about 50 are usually variants of each other.
+func TLSHDistance(a, b string) (int, error) {
+	x, err := parseTLSH(a)
+	if err != nil {
+		return 0, err
+	}
+	y, err := parseTLSH(b)
+	if err != nil {
+		return 0, err
+	}
+	return x.distance(y), nil
+}
+
+func (x tlshDigest) distance(y tlshDigest) int {
+	diff := 0
+	switch ldiff := modDiff(int(x.lvalue), int(y.lvalue), 256); ldiff {
+	case 0:
+	case 1:
+		diff = 1
+	default:
+		diff += ldiff * 12
+	}
+	for _, qdiff := range []int{modDiff(int(x.q1), int(y.q1), 16), modDiff(int(x.q2), int(y.q2), 16)} {
+		if qdiff <= 1 {
+			diff += qdiff
+		} else {
+			diff += (qdiff - 1) * 12
+		}
+	}
+	if x.checksum != y.checksum {
+		diff++
+	}
+	for i := range x.body {
+		for shift := 0; shift < 8; shift += 2 {
+			d := int(x.body[i]>>shift&3) - int(y.body[i]>>shift&3)
+			if d < 0 {
+				d = -d
+			}
+			if d == 3 {
+				d = 6
+			}
+			diff += d
+		}
+	}
+	return diff
+}
+
+// modDiff is the distance of x and y on a circle of r values.
+func modDiff(x, y, r int) int {
+	dl, dr := x-y, y+r-x
+	if y > x {
+		dl, dr = y-x, x+r-y
+	}
+	if dl > dr {
+		return dr
+	}
+	return dl
+}
@@ -0,0 +1,414 @@
+// Package snapshot writes and reads signed snapshots of the verified and
+// malicious hashes, which analyze scans on networks that cannot reach the
+// database.
+//
+// A snapshot file starts with the line "sys-check-snapshot <format>",
+// followed by a line holding the base64 Ed25519 signature of the SHA-512
+// digest of the rest of the file. The rest is gzip compressed JSON lines:
+// a Header, then one Entry per known file.
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"common/hashes"
+	"common/store"
+)
+
+// Format is the version of the file layout written by Write. Readers
+// refuse other versions.
+const Format = 1
+
+const magic = "sys-check-snapshot"
+
+var ErrBadSignature = errors.New("snapshot signature does not match the public key")
+
+type Header struct {
+	Format    int       `json:"format"`
+	CreatedAt time.Time `json:"createdAt"`
+	// Database schema version the snapshot was exported from.
+	SchemaVersion int `json:"schemaVersion"`
+	// Number of entries per status.
+	Files map[string]int64 `json:"files"`
+}
+
+// Entry is a known file. Other holds the digests of the algorithms without
+// a files column, by algorithm.
+type Entry struct {
+	MD5         string            `json:"md5,omitempty"`
+	SHA1        string            `json:"sha1,omitempty"`
+	SHA256      string            `json:"sha256,omitempty"`
+	SHA512      string            `json:"sha512,omitempty"`
+	Other       map[string]string `json:"other,omitempty"`
+	Status      string            `json:"status"`
+	Family      string            `json:"family,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	FirstSeen   *time.Time        `json:"firstSeen,omitempty"`
+	ThreatLabel string            `json:"threatLabel,omitempty"`
+}
+
+// Write signs and writes a snapshot of header and the entries passed to
+// the add function of entries, and returns the header with the counts of
+// the entries. The compressed entries are kept in a temporary file until
+// they are signed.
+func Write(w io.Writer, key ed25519.PrivateKey, header Header, entries func(add func(Entry) error) error) (Header, error) {
+	tmp, err := os.CreateTemp("", "sys-check-snapshot-*")
+	if err != nil {
+		return header, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	counts := make(map[string]int64)
+	zw := gzip.NewWriter(tmp)
+	encoder := json.NewEncoder(zw)
+	err = entries(func(e Entry) error {
+		if e.Status != "verified" && e.Status != "malicious" {
+			return fmt.Errorf("snapshots only hold verified and malicious files, not %q", e.Status)
+		}
+		counts[e.Status]++
+		return encoder.Encode(e)
+	})
+	if err != nil {
+		return header, err
+	}
+	if err := zw.Close(); err != nil {
+		return header, err
+	}
+
+	// The header needs the counts, so it is compressed into a gzip member
+	// of its own that precedes the entries.
+	header.Format = Format
+	header.Files = counts
+	var head bytes.Buffer
+	zw = gzip.NewWriter(&head)
+	if err := json.NewEncoder(zw).Encode(header); err != nil {
+		return header, err
+	}
+	if err := zw.Close(); err != nil {
+		return header, err
+	}
+
+	digest := sha512.New()
+	digest.Write(head.Bytes())
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return header, err
+	}
+	if _, err := io.Copy(digest, tmp); err != nil {
+		return header, err
+	}
+	signature := ed25519.Sign(key, digest.Sum(nil))
+
+	if _, err := fmt.Fprintf(w, "%s %d\n%s\n", magic, Format, base64.StdEncoding.EncodeToString(signature)); err != nil {
+		return header, err
+	}
+	if _, err := w.Write(head.Bytes()); err != nil {
+		return header, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return header, err
+	}
+	_, err = io.Copy(w, tmp)
+	return header, err
+}
+
+// Snapshot is a read-only known hash store held in memory.
+type Snapshot struct {
+	header  Header
+	entries []Entry
+	// Entry index by digest, per algorithm with a files column, and by
+	// the other exact digests prefixed with their algorithm.
+	index  [4]map[string]int
+	others map[string]int
+}
+
+// Open reads the snapshot at path. Its entries are only parsed once the
+// signature of the whole file is verified with key.
+func Open(path string, key ed25519.PublicKey) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	s, err := Read(bufio.NewReaderSize(file, 1<<20), key)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return s, nil
+}
+
+func Read(r *bufio.Reader, key ed25519.PublicKey) (*Snapshot, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("not a snapshot: %v", err)
+	}
+	name, version, _ := strings.Cut(strings.TrimSpace(line), " ")
+	if name != magic {
+		return nil, errors.New("not a snapshot")
+	}
+	if format, err := strconv.Atoi(version); err != nil || format != Format {
+		return nil, fmt.Errorf("snapshot format %s is not supported, expected %d", version, Format)
+	}
+	line, err = r.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("missing signature: %v", err)
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(line))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signature: %v", err)
+	}
+
+	// The signed data is kept compressed in memory, so nothing of it is
+	// parsed before the signature is verified.
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	digest := sha512.Sum512(data)
+	if !ed25519.Verify(key, digest[:], signature) {
+		return nil, ErrBadSignature
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid snapshot data: %v", err)
+	}
+	decoder := json.NewDecoder(zr)
+
+	s := &Snapshot{}
+	if err := decoder.Decode(&s.header); err != nil {
+		return nil, fmt.Errorf("invalid snapshot header: %v", err)
+	}
+	if s.header.Format != Format {
+		return nil, fmt.Errorf("snapshot format %d is not supported, expected %d", s.header.Format, Format)
+	}
+	for i := range s.index {
+		s.index[i] = make(map[string]int)
+	}
+	s.others = make(map[string]int)
+	for {
+		var e Entry
+		err := decoder.Decode(&e)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot entry %d: %v", len(s.entries)+1, err)
+		}
+		digests, err := hashes.Digests(e.MD5, e.SHA1, e.SHA256, e.SHA512)
+		if err != nil {
+			return nil, fmt.Errorf("invalid snapshot entry %d: %v", len(s.entries)+1, err)
+		}
+		for i, d := range digests {
+			if d == nil {
+				continue
+			}
+			if _, seen := s.index[i][string(d.([]byte))]; !seen {
+				s.index[i][string(d.([]byte))] = len(s.entries)
+			}
+		}
+		for algorithm, digest := range e.Other {
+			normalized, err := hashes.Normalize(algorithm, digest)
+			if err != nil {
+				return nil, fmt.Errorf("invalid snapshot entry %d: %v", len(s.entries)+1, err)
+			}
+			e.Other[algorithm] = normalized
+			if _, seen := s.others[algorithm+" "+normalized]; !seen && !hashes.Fuzzy(algorithm) {
+				s.others[algorithm+" "+normalized] = len(s.entries)
+			}
+		}
+		s.entries = append(s.entries, e)
+	}
+	var total int64
+	for _, count := range s.header.Files {
+		total += count
+	}
+	if total != int64(len(s.entries)) {
+		return nil, fmt.Errorf("snapshot holds %d files, its header %d", len(s.entries), total)
+	}
+	return s, nil
+}
+
+func (s *Snapshot) Header() Header {
+	return s.header
+}
+
+func (s *Snapshot) Lookup(ctx context.Context, h store.Hashes) ([]store.File, error) {
+	digests, err := hashes.Digests(h.MD5, h.SHA1, h.SHA256, h.SHA512)
+	if err != nil {
+		return nil, err
+	}
+	var matched []int
+	for i, d := range digests {
+		if d == nil {
+			continue
+		}
+		if n, ok := s.index[i][string(d.([]byte))]; ok {
+			matched = append(matched, n)
+		}
+	}
+	for algorithm, digest := range h.Other {
+		if n, ok := s.others[algorithm+" "+digest]; ok && !hashes.Fuzzy(algorithm) {
+			matched = append(matched, n)
+		}
+	}
+	sort.Ints(matched)
+
+	var files []store.File
+	for i, n := range matched {
+		if i > 0 && matched[i-1] == n {
+			continue
+		}
+		files = append(files, s.file(n))
+	}
+	return files, nil
+}
+
+func (s *Snapshot) ListFuzzy(ctx context.Context, status string, fn func(store.File) error) error {
+	for n, e := range s.entries {
+		if e.Status != status || e.Other[hashes.SSDEEP] == "" && e.Other[hashes.TLSH] == "" {
+			continue
+		}
+		if err := fn(s.file(n)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// file returns entry n as a known file, numbered from 1.
+func (s *Snapshot) file(n int) store.File {
+	e := s.entries[n]
+	return store.File{
+		ID:          int64(n + 1),
+		MD5:         strings.ToLower(e.MD5),
+		SHA1:        strings.ToLower(e.SHA1),
+		SHA256:      strings.ToLower(e.SHA256),
+		SHA512:      strings.ToLower(e.SHA512),
+		Other:       e.Other,
+		Status:      e.Status,
+		Family:      e.Family,
+		Source:      e.Source,
+		FirstSeen:   e.FirstSeen,
+		ThreatLabel: e.ThreatLabel,
+	}
+}
+
+func (s *Snapshot) BulkLookup(ctx context.Context, hs []store.Hashes) ([][]store.File, error) {
+	matches := make([][]store.File, len(hs))
+	for i, h := range hs {
+		files, err := s.Lookup(ctx, h)
+		if err != nil {
+			return nil, err
+		}
+		matches[i] = files
+	}
+	return matches, nil
+}
+
+func (s *Snapshot) Upsert(ctx context.Context, f store.File, c store.Change) (store.Outcome, error) {
+	return store.Unchanged, store.ErrReadOnly
+}
+
+func (s *Snapshot) SetStatus(ctx context.Context, hash, status string, c store.Change) (int64, error) {
+	return 0, store.ErrReadOnly
+}
+
+func (s *Snapshot) Stats(ctx context.Context) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	for status, count := range s.header.Files {
+		counts[status] = count
+	}
+	return counts, nil
+}
+
+func (s *Snapshot) Begin(ctx context.Context) (store.Tx, error) {
+	return nil, store.ErrReadOnly
+}
+
+func (s *Snapshot) Close() error {
+	return nil
+}
+
+// GenerateKey writes a new signing key pair as PEM files, the private key
+// readable by its owner only.
+func GenerateKey(privatePath, publicPath string) error {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return err
+	}
+	privateDER, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return err
+	}
+	publicDER, err := x509.MarshalPKIXPublicKey(public)
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(privatePath, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: privateDER}), 0600)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(publicPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: publicDER}), 0644)
+}
+
+func LoadPrivateKey(path string) (ed25519.PrivateKey, error) {
+	der, err := readPEM(path, "PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", path)
+	}
+	return private, nil
+}
+
+func LoadPublicKey(path string) (ed25519.PublicKey, error) {
+	der, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", path)
+	}
+	return public, nil
+}
+
+func readPEM(path, blockType string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != blockType {
+		return nil, fmt.Errorf("%s does not hold a PEM %s", path, blockType)
+	}
+	return block.Bytes, nil
+}
@@ -0,0 +1,117 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"strings"
+	"testing"
+
+	"common/store"
+)
+
+var testEntries = []Entry{
+	{MD5: strings.Repeat("a1", 16), SHA256: strings.Repeat("c3", 32), Status: "verified"},
+	{SHA1: strings.Repeat("b2", 20), Status: "malicious", Family: "Mirai", ThreatLabel: "trojan.mirai"},
+}
+
+func writeTestSnapshot(t *testing.T, key ed25519.PrivateKey) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	header, err := Write(&buf, key, Header{SchemaVersion: 7}, func(add func(Entry) error) error {
+		for _, e := range testEntries {
+			if err := add(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Files["verified"] != 1 || header.Files["malicious"] != 1 {
+		t.Fatalf("Write counted %v, want one verified and one malicious file", header.Files)
+	}
+	return buf.Bytes()
+}
+
+func readTestSnapshot(data []byte, key ed25519.PublicKey) (*Snapshot, error) {
+	return Read(bufio.NewReader(bytes.NewReader(data)), key)
+}
+
+func TestRoundTrip(t *testing.T) {
+	public, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := readTestSnapshot(writeTestSnapshot(t, private), public)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header := s.Header(); header.Format != Format || header.SchemaVersion != 7 {
+		t.Errorf("Header = %+v, want format %d and schema version 7", header, Format)
+	}
+
+	ctx := context.Background()
+	files, err := s.Lookup(ctx, store.Hashes{SHA256: strings.Repeat("c3", 32)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Status != "verified" || files[0].MD5 != strings.Repeat("a1", 16) {
+		t.Errorf("Lookup by SHA256 = %+v, want the verified file", files)
+	}
+	files, err = s.Lookup(ctx, store.Hashes{SHA1: strings.Repeat("B2", 20)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Status != "malicious" || files[0].Family != "Mirai" {
+		t.Errorf("Lookup by SHA1 = %+v, want the malicious file", files)
+	}
+	files, err = s.Lookup(ctx, store.Hashes{MD5: strings.Repeat("d4", 16)})
+	if err != nil || len(files) != 0 {
+		t.Errorf("Lookup of an unknown hash = %+v, %v, want no files", files, err)
+	}
+	if _, err := s.SetStatus(ctx, strings.Repeat("a1", 16), "malicious", store.Change{}); !errors.Is(err, store.ErrReadOnly) {
+		t.Errorf("SetStatus = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestBadSignature(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := writeTestSnapshot(t, private)
+	if _, err := readTestSnapshot(data, other); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Read with another key = %v, want ErrBadSignature", err)
+	}
+
+	public := private.Public().(ed25519.PublicKey)
+	tampered := append([]byte(nil), data...)
+	tampered[len(tampered)-10] ^= 0xff
+	if _, err := readTestSnapshot(tampered, public); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Read of a changed snapshot = %v, want ErrBadSignature", err)
+	}
+	if _, err := readTestSnapshot(append(data, "trailing"...), public); !errors.Is(err, ErrBadSignature) {
+		t.Errorf("Read with trailing bytes = %v, want ErrBadSignature", err)
+	}
+}
+
+func TestWriteRejectsCandidates(t *testing.T) {
+	_, private, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Write(&bytes.Buffer{}, private, Header{}, func(add func(Entry) error) error {
+		return add(Entry{MD5: strings.Repeat("a1", 16), Status: "candidate"})
+	})
+	if err == nil {
+		t.Error("Write of a candidate succeeded, want an error")
+	}
+}
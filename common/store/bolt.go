@@ -0,0 +1,469 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"common/hashes"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// Buckets of the bolt store. files maps ids to JSON encoded files, each
+// digest bucket maps digests to ids, others maps the other digests
+// prefixed with their algorithm to ids and history holds the status
+// history by file id and sequence number.
+var (
+	filesBucket   = []byte("files")
+	historyBucket = []byte("history")
+	othersBucket  = []byte("others")
+	digestBuckets = [][]byte{[]byte("md5"), []byte("sha1"), []byte("sha256"), []byte("sha512")}
+)
+
+// Bolt is the store in a single local file, for hosts without PostgreSQL.
+// Only one process can open the file at a time.
+type Bolt struct {
+	*boltOps
+	db *bolt.DB
+}
+
+type boltTx struct {
+	*boltOps
+	tx *bolt.Tx
+}
+
+// boltOps runs the operations in transactions of the store, or in the
+// transaction it belongs to.
+type boltOps struct {
+	view   func(fn func(tx *bolt.Tx) error) error
+	update func(fn func(tx *bolt.Tx) error) error
+}
+
+// boltEvent is a status history entry.
+type boltEvent struct {
+	FileID    int64     `json:"fileId"`
+	OldStatus string    `json:"oldStatus,omitempty"`
+	NewStatus string    `json:"newStatus"`
+	Actor     string    `json:"actor"`
+	Source    string    `json:"source"`
+	Reason    string    `json:"reason,omitempty"`
+	ChangedAt time.Time `json:"changedAt"`
+}
+
+func OpenBolt(path string) (*Bolt, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("failed to open %s: %v", path, err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range append([][]byte{filesBucket, historyBucket, othersBucket}, digestBuckets...) {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create buckets in %s: %v", path, err)
+	}
+	return &Bolt{boltOps: &boltOps{view: db.View, update: db.Update}, db: db}, nil
+}
+
+func (b *Bolt) Begin(ctx context.Context) (Tx, error) {
+	tx, err := b.db.Begin(true)
+	if err != nil {
+		return nil, err
+	}
+	run := func(fn func(tx *bolt.Tx) error) error {
+		return fn(tx)
+	}
+	return &boltTx{boltOps: &boltOps{view: run, update: run}, tx: tx}, nil
+}
+
+func (b *Bolt) Close() error {
+	return b.db.Close()
+}
+
+func (t *boltTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *boltTx) Rollback() error {
+	err := t.tx.Rollback()
+	if err == bolt.ErrTxClosed {
+		return nil
+	}
+	return err
+}
+
+func (o *boltOps) Lookup(ctx context.Context, h Hashes) ([]File, error) {
+	var files []File
+	err := o.view(func(tx *bolt.Tx) error {
+		var err error
+		files, err = lookupBolt(tx, h)
+		return err
+	})
+	return files, err
+}
+
+func (o *boltOps) BulkLookup(ctx context.Context, hs []Hashes) ([][]File, error) {
+	matches := make([][]File, len(hs))
+	err := o.view(func(tx *bolt.Tx) error {
+		for i, h := range hs {
+			files, err := lookupBolt(tx, h)
+			if err != nil {
+				return err
+			}
+			matches[i] = files
+		}
+		return nil
+	})
+	return matches, err
+}
+
+func (o *boltOps) Upsert(ctx context.Context, f File, c Change) (Outcome, error) {
+	if !validStatus(f.Status) {
+		return Unchanged, ErrInvalidStatus
+	}
+	digests, err := f.Hashes().digests()
+	if err != nil {
+		return Unchanged, err
+	}
+	others, _, err := f.Hashes().others()
+	if err != nil {
+		return Unchanged, err
+	}
+
+	outcome := Unchanged
+	err = o.update(func(tx *bolt.Tx) error {
+		ids := matchBolt(tx, digests, others)
+		if len(ids) == 0 {
+			outcome = Inserted
+			f.Other = others
+			return insertBolt(tx, f, digests, c)
+		}
+
+		known, err := getBolt(tx, ids[0])
+		if err != nil {
+			return err
+		}
+		changed := false
+		for i, digest := range digests {
+			// Digests stored with another file are not copied
+			if digest == nil || fileDigest(known, i) != "" || tx.Bucket(digestBuckets[i]).Get(digest.([]byte)) != nil {
+				continue
+			}
+			setFileDigest(&known, i, hex.EncodeToString(digest.([]byte)))
+			if err := tx.Bucket(digestBuckets[i]).Put(digest.([]byte), idKey(known.ID)); err != nil {
+				return err
+			}
+			changed = true
+		}
+		for algorithm, digest := range others {
+			stored := tx.Bucket(othersBucket).Get(otherKey(algorithm, digest)) != nil
+			if known.Other[algorithm] != "" || stored && !hashes.Fuzzy(algorithm) {
+				continue
+			}
+			if known.Other == nil {
+				known.Other = make(map[string]string)
+			}
+			known.Other[algorithm] = digest
+			if !stored {
+				if err := tx.Bucket(othersBucket).Put(otherKey(algorithm, digest), idKey(known.ID)); err != nil {
+					return err
+				}
+			}
+			changed = true
+		}
+		if known.Size == nil && f.Size != nil {
+			known.Size = f.Size
+			changed = true
+		}
+		old := known.Status
+		if f.Status == "malicious" {
+			changed = flagBolt(&known, f) || changed
+		}
+		if changed {
+			outcome = Updated
+		}
+		if known.Status != old {
+			outcome = Flagged
+		}
+		paths := len(known.Paths)
+		known.Paths = addPaths(known.Paths, f.Paths)
+		if !changed && len(known.Paths) == paths {
+			return nil
+		}
+		if err := putBolt(tx, known); err != nil {
+			return err
+		}
+		if known.Status == old {
+			return nil
+		}
+		return recordBolt(tx, known.ID, old, known.Status, c)
+	})
+	if err != nil {
+		return Unchanged, fmt.Errorf("failed to store file: %v", err)
+	}
+	return outcome, nil
+}
+
+func (o *boltOps) SetStatus(ctx context.Context, hash, status string, c Change) (int64, error) {
+	if !validStatus(status) {
+		return 0, ErrInvalidStatus
+	}
+	column, digest, err := hashes.Parse(hash)
+	if err != nil {
+		return 0, err
+	}
+
+	var changed int64
+	err = o.update(func(tx *bolt.Tx) error {
+		id := tx.Bucket([]byte(column)).Get(digest)
+		if id == nil {
+			return ErrNotFound
+		}
+		f, err := getBolt(tx, int64(binary.BigEndian.Uint64(id)))
+		if err != nil {
+			return err
+		}
+		if f.Status == status {
+			return nil
+		}
+		old := f.Status
+		f.Status = status
+		if err := putBolt(tx, f); err != nil {
+			return err
+		}
+		changed++
+		return recordBolt(tx, f.ID, old, status, c)
+	})
+	return changed, err
+}
+
+func (o *boltOps) Stats(ctx context.Context) (map[string]int64, error) {
+	counts := make(map[string]int64)
+	err := o.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(_, value []byte) error {
+			var f File
+			if err := json.Unmarshal(value, &f); err != nil {
+				return err
+			}
+			counts[f.Status]++
+			return nil
+		})
+	})
+	return counts, err
+}
+
+func (b *Bolt) ListFuzzy(ctx context.Context, status string, fn func(File) error) error {
+	return b.view(func(tx *bolt.Tx) error {
+		return tx.Bucket(filesBucket).ForEach(func(_, value []byte) error {
+			var f File
+			if err := json.Unmarshal(value, &f); err != nil {
+				return err
+			}
+			if f.Status != status || f.Other[hashes.SSDEEP] == "" && f.Other[hashes.TLSH] == "" {
+				return nil
+			}
+			return fn(f)
+		})
+	})
+}
+
+// matchBolt returns the ids of the files holding any of digests or the
+// exact other digests, in order. Without exact digests the files are
+// matched by the fuzzy ones.
+func matchBolt(tx *bolt.Tx, digests []interface{}, others map[string]string) []int64 {
+	var keys [][]byte
+	exact := false
+	for i, digest := range digests {
+		if digest != nil {
+			keys = append(keys, tx.Bucket(digestBuckets[i]).Get(digest.([]byte)))
+			exact = true
+		}
+	}
+	for algorithm := range others {
+		exact = exact || !hashes.Fuzzy(algorithm)
+	}
+	for algorithm, digest := range others {
+		if !exact || !hashes.Fuzzy(algorithm) {
+			keys = append(keys, tx.Bucket(othersBucket).Get(otherKey(algorithm, digest)))
+		}
+	}
+
+	var ids []int64
+	for _, key := range keys {
+		if key == nil {
+			continue
+		}
+		id := int64(binary.BigEndian.Uint64(key))
+		found := false
+		for _, other := range ids {
+			found = found || other == id
+		}
+		if !found {
+			ids = append(ids, id)
+		}
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+func lookupBolt(tx *bolt.Tx, h Hashes) ([]File, error) {
+	digests, err := h.digests()
+	if err != nil {
+		return nil, err
+	}
+	others, _, err := h.others()
+	if err != nil {
+		return nil, err
+	}
+	var files []File
+	for _, id := range matchBolt(tx, digests, others) {
+		f, err := getBolt(tx, id)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, f)
+	}
+	return files, nil
+}
+
+// flagBolt makes known malicious with the details of f, or fills in the
+// details it is missing when it already was, and reports whether it
+// changed.
+func flagBolt(known *File, f File) bool {
+	details := []struct{ known, f *string }{
+		{&known.Family, &f.Family}, {&known.Source, &f.Source}, {&known.ThreatLabel, &f.ThreatLabel},
+	}
+	changed := false
+	for _, d := range details {
+		// Malicious files keep the details of the feed that flagged them.
+		if *d.f == "" || *d.known == *d.f || known.Status == "malicious" && *d.known != "" {
+			continue
+		}
+		*d.known = *d.f
+		changed = true
+	}
+	if known.Status != "malicious" {
+		known.Status = "malicious"
+		changed = true
+	}
+	return changed
+}
+
+func insertBolt(tx *bolt.Tx, f File, digests []interface{}, c Change) error {
+	seq, err := tx.Bucket(filesBucket).NextSequence()
+	if err != nil {
+		return err
+	}
+	f.ID = int64(seq)
+	for i, digest := range digests {
+		value := ""
+		if digest != nil {
+			value = hex.EncodeToString(digest.([]byte))
+			if err := tx.Bucket(digestBuckets[i]).Put(digest.([]byte), idKey(f.ID)); err != nil {
+				return err
+			}
+		}
+		setFileDigest(&f, i, value)
+	}
+	for algorithm, digest := range f.Other {
+		// Fuzzy digests may be shared, the first file keeps them.
+		if hashes.Fuzzy(algorithm) && tx.Bucket(othersBucket).Get(otherKey(algorithm, digest)) != nil {
+			continue
+		}
+		if err := tx.Bucket(othersBucket).Put(otherKey(algorithm, digest), idKey(f.ID)); err != nil {
+			return err
+		}
+	}
+	if f.FirstSeen == nil {
+		now := time.Now()
+		f.FirstSeen = &now
+	}
+	f.Paths = addPaths(nil, f.Paths)
+	if err := putBolt(tx, f); err != nil {
+		return err
+	}
+	return recordBolt(tx, f.ID, "", f.Status, c)
+}
+
+func getBolt(tx *bolt.Tx, id int64) (File, error) {
+	var f File
+	value := tx.Bucket(filesBucket).Get(idKey(id))
+	if value == nil {
+		return f, fmt.Errorf("file %d is indexed but missing", id)
+	}
+	if err := json.Unmarshal(value, &f); err != nil {
+		return f, fmt.Errorf("file %d is corrupt: %v", id, err)
+	}
+	return f, nil
+}
+
+func putBolt(tx *bolt.Tx, f File) error {
+	value, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return tx.Bucket(filesBucket).Put(idKey(f.ID), value)
+}
+
+func recordBolt(tx *bolt.Tx, id int64, oldStatus, newStatus string, c Change) error {
+	bucket := tx.Bucket(historyBucket)
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	}
+	value, err := json.Marshal(boltEvent{
+		FileID:    id,
+		OldStatus: oldStatus,
+		NewStatus: newStatus,
+		Actor:     c.Actor,
+		Source:    c.Source,
+		Reason:    c.Reason,
+		ChangedAt: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	return bucket.Put(append(idKey(id), idKey(int64(seq))...), value)
+}
+
+func idKey(id int64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, uint64(id))
+	return key
+}
+
+func otherKey(algorithm, digest string) []byte {
+	return []byte(algorithm + " " + digest)
+}
+
+func fileDigest(f File, i int) string {
+	return [...]string{f.MD5, f.SHA1, f.SHA256, f.SHA512}[i]
+}
+
+func setFileDigest(f *File, i int, value string) {
+	*[...]*string{&f.MD5, &f.SHA1, &f.SHA256, &f.SHA512}[i] = value
+}
+
+// addPaths appends the paths that are not known yet.
+func addPaths(known, paths []string) []string {
+	for _, path := range paths {
+		found := path == ""
+		for _, k := range known {
+			found = found || k == path
+		}
+		if !found {
+			known = append(known, path)
+		}
+	}
+	return known
+}
@@ -0,0 +1,201 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	testMD5    = strings.Repeat("a1", 16)
+	testSHA1   = strings.Repeat("b2", 20)
+	testSHA256 = strings.Repeat("c3", 32)
+	otherMD5   = strings.Repeat("d4", 16)
+)
+
+func openTestStore(t *testing.T) KnownHashStore {
+	t.Helper()
+	st, err := OpenBolt(filepath.Join(t.TempDir(), "known.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { st.Close() })
+	return st
+}
+
+func lookupOne(t *testing.T, st Operations, h Hashes) File {
+	t.Helper()
+	files, err := st.Lookup(context.Background(), h)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		t.Fatalf("Lookup(%+v) found %d files, want 1", h, len(files))
+	}
+	return files[0]
+}
+
+func TestBoltUpsertAndLookup(t *testing.T) {
+	ctx := context.Background()
+	st := openTestStore(t)
+	change := Change{Actor: "test"}
+
+	outcome, err := st.Upsert(ctx, File{MD5: testMD5, SHA256: testSHA256, Status: "verified", Paths: []string{"/bin/a"}}, change)
+	if err != nil || outcome != Inserted {
+		t.Fatalf("Upsert of a new file = %v, %v, want Inserted", outcome, err)
+	}
+	f := lookupOne(t, st, Hashes{SHA256: testSHA256})
+	if f.MD5 != testMD5 || f.Status != "verified" {
+		t.Errorf("Lookup by SHA256 = %+v, want the stored MD5 and status", f)
+	}
+
+	size := int64(42)
+	outcome, err = st.Upsert(ctx, File{SHA1: testSHA1, SHA256: testSHA256, Size: &size, Status: "candidate", Paths: []string{"/bin/b"}}, change)
+	if err != nil || outcome != Updated {
+		t.Fatalf("Upsert with missing digests = %v, %v, want Updated", outcome, err)
+	}
+	f = lookupOne(t, st, Hashes{SHA1: testSHA1})
+	if f.MD5 != testMD5 || f.Size == nil || *f.Size != size {
+		t.Errorf("Lookup by SHA1 = %+v, want the digests and size merged", f)
+	}
+	if f.Status != "verified" {
+		t.Errorf("Upsert changed the status to %q", f.Status)
+	}
+	if len(f.Paths) != 2 {
+		t.Errorf("Paths = %v, want both paths", f.Paths)
+	}
+
+	outcome, err = st.Upsert(ctx, File{MD5: testMD5, Status: "verified"}, change)
+	if err != nil || outcome != Unchanged {
+		t.Errorf("Upsert of a known file = %v, %v, want Unchanged", outcome, err)
+	}
+	if _, err := st.Upsert(ctx, File{MD5: otherMD5, Status: "unknown"}, change); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("Upsert with an invalid status = %v, want ErrInvalidStatus", err)
+	}
+
+	files, err := st.Lookup(ctx, Hashes{MD5: otherMD5})
+	if err != nil || len(files) != 0 {
+		t.Errorf("Lookup of an unknown hash = %v, %v, want no files", files, err)
+	}
+}
+
+func TestBoltUpsertMalicious(t *testing.T) {
+	ctx := context.Background()
+	st := openTestStore(t)
+	if _, err := st.Upsert(ctx, File{MD5: testMD5, Status: "candidate"}, Change{}); err != nil {
+		t.Fatal(err)
+	}
+
+	feed := File{MD5: testMD5, Status: "malicious", Family: "Mirai", Source: "feed-a", ThreatLabel: "trojan.mirai"}
+	outcome, err := st.Upsert(ctx, feed, Change{Actor: "test"})
+	if err != nil || outcome != Flagged {
+		t.Fatalf("Upsert of a malicious candidate = %v, %v, want Flagged", outcome, err)
+	}
+	f := lookupOne(t, st, Hashes{MD5: testMD5})
+	if f.Status != "malicious" || f.Family != "Mirai" || f.Source != "feed-a" || f.ThreatLabel != "trojan.mirai" {
+		t.Errorf("Lookup after the import = %+v, want the file malicious with the feed details", f)
+	}
+
+	// A second feed does not take over the file.
+	outcome, err = st.Upsert(ctx, File{MD5: testMD5, Status: "malicious", Family: "Gafgyt", Source: "feed-b"}, Change{})
+	if err != nil || outcome != Unchanged {
+		t.Errorf("Upsert of a known malicious file = %v, %v, want Unchanged", outcome, err)
+	}
+	if f := lookupOne(t, st, Hashes{MD5: testMD5}); f.Source != "feed-a" || f.Family != "Mirai" {
+		t.Errorf("second feed changed the file to %+v", f)
+	}
+
+	// Other statuses do not change known files.
+	if _, err := st.Upsert(ctx, File{MD5: testMD5, Status: "verified"}, Change{}); err != nil {
+		t.Fatal(err)
+	}
+	if f := lookupOne(t, st, Hashes{MD5: testMD5}); f.Status != "malicious" {
+		t.Errorf("verified import changed the status to %q", f.Status)
+	}
+}
+
+func TestBoltBulkLookup(t *testing.T) {
+	ctx := context.Background()
+	st := openTestStore(t)
+	for _, f := range []File{{MD5: testMD5, Status: "verified"}, {SHA256: testSHA256, Status: "malicious"}} {
+		if _, err := st.Upsert(ctx, f, Change{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	matches, err := st.BulkLookup(ctx, []Hashes{{SHA256: testSHA256}, {MD5: otherMD5}, {MD5: testMD5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(matches) != 3 {
+		t.Fatalf("BulkLookup returned %d results, want 3", len(matches))
+	}
+	want := []string{"malicious", "", "verified"}
+	for i, status := range want {
+		if status == "" {
+			if len(matches[i]) != 0 {
+				t.Errorf("result %d = %+v, want no files", i, matches[i])
+			}
+			continue
+		}
+		if len(matches[i]) != 1 || matches[i][0].Status != status {
+			t.Errorf("result %d = %+v, want one %s file", i, matches[i], status)
+		}
+	}
+}
+
+func TestBoltSetStatus(t *testing.T) {
+	ctx := context.Background()
+	st := openTestStore(t)
+	if _, err := st.Upsert(ctx, File{MD5: testMD5, SHA256: testSHA256, Status: "candidate"}, Change{}); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := st.SetStatus(ctx, testSHA256, "malicious", Change{Actor: "test", Reason: "reviewed"})
+	if err != nil || changed != 1 {
+		t.Fatalf("SetStatus = %d, %v, want 1 change", changed, err)
+	}
+	if f := lookupOne(t, st, Hashes{MD5: testMD5}); f.Status != "malicious" {
+		t.Errorf("status after SetStatus = %q, want malicious", f.Status)
+	}
+	changed, err = st.SetStatus(ctx, testMD5, "malicious", Change{})
+	if err != nil || changed != 0 {
+		t.Errorf("SetStatus to the same status = %d, %v, want no change", changed, err)
+	}
+	if _, err := st.SetStatus(ctx, otherMD5, "verified", Change{}); !errors.Is(err, ErrNotFound) {
+		t.Errorf("SetStatus of an unknown hash = %v, want ErrNotFound", err)
+	}
+	if _, err := st.SetStatus(ctx, testMD5, "unknown", Change{}); !errors.Is(err, ErrInvalidStatus) {
+		t.Errorf("SetStatus to an invalid status = %v, want ErrInvalidStatus", err)
+	}
+
+	stats, err := st.Stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats["malicious"] != 1 || stats["candidate"] != 0 {
+		t.Errorf("Stats = %v, want one malicious file", stats)
+	}
+}
+
+func TestBoltRollback(t *testing.T) {
+	ctx := context.Background()
+	st := openTestStore(t)
+	tx, err := st.Begin(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := tx.Upsert(ctx, File{MD5: testMD5, Status: "verified"}, Change{}); err != nil {
+		t.Fatal(err)
+	}
+	lookupOne(t, tx, Hashes{MD5: testMD5})
+	if err := tx.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	files, err := st.Lookup(ctx, Hashes{MD5: testMD5})
+	if err != nil || len(files) != 0 {
+		t.Errorf("Lookup after Rollback = %v, %v, want no files", files, err)
+	}
+}
@@ -0,0 +1,280 @@
+package store
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+)
+
+// Format of the filter cache, changed whenever the layout is.
+const filterFormat = 1
+
+// Bits per digest and probes of the Bloom filters, for about 1% false
+// positives at capacity.
+const (
+	filterBitsPerDigest = 10
+	filterProbes        = 7
+)
+
+// Filter is a Bloom filter per hash algorithm of every digest known to a
+// store. A lookup that misses every filter is certainly unknown and does
+// not need to reach the store. Filters only grow, so a status change never
+// makes a lookup miss.
+type Filter struct {
+	lister HashLister
+
+	mu     sync.RWMutex
+	blooms [4]*bloom
+	// Number of the latest store change included.
+	latest int64
+}
+
+// FilterMetrics count lookups that had to reach the store (hits) and
+// lookups the filter answered (misses). False positives reached the store
+// without finding anything, stale misses were answered by the filter but
+// turned out to be known.
+type FilterMetrics struct {
+	Hits           int64 `json:"hits"`
+	Misses         int64 `json:"misses"`
+	FalsePositives int64 `json:"falsePositives"`
+	StaleMisses    int64 `json:"staleMisses"`
+}
+
+func (m *FilterMetrics) Add(other FilterMetrics) {
+	m.Hits += other.Hits
+	m.Misses += other.Misses
+	m.FalsePositives += other.FalsePositives
+	m.StaleMisses += other.StaleMisses
+}
+
+type bloom struct {
+	Bits     []uint64
+	Capacity int64
+	Count    int64
+}
+
+type filterCache struct {
+	Format int
+	Latest int64
+	Blooms [4]*bloom
+}
+
+// LoadFilter reads the filter cached at cachePath, brings it up to date
+// with the changes of the store since it was saved and saves it again. It
+// builds the filter from every known hash when there is no usable cache,
+// or when the store outgrew it. Concurrent loads of the same cache wait
+// for each other.
+func LoadFilter(ctx context.Context, lister HashLister, cachePath string) (*Filter, error) {
+	if err := os.MkdirAll(filepath.Dir(cachePath), 0755); err != nil {
+		return nil, err
+	}
+	lock, err := os.OpenFile(cachePath+".lock", os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Close()
+	if err := syscall.Flock(int(lock.Fd()), syscall.LOCK_EX); err != nil {
+		return nil, fmt.Errorf("failed to lock %s: %v", cachePath, err)
+	}
+
+	f := &Filter{lister: lister}
+	if err := f.read(cachePath); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			fmt.Fprintf(os.Stderr, "rebuilding lookup filter: %v\n", err)
+		}
+		if err := f.Build(ctx); err != nil {
+			return nil, err
+		}
+	} else if err := f.Update(ctx); err != nil {
+		return nil, err
+	}
+	return f, f.write(cachePath)
+}
+
+// Build replaces the filters with ones holding every known hash, sized
+// with room for a quarter more.
+func (f *Filter) Build(ctx context.Context) error {
+	counts, err := f.lister.CountHashes(ctx)
+	if err != nil {
+		return err
+	}
+	var blooms [4]*bloom
+	for i, count := range counts {
+		blooms[i] = newBloom(count + count/4)
+	}
+	latest, err := f.lister.ListHashes(ctx, 0, func(h Hashes) error {
+		addBlooms(blooms, h)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to build lookup filter: %v", err)
+	}
+
+	f.mu.Lock()
+	f.blooms = blooms
+	f.latest = latest
+	f.mu.Unlock()
+	return nil
+}
+
+// Update adds the hashes of the files changed since the filter was built
+// or last updated, and rebuilds it once it holds more digests than it was
+// sized for.
+func (f *Filter) Update(ctx context.Context) error {
+	f.mu.RLock()
+	since := f.latest
+	f.mu.RUnlock()
+
+	latest, err := f.lister.ListHashes(ctx, since, func(h Hashes) error {
+		f.Add(h)
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to update lookup filter: %v", err)
+	}
+
+	f.mu.Lock()
+	f.latest = latest
+	full := false
+	for _, b := range f.blooms {
+		full = full || b.Count > b.Capacity
+	}
+	f.mu.Unlock()
+	if full {
+		return f.Build(ctx)
+	}
+	return nil
+}
+
+// MayContain reports whether any digest of h may be known. False means
+// none is. The filters only hold the digests with a files column, so
+// files with other exact digests may always be known.
+func (f *Filter) MayContain(h Hashes) bool {
+	digests, err := h.digests()
+	if err != nil {
+		// Let the store report the invalid hash.
+		return true
+	}
+	if _, exact, err := h.others(); err != nil || exact {
+		return true
+	}
+
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	for i, digest := range digests {
+		if digest != nil && f.blooms[i].has(digest.([]byte)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Add adds the digests of a file stored after the filter was loaded.
+func (f *Filter) Add(h Hashes) {
+	f.mu.Lock()
+	addBlooms(f.blooms, h)
+	f.mu.Unlock()
+}
+
+func (f *Filter) read(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var cache filterCache
+	if err := gob.NewDecoder(file).Decode(&cache); err != nil {
+		return fmt.Errorf("failed to read %s: %v", path, err)
+	}
+	if cache.Format != filterFormat {
+		return fmt.Errorf("%s has format %d, expected %d", path, cache.Format, filterFormat)
+	}
+	for _, b := range cache.Blooms {
+		if b == nil || len(b.Bits) == 0 {
+			return fmt.Errorf("%s is incomplete", path)
+		}
+	}
+	f.blooms = cache.Blooms
+	f.latest = cache.Latest
+	return nil
+}
+
+// write replaces the cache at path, so readers never see a partial file.
+func (f *Filter) write(path string) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	f.mu.RLock()
+	err = gob.NewEncoder(tmp).Encode(filterCache{Format: filterFormat, Latest: f.latest, Blooms: f.blooms})
+	f.mu.RUnlock()
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to save lookup filter: %v", err)
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+func newBloom(capacity int64) *bloom {
+	if capacity < 1024 {
+		capacity = 1024
+	}
+	words := (capacity*filterBitsPerDigest + 63) / 64
+	return &bloom{Bits: make([]uint64, words), Capacity: capacity}
+}
+
+func addBlooms(blooms [4]*bloom, h Hashes) {
+	digests, err := h.digests()
+	if err != nil {
+		return
+	}
+	for i, digest := range digests {
+		if digest != nil {
+			blooms[i].add(digest.([]byte))
+		}
+	}
+}
+
+// probes calls fn with every bit position of a digest until it returns
+// false. Digests are already
+// uniformly distributed, so their first 16 bytes are used as the two
+// hashes of double hashing.
+func (b *bloom) probes(digest []byte, fn func(bit uint64) bool) bool {
+	if len(digest) < 16 {
+		return false
+	}
+	size := uint64(len(b.Bits)) * 64
+	h1 := binary.LittleEndian.Uint64(digest[:8])
+	h2 := binary.LittleEndian.Uint64(digest[8:16]) | 1
+	for i := uint64(0); i < filterProbes; i++ {
+		if !fn((h1 + i*h2) % size) {
+			return false
+		}
+	}
+	return true
+}
+
+func (b *bloom) add(digest []byte) {
+	b.probes(digest, func(bit uint64) bool {
+		b.Bits[bit/64] |= 1 << (bit % 64)
+		return true
+	})
+	b.Count++
+}
+
+func (b *bloom) has(digest []byte) bool {
+	return b.probes(digest, func(bit uint64) bool {
+		return b.Bits[bit/64]&(1<<(bit%64)) != 0
+	})
+}
@@ -0,0 +1,532 @@
+package store
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"common/hashes"
+	"common/history"
+	"common/views"
+
+	"github.com/lib/pq"
+)
+
+// Postgres is the store on the files table. The database must be migrated
+// to the version the program was built for.
+type Postgres struct {
+	*postgresOps
+	db *sql.DB
+}
+
+type postgresTx struct {
+	*postgresOps
+	tx *sql.Tx
+}
+
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+type postgresOps struct {
+	q querier
+
+	// Upserts come in bulk from imports and scans, so the statement is
+	// prepared once.
+	mu     sync.Mutex
+	upsert *sql.Stmt
+}
+
+func NewPostgres(db *sql.DB) *Postgres {
+	return &Postgres{postgresOps: &postgresOps{q: db}, db: db}
+}
+
+func (p *Postgres) Begin(ctx context.Context) (Tx, error) {
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTx{postgresOps: &postgresOps{q: tx}, tx: tx}, nil
+}
+
+func (p *Postgres) Close() error {
+	if p.upsert != nil {
+		p.upsert.Close()
+	}
+	return p.db.Close()
+}
+
+// Refresh marks the materialized views as outdated and refreshes them,
+// unless they were refreshed within interval.
+func (p *Postgres) Refresh(ctx context.Context, interval time.Duration) ([]string, error) {
+	if err := views.Request(p.db); err != nil {
+		return nil, err
+	}
+	return views.RefreshPending(p.db, interval)
+}
+
+func (t *postgresTx) Commit() error {
+	return t.tx.Commit()
+}
+
+func (t *postgresTx) Rollback() error {
+	return t.tx.Rollback()
+}
+
+// matchLateral selects the id of every file matching one of the digests of
+// the row q.
+const matchLateral = `
+	SELECT id FROM files WHERE md5 = q.md5
+	UNION
+	SELECT id FROM files WHERE sha1 = q.sha1
+	UNION
+	SELECT id FROM files WHERE sha256 = q.sha256
+	UNION
+	SELECT id FROM files WHERE sha512 = q.sha512
+	UNION
+	SELECT file_id FROM file_digests WHERE algorithm = '` + hashes.BLAKE3 + `' AND digest = q.blake3`
+
+// OtherDigests selects the digests of files f without a files column, as
+// lines of algorithm and digest for ParseOtherDigests.
+const OtherDigests = `(SELECT string_agg(d.algorithm || ' ' || d.digest, E'\n' ORDER BY d.algorithm) FROM file_digests d WHERE d.file_id = f.id)`
+
+func (o *postgresOps) Lookup(ctx context.Context, h Hashes) ([]File, error) {
+	matches, err := o.BulkLookup(ctx, []Hashes{h})
+	if err != nil {
+		return nil, err
+	}
+	return matches[0], nil
+}
+
+func (o *postgresOps) BulkLookup(ctx context.Context, hs []Hashes) ([][]File, error) {
+	digests, blake3, err := digestArrays(hs)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := o.q.QueryContext(ctx, `
+		SELECT q.n, f.id, encode(f.md5, 'hex'), encode(f.sha1, 'hex'), encode(f.sha256, 'hex'), encode(f.sha512, 'hex'),
+			`+OtherDigests+`, f.filesize,
+			(SELECT string_agg(p.filepath, E'\n' ORDER BY p.added_at, p.filepath) FROM file_paths p WHERE p.file_id = f.id),
+			f.status, f.family, f.source, f.first_seen, f.threat_label
+		FROM unnest($1::BYTEA[], $2::BYTEA[], $3::BYTEA[], $4::BYTEA[], $5::TEXT[]) WITH ORDINALITY AS q(md5, sha1, sha256, sha512, blake3, n)
+		CROSS JOIN LATERAL (`+matchLateral+`) m
+		JOIN files f ON f.id = m.id
+		ORDER BY q.n, f.id;
+	`, digests[0], digests[1], digests[2], digests[3], blake3)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	matches := make([][]File, len(hs))
+	for rows.Next() {
+		var n int
+		var f File
+		var md5, sha1, sha256, sha512, others, paths, status, family, source, threatLabel sql.NullString
+		var size sql.NullInt64
+		var firstSeen sql.NullTime
+		err := rows.Scan(&n, &f.ID, &md5, &sha1, &sha256, &sha512, &others, &size, &paths, &status, &family, &source, &firstSeen, &threatLabel)
+		if err != nil {
+			return nil, fmt.Errorf("error checking query results: %v", err)
+		}
+		f.MD5 = md5.String
+		f.SHA1 = sha1.String
+		f.SHA256 = sha256.String
+		f.SHA512 = sha512.String
+		f.Other = ParseOtherDigests(others.String)
+		if size.Valid {
+			f.Size = &size.Int64
+		}
+		if paths.String != "" {
+			f.Paths = strings.Split(paths.String, "\n")
+		}
+		f.Status = status.String
+		f.Family = family.String
+		f.Source = source.String
+		if firstSeen.Valid {
+			f.FirstSeen = &firstSeen.Time
+		}
+		f.ThreatLabel = threatLabel.String
+		matches[n-1] = append(matches[n-1], f)
+	}
+	return matches, rows.Err()
+}
+
+// upsertQuery inserts a file unless one of its digests is known, fills in
+// what the first matching file is missing and adds the paths. A malicious
+// file makes the matching file malicious with its family, source and
+// threat label. Inserted and changed files are recorded in the status
+// history, which lookup filters follow. Files without an exact digest are
+// matched by their fuzzy digests instead. It returns the outcome, and
+// nothing when the known file was already complete.
+var upsertQuery = `
+	WITH existing AS (
+		SELECT id
+		FROM (` + hashes.MatchQuery(1) + `
+			UNION
+			SELECT file_id FROM file_digests WHERE algorithm = '` + hashes.BLAKE3 + `' AND digest = $15
+			UNION
+			SELECT d.file_id FROM file_digests d, unnest($16::TEXT[], $17::TEXT[]) o(algorithm, digest)
+			WHERE $18::BOOLEAN AND d.algorithm = o.algorithm AND d.digest = o.digest) matched
+		ORDER BY id
+		LIMIT 1
+	), inserted AS (
+		INSERT INTO files (md5, sha1, sha256, sha512, filesize, status, family, source, first_seen, threat_label)
+		SELECT $1::BYTEA, $2::BYTEA, $3::BYTEA, $4::BYTEA, $5::BIGINT, $7::VARCHAR,
+			NULLIF($8::VARCHAR, ''), NULLIF($9::VARCHAR, ''), COALESCE($10::TIMESTAMPTZ, now()), NULLIF($11::VARCHAR, '')
+		WHERE NOT EXISTS (SELECT 1 FROM existing)
+		ON CONFLICT DO NOTHING
+		RETURNING id, NULL::VARCHAR AS old_status, status AS new_status
+	), filled AS (
+		-- Digests stored with another file are not copied
+		SELECT f.id,
+			COALESCE(f.md5, (SELECT $1::BYTEA WHERE NOT EXISTS (SELECT 1 FROM files o WHERE o.md5 = $1))) AS md5,
+			COALESCE(f.sha1, (SELECT $2::BYTEA WHERE NOT EXISTS (SELECT 1 FROM files o WHERE o.sha1 = $2))) AS sha1,
+			COALESCE(f.sha256, (SELECT $3::BYTEA WHERE NOT EXISTS (SELECT 1 FROM files o WHERE o.sha256 = $3))) AS sha256,
+			COALESCE(f.sha512, (SELECT $4::BYTEA WHERE NOT EXISTS (SELECT 1 FROM files o WHERE o.sha512 = $4))) AS sha512,
+			COALESCE(f.filesize, $5::BIGINT) AS filesize,
+			f.status AS old_status,
+			-- Only malicious files change the status and the details of
+			-- known files, which keep the details of an earlier feed
+			-- once they are malicious
+			CASE WHEN $7 = 'malicious' THEN 'malicious' ELSE f.status END AS status,
+			CASE WHEN $7 <> 'malicious' THEN f.family
+				WHEN f.status IS DISTINCT FROM 'malicious' THEN COALESCE(NULLIF($8::VARCHAR, ''), f.family)
+				ELSE COALESCE(f.family, NULLIF($8::VARCHAR, '')) END AS family,
+			CASE WHEN $7 <> 'malicious' THEN f.source
+				WHEN f.status IS DISTINCT FROM 'malicious' THEN COALESCE(NULLIF($9::VARCHAR, ''), f.source)
+				ELSE COALESCE(f.source, NULLIF($9::VARCHAR, '')) END AS source,
+			CASE WHEN $7 <> 'malicious' THEN f.threat_label
+				WHEN f.status IS DISTINCT FROM 'malicious' THEN COALESCE(NULLIF($11::VARCHAR, ''), f.threat_label)
+				ELSE COALESCE(f.threat_label, NULLIF($11::VARCHAR, '')) END AS threat_label
+		FROM files f
+		JOIN existing e ON e.id = f.id
+	), backfilled AS (
+		UPDATE files f
+		SET md5 = filled.md5, sha1 = filled.sha1, sha256 = filled.sha256, sha512 = filled.sha512, filesize = filled.filesize,
+			status = filled.status, family = filled.family, source = filled.source, threat_label = filled.threat_label
+		FROM filled
+		WHERE f.id = filled.id
+			AND (f.md5, f.sha1, f.sha256, f.sha512, f.filesize, f.status, f.family, f.source, f.threat_label) IS DISTINCT FROM
+				(filled.md5, filled.sha1, filled.sha256, filled.sha512, filled.filesize,
+				filled.status, filled.family, filled.source, filled.threat_label)
+		RETURNING f.id, filled.old_status, f.status AS new_status
+	), paths AS (
+		INSERT INTO file_paths (file_id, filepath)
+		SELECT matched.id, path
+		FROM (SELECT id FROM existing UNION ALL SELECT id FROM inserted) matched, unnest($6::TEXT[]) path
+		ON CONFLICT DO NOTHING
+	), others AS (
+		-- Exact digests stored with another file are not copied
+		INSERT INTO file_digests (file_id, algorithm, digest)
+		SELECT matched.id, d.algorithm, d.digest
+		FROM (SELECT id FROM existing UNION ALL SELECT id FROM inserted) matched, unnest($16::TEXT[], $17::TEXT[]) d(algorithm, digest)
+		WHERE d.algorithm <> '` + hashes.BLAKE3 + `'
+			OR NOT EXISTS (SELECT 1 FROM file_digests o WHERE o.algorithm = d.algorithm AND o.digest = d.digest)
+		ON CONFLICT DO NOTHING
+		RETURNING file_id
+	), changed AS (
+		SELECT id, old_status, new_status FROM inserted
+		UNION ALL
+		SELECT id, old_status, new_status FROM backfilled
+	), recorded AS (` + history.InsertFrom("changed", 12, 13, 14) + `
+	)
+	SELECT 'inserted' FROM inserted
+	UNION ALL
+	SELECT CASE WHEN old_status IS DISTINCT FROM new_status THEN 'flagged' ELSE 'updated' END FROM backfilled
+	UNION ALL
+	SELECT 'updated' FROM others WHERE NOT EXISTS (SELECT 1 FROM inserted);
+`
+
+func (o *postgresOps) Upsert(ctx context.Context, f File, c Change) (Outcome, error) {
+	if !validStatus(f.Status) {
+		return Unchanged, ErrInvalidStatus
+	}
+	digests, err := f.Hashes().digests()
+	if err != nil {
+		return Unchanged, err
+	}
+	others, exact, err := f.Hashes().others()
+	if err != nil {
+		return Unchanged, err
+	}
+	for _, digest := range digests {
+		exact = exact || digest != nil
+	}
+	var algorithms, otherValues []string
+	for algorithm, digest := range others {
+		algorithms = append(algorithms, algorithm)
+		otherValues = append(otherValues, digest)
+	}
+
+	o.mu.Lock()
+	if o.upsert == nil {
+		o.upsert, err = o.q.PrepareContext(ctx, upsertQuery)
+	}
+	stmt := o.upsert
+	o.mu.Unlock()
+	if err != nil {
+		return Unchanged, fmt.Errorf("error preparing upsert: %v", err)
+	}
+
+	var size, firstSeen interface{}
+	if f.Size != nil {
+		size = *f.Size
+	}
+	if f.FirstSeen != nil {
+		firstSeen = *f.FirstSeen
+	}
+	var outcome string
+	err = stmt.QueryRowContext(ctx, digests[0], digests[1], digests[2], digests[3], size, pq.Array(f.Paths), f.Status,
+		f.Family, f.Source, firstSeen, f.ThreatLabel, c.Actor, c.Source, c.Reason,
+		others[hashes.BLAKE3], pq.Array(algorithms), pq.Array(otherValues), !exact).Scan(&outcome)
+	switch {
+	case err == sql.ErrNoRows:
+		return Unchanged, nil
+	case err != nil:
+		return Unchanged, fmt.Errorf("failed to store file: %v", err)
+	case outcome == "inserted":
+		return Inserted, nil
+	case outcome == "flagged":
+		return Flagged, nil
+	}
+	return Updated, nil
+}
+
+func (o *postgresOps) SetStatus(ctx context.Context, hash, status string, c Change) (int64, error) {
+	if !validStatus(status) {
+		return 0, ErrInvalidStatus
+	}
+	column, digest, err := hashes.Parse(hash)
+	if err != nil {
+		return 0, err
+	}
+
+	var known bool
+	err = o.q.QueryRowContext(ctx, fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM files WHERE %s = $1);`, column), digest).Scan(&known)
+	if err != nil {
+		return 0, fmt.Errorf("error executing query: %v", err)
+	}
+	if !known {
+		return 0, ErrNotFound
+	}
+
+	result, err := o.q.ExecContext(ctx, fmt.Sprintf(`
+		WITH changed AS (
+			UPDATE files
+			SET status = $1
+			FROM (SELECT id, status FROM files WHERE %s = $2 AND status <> $1) old
+			WHERE files.id = old.id
+			RETURNING files.id, old.status AS old_status, files.status AS new_status
+		)`, column)+history.InsertFrom("changed", 3, 4, 5)+";",
+		status, digest, c.Actor, c.Source, c.Reason)
+	if err != nil {
+		return 0, fmt.Errorf("error updating entry: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+func (o *postgresOps) Stats(ctx context.Context) (map[string]int64, error) {
+	rows, err := o.q.QueryContext(ctx, `
+		SELECT COALESCE(status, ''), COUNT(*)
+		FROM files
+		GROUP BY status;
+	`)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int64)
+	for rows.Next() {
+		var status string
+		var count int64
+		if err := rows.Scan(&status, &count); err != nil {
+			return nil, fmt.Errorf("error checking query results: %v", err)
+		}
+		counts[status] = count
+	}
+	return counts, rows.Err()
+}
+
+// RecordSightings stores where candidate and malicious files were found,
+// and the malicious files they were similar to. Sightings of unknown files
+// are ignored.
+func (p *Postgres) RecordSightings(ctx context.Context, sightings []Sighting) error {
+	hs := make([]Hashes, len(sightings))
+	var paths, hosts, scans []string
+	var similar []sql.NullInt64
+	for i, s := range sightings {
+		hs[i] = s.Hashes
+		paths = append(paths, s.Path)
+		hosts = append(hosts, s.Host)
+		scans = append(scans, s.ScanID)
+		similar = append(similar, sql.NullInt64{Int64: s.SimilarTo, Valid: s.SimilarTo != 0})
+	}
+	digests, blake3, err := digestArrays(hs)
+	if err != nil {
+		return err
+	}
+
+	_, err = p.db.ExecContext(ctx, `
+		INSERT INTO file_sightings (file_id, filepath, host, scan_id, similar_to)
+		SELECT m.id, q.filepath, q.host, q.scan_id, q.similar_to
+		FROM unnest($1::BYTEA[], $2::BYTEA[], $3::BYTEA[], $4::BYTEA[], $5::TEXT[], $6::TEXT[], $7::TEXT[], $8::TEXT[], $9::INTEGER[])
+			AS q(md5, sha1, sha256, sha512, blake3, filepath, host, scan_id, similar_to)
+		CROSS JOIN LATERAL (`+matchLateral+`) m
+		ON CONFLICT (file_id, filepath, host, scan_id) DO UPDATE
+		SET similar_to = COALESCE(EXCLUDED.similar_to, file_sightings.similar_to);
+	`, digests[0], digests[1], digests[2], digests[3], blake3, pq.Array(paths), pq.Array(hosts), pq.Array(scans), pq.Array(similar))
+	if err != nil {
+		return fmt.Errorf("failed to record sightings: %v", err)
+	}
+	return nil
+}
+
+func (p *Postgres) CountHashes(ctx context.Context) ([4]int64, error) {
+	var counts [4]int64
+	err := p.db.QueryRowContext(ctx, `SELECT COUNT(md5), COUNT(sha1), COUNT(sha256), COUNT(sha512) FROM files;`).
+		Scan(&counts[0], &counts[1], &counts[2], &counts[3])
+	if err != nil {
+		return counts, fmt.Errorf("error executing query: %v", err)
+	}
+	return counts, nil
+}
+
+// ListHashes follows the status history, which records every inserted,
+// backfilled and changed file.
+func (p *Postgres) ListHashes(ctx context.Context, since int64, fn func(Hashes) error) (int64, error) {
+	var latest int64
+	err := p.db.QueryRowContext(ctx, `SELECT COALESCE(MAX(id), 0) FROM file_status_history;`).Scan(&latest)
+	if err != nil {
+		return since, fmt.Errorf("error executing query: %v", err)
+	}
+
+	query := `
+		SELECT encode(md5, 'hex'), encode(sha1, 'hex'), encode(sha256, 'hex'), encode(sha512, 'hex')
+		FROM files
+		WHERE merged_into IS NULL;`
+	args := []interface{}{}
+	if since > 0 {
+		if latest <= since {
+			return since, nil
+		}
+		query = `
+			SELECT encode(f.md5, 'hex'), encode(f.sha1, 'hex'), encode(f.sha256, 'hex'), encode(f.sha512, 'hex')
+			FROM files f
+			WHERE f.id IN (SELECT file_id FROM file_status_history WHERE id > $1 AND id <= $2);`
+		args = append(args, since, latest)
+	}
+	rows, err := p.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return since, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var md5, sha1, sha256, sha512 sql.NullString
+		if err := rows.Scan(&md5, &sha1, &sha256, &sha512); err != nil {
+			return since, fmt.Errorf("error checking query results: %v", err)
+		}
+		if err := fn(Hashes{MD5: md5.String, SHA1: sha1.String, SHA256: sha256.String, SHA512: sha512.String}); err != nil {
+			return since, err
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return since, err
+	}
+	return latest, nil
+}
+
+// ListFuzzy selects the files of status with a fuzzy digest, with their
+// first path.
+func (p *Postgres) ListFuzzy(ctx context.Context, status string, fn func(File) error) error {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT f.id, encode(f.md5, 'hex'), encode(f.sha1, 'hex'), encode(f.sha256, 'hex'), encode(f.sha512, 'hex'),
+			`+OtherDigests+`,
+			(SELECT p.filepath FROM file_paths p WHERE p.file_id = f.id ORDER BY p.added_at, p.filepath LIMIT 1),
+			f.family, f.source, f.threat_label
+		FROM files f
+		WHERE f.status = $1 AND f.merged_into IS NULL
+			AND EXISTS (SELECT 1 FROM file_digests d WHERE d.file_id = f.id AND d.algorithm IN ('`+hashes.SSDEEP+`', '`+hashes.TLSH+`'))
+		ORDER BY f.id;
+	`, status)
+	if err != nil {
+		return fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		f := File{Status: status}
+		var md5, sha1, sha256, sha512, others, path, family, source, threatLabel sql.NullString
+		err := rows.Scan(&f.ID, &md5, &sha1, &sha256, &sha512, &others, &path, &family, &source, &threatLabel)
+		if err != nil {
+			return fmt.Errorf("error checking query results: %v", err)
+		}
+		f.MD5 = md5.String
+		f.SHA1 = sha1.String
+		f.SHA256 = sha256.String
+		f.SHA512 = sha512.String
+		f.Other = ParseOtherDigests(others.String)
+		if path.Valid {
+			f.Paths = []string{path.String}
+		}
+		f.Family = family.String
+		f.Source = source.String
+		f.ThreatLabel = threatLabel.String
+		if err := fn(f); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// digestArrays returns the MD5, SHA1, SHA256 and SHA512 digests of hs as
+// bytea array arguments, and the BLAKE3 digests as a text array. Missing
+// digests are empty and match nothing.
+func digestArrays(hs []Hashes) ([4]pq.ByteaArray, pq.StringArray, error) {
+	var arrays [4]pq.ByteaArray
+	for i := range arrays {
+		arrays[i] = make(pq.ByteaArray, len(hs))
+	}
+	blake3 := make(pq.StringArray, len(hs))
+	for n, h := range hs {
+		digests, err := h.digests()
+		if err != nil {
+			return arrays, blake3, err
+		}
+		for i, d := range digests {
+			if d != nil {
+				arrays[i][n] = d.([]byte)
+			}
+		}
+		others, _, err := h.others()
+		if err != nil {
+			return arrays, blake3, err
+		}
+		blake3[n] = others[hashes.BLAKE3]
+	}
+	return arrays, blake3, nil
+}
+
+// ParseOtherDigests parses the digests selected as lines of algorithm and
+// digest.
+func ParseOtherDigests(lines string) map[string]string {
+	if lines == "" {
+		return nil
+	}
+	others := make(map[string]string)
+	for _, line := range strings.Split(lines, "\n") {
+		if algorithm, digest, ok := strings.Cut(line, " "); ok {
+			others[algorithm] = digest
+		}
+	}
+	return others
+}
@@ -0,0 +1,306 @@
+// Package store keeps the known file hashes and their status. Programs
+// depend on the KnownHashStore interface, which is implemented on the
+// PostgreSQL files table for the full system and on a local bbolt file for
+// single-box deployments and air-gapped labs.
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"common/hashes"
+)
+
+// Backends selected with KNOWN_HASH_STORE.
+const (
+	BackendPostgres = "postgres"
+	BackendBolt     = "bolt"
+)
+
+var (
+	ErrNotFound      = errors.New("hash is not known")
+	ErrInvalidStatus = errors.New("status must be verified, candidate or malicious")
+	// ErrUnsupported is returned by programs for commands that need the
+	// PostgreSQL store.
+	ErrUnsupported = errors.New("only supported by the postgres store")
+	// ErrReadOnly is returned by changes to stores that can only be read,
+	// like snapshots.
+	ErrReadOnly = errors.New("the known hash store is read-only")
+)
+
+var statuses = []string{"verified", "candidate", "malicious"}
+
+// File is a known file. Digests are lowercase hex.
+type File struct {
+	ID          int64
+	MD5         string
+	SHA1        string
+	SHA256      string
+	SHA512      string
+	Other       map[string]string
+	Size        *int64
+	Paths       []string
+	Status      string
+	Family      string
+	Source      string
+	FirstSeen   *time.Time
+	ThreatLabel string
+}
+
+func (f File) Hashes() Hashes {
+	return Hashes{MD5: f.MD5, SHA1: f.SHA1, SHA256: f.SHA256, SHA512: f.SHA512, Other: f.Other}
+}
+
+// SetHashes replaces the digests of f with h.
+func (f *File) SetHashes(h Hashes) {
+	f.MD5, f.SHA1, f.SHA256, f.SHA512, f.Other = h.MD5, h.SHA1, h.SHA256, h.SHA512, h.Other
+}
+
+// Hashes are the hex digests a file is looked up by. Any of them may be
+// empty. Other holds the digests of the algorithms without a files column
+// by algorithm; files are looked up by the exact ones, the fuzzy ones are
+// only stored.
+type Hashes struct {
+	MD5    string
+	SHA1   string
+	SHA256 string
+	SHA512 string
+	Other  map[string]string
+}
+
+// HashesOf returns the Hashes of digests by algorithm, as scan requests
+// hold them. Empty digests are left out.
+func HashesOf(digests map[string]string) (Hashes, error) {
+	var h Hashes
+	for algorithm, digest := range digests {
+		if digest == "" {
+			continue
+		}
+		normalized, err := hashes.Normalize(algorithm, digest)
+		if err != nil {
+			return Hashes{}, err
+		}
+		switch algorithm {
+		case hashes.MD5:
+			h.MD5 = normalized
+		case hashes.SHA1:
+			h.SHA1 = normalized
+		case hashes.SHA256:
+			h.SHA256 = normalized
+		case hashes.SHA512:
+			h.SHA512 = normalized
+		default:
+			if h.Other == nil {
+				h.Other = make(map[string]string)
+			}
+			h.Other[algorithm] = normalized
+		}
+	}
+	return h, nil
+}
+
+// Map returns the digests of h by algorithm.
+func (h Hashes) Map() map[string]string {
+	digests := make(map[string]string)
+	for algorithm, digest := range map[string]string{hashes.MD5: h.MD5, hashes.SHA1: h.SHA1, hashes.SHA256: h.SHA256, hashes.SHA512: h.SHA512} {
+		if digest != "" {
+			digests[algorithm] = digest
+		}
+	}
+	for algorithm, digest := range h.Other {
+		if digest != "" {
+			digests[algorithm] = digest
+		}
+	}
+	return digests
+}
+
+// Validate reports whether files can be looked up by h, which needs a
+// valid digest that is not fuzzy.
+func (h Hashes) Validate() error {
+	if _, err := h.digests(); err != nil {
+		return err
+	}
+	_, exact, err := h.others()
+	if err != nil {
+		return err
+	}
+	if !exact && h.MD5 == "" && h.SHA1 == "" && h.SHA256 == "" && h.SHA512 == "" {
+		return errors.New("no digest to look up the file by")
+	}
+	return nil
+}
+
+// ParseHash returns Hashes holding a single hex digest of any algorithm.
+func ParseHash(hash string) (Hashes, error) {
+	column, err := hashes.Column(hash)
+	if err != nil {
+		return Hashes{}, err
+	}
+	var h Hashes
+	switch column {
+	case "md5":
+		h.MD5 = hash
+	case "sha1":
+		h.SHA1 = hash
+	case "sha256":
+		h.SHA256 = hash
+	case "sha512":
+		h.SHA512 = hash
+	}
+	return h, nil
+}
+
+func (h Hashes) digests() ([]interface{}, error) {
+	return hashes.Digests(h.MD5, h.SHA1, h.SHA256, h.SHA512)
+}
+
+// others returns the digests of Other normalized, and whether files can be
+// looked up by any of them.
+func (h Hashes) others() (map[string]string, bool, error) {
+	others := make(map[string]string)
+	exact := false
+	for algorithm, digest := range h.Other {
+		if digest == "" {
+			continue
+		}
+		normalized, err := hashes.Normalize(algorithm, digest)
+		if err != nil {
+			return nil, false, err
+		}
+		others[algorithm] = normalized
+		exact = exact || !hashes.Fuzzy(algorithm)
+	}
+	return others, exact, nil
+}
+
+// Change names who made a change, where it came from and why, for the
+// status history.
+type Change struct {
+	Actor  string
+	Source string
+	Reason string
+}
+
+// Outcome of an Upsert.
+type Outcome int
+
+const (
+	Unchanged Outcome = iota
+	Inserted
+	// Missing digests or the size of a known file were filled in.
+	Updated
+	// A known file that was not malicious was made malicious.
+	Flagged
+)
+
+// Operations are shared by stores and their transactions.
+type Operations interface {
+	// Lookup returns the files matching any digest of h, ordered by ID.
+	Lookup(ctx context.Context, h Hashes) ([]File, error)
+	// BulkLookup returns the matches of every element of hs, in order.
+	BulkLookup(ctx context.Context, hs []Hashes) ([][]File, error)
+	// Upsert stores f when none of its digests is known. Otherwise the
+	// first matching file gets the digests and size it is missing, and the
+	// paths of f. A malicious f makes it malicious with the family, source
+	// and threat label of f, or fills in those it is missing when it
+	// already was; other statuses leave its status and details unchanged.
+	Upsert(ctx context.Context, f File, c Change) (Outcome, error)
+	// SetStatus changes the status of the files matching hash and returns
+	// how many changed, or ErrNotFound when none match.
+	SetStatus(ctx context.Context, hash, status string, c Change) (int64, error)
+	// Stats returns the number of files per status.
+	Stats(ctx context.Context) (map[string]int64, error)
+}
+
+type KnownHashStore interface {
+	Operations
+	// Begin starts a transaction whose changes are only visible once it is
+	// committed.
+	Begin(ctx context.Context) (Tx, error)
+	Close() error
+}
+
+type Tx interface {
+	Operations
+	Commit() error
+	Rollback() error
+}
+
+// Sighting is a file found on a host during a scan.
+type Sighting struct {
+	Hashes Hashes
+	Path   string
+	Host   string
+	ScanID string
+	// ID of the known malicious file the sighted file is similar to, or 0.
+	SimilarTo int64
+}
+
+// SightingRecorder is implemented by stores that remember where files were
+// found, for promotions and triage.
+type SightingRecorder interface {
+	RecordSightings(ctx context.Context, sightings []Sighting) error
+}
+
+// Refresher is implemented by stores that keep data derived from the files,
+// like the PostgreSQL materialized views, which has to be refreshed after
+// changes. Refresh does so at most once per interval and returns the names
+// of what it refreshed.
+type Refresher interface {
+	Refresh(ctx context.Context, interval time.Duration) ([]string, error)
+}
+
+// HashLister is implemented by stores that can feed a lookup Filter.
+type HashLister interface {
+	// CountHashes returns the number of stored MD5, SHA1, SHA256 and SHA512
+	// digests.
+	CountHashes(ctx context.Context) ([4]int64, error)
+	// ListHashes calls fn with the hashes of every file, or when since is
+	// not 0 of the files changed after the change numbered since, and
+	// returns the number of the latest change.
+	ListHashes(ctx context.Context, since int64, fn func(Hashes) error) (int64, error)
+}
+
+// FuzzyLister is implemented by stores that can list the files with fuzzy
+// digests, for similarity matching.
+type FuzzyLister interface {
+	// ListFuzzy calls fn with every file of status that has a fuzzy
+	// digest, ordered by ID.
+	ListFuzzy(ctx context.Context, status string, fn func(File) error) error
+}
+
+// Config selects the store from KNOWN_HASH_STORE, postgres by default, and
+// KNOWN_HASH_STORE_PATH, the file of the bolt store.
+type Config struct {
+	Backend string
+	Path    string
+}
+
+func ConfigFromEnv() (Config, error) {
+	cfg := Config{Backend: os.Getenv("KNOWN_HASH_STORE"), Path: os.Getenv("KNOWN_HASH_STORE_PATH")}
+	switch cfg.Backend {
+	case "":
+		cfg.Backend = BackendPostgres
+	case BackendPostgres:
+	case BackendBolt:
+		if cfg.Path == "" {
+			return cfg, fmt.Errorf("KNOWN_HASH_STORE_PATH must be set for the bolt store")
+		}
+	default:
+		return cfg, fmt.Errorf("unknown KNOWN_HASH_STORE %q, expected postgres or bolt", cfg.Backend)
+	}
+	return cfg, nil
+}
+
+func validStatus(status string) bool {
+	for _, s := range statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,214 @@
+// Package triage lists candidate files awaiting review and records the
+// decisions reviewers make about them.
+package triage
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"common/hashes"
+	"common/history"
+)
+
+// Number of known and of sighted paths returned with every candidate.
+const maxPaths = 10
+
+var ErrInvalidDecision = errors.New("invalid decision")
+
+type Candidate struct {
+	ID     int64  `json:"id"`
+	MD5    string `json:"MD5"`
+	SHA1   string `json:"SHA1"`
+	SHA256 string `json:"SHA256"`
+	SHA512 string `json:"SHA512"`
+	Size   *int64 `json:"size,omitempty"`
+	// Paths the file is known under, from imports and the first scan that
+	// found it.
+	KnownPaths []string `json:"knownPaths"`
+	Hosts      int      `json:"hosts"`
+	Scans      int      `json:"scans"`
+	// Paths the file was sighted at.
+	Paths    []string   `json:"paths"`
+	LastSeen *time.Time `json:"lastSeen,omitempty"`
+}
+
+type Filter struct {
+	Prefix string
+	ScanID string
+	Limit  int
+}
+
+type Decision struct {
+	Status   string `json:"status"`
+	Reviewer string `json:"reviewer"`
+	Comment  string `json:"comment"`
+}
+
+func (d Decision) validate() error {
+	if d.Status != "verified" && d.Status != "malicious" {
+		return fmt.Errorf("%w: status must be verified or malicious", ErrInvalidDecision)
+	}
+	if strings.TrimSpace(d.Reviewer) == "" {
+		return fmt.Errorf("%w: reviewer is required", ErrInvalidDecision)
+	}
+	return nil
+}
+
+type querier interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// ListCandidates returns candidates ordered by the number of hosts they were
+// found on. With a prefix or scan ID only candidates sighted under that
+// prefix or in that scan are returned.
+func ListCandidates(db querier, filter Filter) ([]Candidate, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = 100
+	}
+	prefix, pattern := prefixPattern(filter.Prefix)
+
+	rows, err := db.Query(`
+		SELECT f.id, COALESCE(encode(f.md5, 'hex'), ''), COALESCE(encode(f.sha1, 'hex'), ''),
+			COALESCE(encode(f.sha256, 'hex'), ''), COALESCE(encode(f.sha512, 'hex'), ''), f.filesize,
+			COALESCE((SELECT string_agg(k.filepath, E'\n' ORDER BY k.added_at, k.filepath) FROM file_paths k WHERE k.file_id = f.id), ''),
+			COUNT(DISTINCT s.host), COUNT(DISTINCT s.scan_id),
+			COALESCE(string_agg(DISTINCT s.filepath, E'\n'), ''), MAX(s.seen_at)
+		FROM files f
+		LEFT JOIN file_sightings s ON s.file_id = f.id
+		WHERE f.status = 'candidate' AND (($1 = '' AND $3 = '') OR EXISTS (
+			SELECT 1
+			FROM file_sightings p
+			WHERE p.file_id = f.id
+				AND ($1 = '' OR p.filepath = $1 OR p.filepath LIKE $2 ESCAPE '\')
+				AND ($3 = '' OR p.scan_id = $3)
+		))
+		GROUP BY f.id
+		ORDER BY COUNT(DISTINCT s.host) DESC, f.id
+		LIMIT $4;
+	`, prefix, pattern, filter.ScanID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	candidates := []Candidate{}
+	for rows.Next() {
+		var c Candidate
+		var size sql.NullInt64
+		var knownPaths, paths string
+		var lastSeen sql.NullTime
+		err := rows.Scan(&c.ID, &c.MD5, &c.SHA1, &c.SHA256, &c.SHA512, &size, &knownPaths,
+			&c.Hosts, &c.Scans, &paths, &lastSeen)
+		if err != nil {
+			return nil, fmt.Errorf("error checking query results: %v", err)
+		}
+		if size.Valid {
+			c.Size = &size.Int64
+		}
+		c.KnownPaths = splitPaths(knownPaths)
+		c.Paths = splitPaths(paths)
+		if lastSeen.Valid {
+			c.LastSeen = &lastSeen.Time
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// Decide sets the status of every file matching hash and records the
+// decision. It returns the number of files whose status changed.
+func Decide(tx *sql.Tx, hash string, d Decision) (int64, error) {
+	if err := d.validate(); err != nil {
+		return 0, err
+	}
+	column, digest, err := hashes.Parse(hash)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %v", ErrInvalidDecision, err)
+	}
+
+	return recordDecision(tx, fmt.Sprintf(`
+		SELECT id, status
+		FROM files
+		WHERE %s = $1 AND status <> $2
+		FOR UPDATE
+	`, column), d, "", "", digest, d.Status)
+}
+
+// DecidePrefix applies a decision to every candidate sighted under prefix
+// in the given scan.
+func DecidePrefix(tx *sql.Tx, prefix, scanID string, d Decision) (int64, error) {
+	if err := d.validate(); err != nil {
+		return 0, err
+	}
+	if prefix == "" || scanID == "" {
+		return 0, fmt.Errorf("%w: path prefix and scan ID are required", ErrInvalidDecision)
+	}
+	prefix, pattern := prefixPattern(prefix)
+
+	return recordDecision(tx, `
+		SELECT id, status
+		FROM files
+		WHERE status = 'candidate' AND id IN (
+			SELECT file_id
+			FROM file_sightings
+			WHERE scan_id = $1 AND (filepath = $2 OR filepath LIKE $3 ESCAPE '\')
+		)
+		FOR UPDATE
+	`, d, scanID, prefix, scanID, prefix, pattern)
+}
+
+// recordDecision updates the files selected by selection, whose arguments
+// are args, and writes one triage_decisions and one file_status_history row
+// per changed file.
+func recordDecision(tx *sql.Tx, selection string, d Decision, scanID, prefix string, args ...interface{}) (int64, error) {
+	n := len(args)
+	query := fmt.Sprintf(`
+		WITH changed AS (
+			UPDATE files
+			SET status = $%[2]d
+			FROM (%[1]s) old
+			WHERE files.id = old.id
+			RETURNING files.id, old.status AS old_status, files.status AS new_status
+		), decided AS (
+			INSERT INTO triage_decisions (file_id, old_status, new_status, reviewer, comment, scan_id, path_prefix)
+			SELECT id, old_status, new_status, $%[3]d, NULLIF($%[4]d, ''), NULLIF($%[5]d, ''), NULLIF($%[6]d, '')
+			FROM changed
+		)
+		%[7]s;
+	`, selection, n+1, n+2, n+3, n+4, n+5, history.InsertFrom("changed", n+2, n+6, n+3))
+	args = append(args, d.Status, d.Reviewer, d.Comment, scanID, prefix, history.Manual)
+
+	result, err := tx.Exec(query, args...)
+	if err != nil {
+		return 0, fmt.Errorf("error recording decision: %v", err)
+	}
+	return result.RowsAffected()
+}
+
+// splitPaths splits paths aggregated with newlines, keeping at most
+// maxPaths of them.
+func splitPaths(paths string) []string {
+	if paths == "" {
+		return []string{}
+	}
+	split := strings.Split(paths, "\n")
+	if len(split) > maxPaths {
+		split = split[:maxPaths]
+	}
+	return split
+}
+
+// prefixPattern returns the cleaned prefix and a LIKE pattern matching
+// every path below it.
+func prefixPattern(prefix string) (string, string) {
+	if prefix == "" {
+		return "", ""
+	}
+	prefix = strings.TrimSuffix(prefix, "/")
+	escaped := strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(prefix)
+	return prefix, escaped + "/%"
+}
@@ -0,0 +1,186 @@
+// Package views keeps the verified, candidates and malicious materialized
+// views up to date. Writers mark the views as outdated with Request, and
+// RefreshPending refreshes them at most once per interval, so a burst of
+// imports or scan batches costs a single refresh.
+package views
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Names of the materialized views over the files table.
+var Names = []string{"verified", "candidates", "malicious"}
+
+// Minimum time between two refreshes when VIEW_REFRESH_INTERVAL is not set.
+const DefaultInterval = time.Minute
+
+// Key of the advisory lock that keeps two processes from refreshing at once.
+const refreshLock = 0x73797363
+
+type Freshness struct {
+	View        string
+	Rows        int64
+	RequestedAt *time.Time
+	RefreshedAt *time.Time
+	// Number of status history entries written since the last refresh.
+	Changes int64
+}
+
+func (f Freshness) Stale() bool {
+	return f.Changes > 0 || f.Pending()
+}
+
+func (f Freshness) Pending() bool {
+	return f.RequestedAt != nil && (f.RefreshedAt == nil || f.RequestedAt.After(*f.RefreshedAt))
+}
+
+type execer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// Interval reads the minimum time between refreshes from
+// VIEW_REFRESH_INTERVAL.
+func Interval() (time.Duration, error) {
+	value := os.Getenv("VIEW_REFRESH_INTERVAL")
+	if value == "" {
+		return DefaultInterval, nil
+	}
+	interval, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid VIEW_REFRESH_INTERVAL %q: %v", value, err)
+	}
+	return interval, nil
+}
+
+// Request marks every view as outdated. Call it after committing changes to
+// the files table.
+func Request(db execer) error {
+	_, err := db.Exec(`
+		UPDATE view_refreshes
+		SET requested_at = now()
+		WHERE requested_at IS NULL OR requested_at <= refreshed_at;
+	`)
+	if err != nil {
+		return fmt.Errorf("failed to request view refresh: %v", err)
+	}
+	return nil
+}
+
+// RefreshPending concurrently refreshes the views marked as outdated that
+// were not refreshed within interval. It returns the views it refreshed,
+// and nothing when another process is already refreshing them.
+func RefreshPending(db *sql.DB, interval time.Duration) ([]string, error) {
+	return refresh(db, false, interval)
+}
+
+// RefreshAll concurrently refreshes every view, whether it is outdated or
+// not.
+func RefreshAll(db *sql.DB) ([]string, error) {
+	return refresh(db, true, 0)
+}
+
+func refresh(db *sql.DB, all bool, interval time.Duration) ([]string, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var locked bool
+	if err := tx.QueryRow(`SELECT pg_try_advisory_xact_lock($1);`, refreshLock).Scan(&locked); err != nil {
+		return nil, fmt.Errorf("failed to lock view refresh: %v", err)
+	}
+	if !locked {
+		return nil, nil
+	}
+
+	pending := Names
+	if !all {
+		pending, err = pendingViews(tx, interval)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, view := range pending {
+		if _, err := tx.Exec("REFRESH MATERIALIZED VIEW CONCURRENTLY " + view); err != nil {
+			return nil, fmt.Errorf("error refreshing %s: %v", view, err)
+		}
+		// now() is the start of this transaction, so changes requested while
+		// the view was refreshing stay pending.
+		_, err := tx.Exec(`
+			INSERT INTO view_refreshes (view_name, refreshed_at)
+			VALUES ($1, now())
+			ON CONFLICT (view_name) DO UPDATE SET refreshed_at = EXCLUDED.refreshed_at;
+		`, view)
+		if err != nil {
+			return nil, fmt.Errorf("error recording refresh of %s: %v", view, err)
+		}
+	}
+	return pending, tx.Commit()
+}
+
+func pendingViews(tx *sql.Tx, interval time.Duration) ([]string, error) {
+	rows, err := tx.Query(`
+		SELECT view_name
+		FROM view_refreshes
+		WHERE requested_at IS NOT NULL
+			AND (refreshed_at IS NULL OR (requested_at > refreshed_at AND refreshed_at <= now() - $1 * INTERVAL '1 second'))
+		ORDER BY view_name;
+	`, interval.Seconds())
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	var pending []string
+	for rows.Next() {
+		var view string
+		if err := rows.Scan(&view); err != nil {
+			return nil, fmt.Errorf("error checking query results: %v", err)
+		}
+		if known(view) {
+			pending = append(pending, view)
+		}
+	}
+	return pending, rows.Err()
+}
+
+// Status reports when every view was last refreshed and how many changes
+// it is missing.
+func Status(db *sql.DB) ([]Freshness, error) {
+	var status []Freshness
+	for _, view := range Names {
+		f := Freshness{View: view}
+		var requestedAt, refreshedAt sql.NullTime
+		err := db.QueryRow(fmt.Sprintf(`
+			SELECT (SELECT COUNT(*) FROM %s), r.requested_at, r.refreshed_at,
+				(SELECT COUNT(*) FROM file_status_history h WHERE r.refreshed_at IS NULL OR h.changed_at > r.refreshed_at)
+			FROM (SELECT $1::text AS view_name) v
+			LEFT JOIN view_refreshes r ON r.view_name = v.view_name;
+		`, view), view).Scan(&f.Rows, &requestedAt, &refreshedAt, &f.Changes)
+		if err != nil {
+			return nil, fmt.Errorf("error checking %s: %v", view, err)
+		}
+		if requestedAt.Valid {
+			f.RequestedAt = &requestedAt.Time
+		}
+		if refreshedAt.Valid {
+			f.RefreshedAt = &refreshedAt.Time
+		}
+		status = append(status, f)
+	}
+	return status, nil
+}
+
+func known(view string) bool {
+	for _, name := range Names {
+		if name == view {
+			return true
+		}
+	}
+	return false
+}
@@ -11,6 +11,35 @@ import datetime
 import threading
 import requests
 import netifaces
+import uuid
+import subprocess
+import time
+import random
+import re
+import fnmatch
+import io
+import zipfile
+import tarfile
+import gzip
+import bz2
+import lzma
+import tempfile
+import collections
+
+# Modules for the hash algorithms hashlib lacks, needed only when they are
+# selected
+try:
+    import blake3
+except ImportError:
+    blake3 = None
+try:
+    import ssdeep
+except ImportError:
+    ssdeep = None
+try:
+    import tlsh
+except ImportError:
+    tlsh = None
 
 def get_local_ipv4_address():
     try:
@@ -29,90 +58,221 @@ def get_local_ipv4_address():
         return None
 
 
-def search_files(starting_directory, depth=0, depth_limit=4):
-    if depth > depth_limit:
-        return []
-
-    found_files = []
-    excluded_extensions = ['.zip', '.rar', '.tar', '.gz', '.7z', '.bz2', '.xz', '.tar.gz', '.tar.bz2', '.tar.xz', '.tar.7z']
-    for root, dirs, files in os.walk(starting_directory):
-        for file in files:
-            file_path = os.path.join(root, file)
-            file_extension = os.path.splitext(file_path)[1].lower()
-
-            if file_extension not in excluded_extensions:
-                found_files.append(file_path)
-
-        if depth < depth_limit:
-            for dir in dirs:
-                found_files.extend(search_files(os.path.join(root, dir), depth + 1))
-
-        break
-
-    return found_files
-
-
-def search_directories(starting_directory, depth=0, depth_limit=4):
-    if depth > depth_limit:
-        return []
-
-    found_directories = []
-
-    for root, dirs, _ in os.walk(starting_directory):
-        for dir in dirs:
-            found_directories.append(os.path.join(root, dir))
-
-            if depth < depth_limit:
-                found_directories.extend(search_directories(os.path.join(root, dir), depth + 1))
-
-        break
-
-    return found_directories
-
-def get_file_paths(directory):
-    file_paths = []
-    excluded_extensions = ['.tar', '.zip', '.rar', '.gz']
-
-    def search_files(curr_dir):
-        for root, dirs, files in os.walk(curr_dir):
-            for file in files:
-                file_path = os.path.join(root, file)
-                file_extension = os.path.splitext(file_path)[1].lower()
-
-                if file_extension not in excluded_extensions:
-                    file_paths.append(file_path)
-
-            for dir in dirs:
-                next_dir = os.path.join(root, dir)
-                search_files(next_dir)
-
-    search_files(directory)
+# Rules used for the keys a rule file leaves out
+default_rules = {
+    'include': [],
+    'exclude': [],
+    'includeRegex': [],
+    'excludeRegex': [],
+    'excludeFilesystems': [
+        'proc', 'sysfs', 'devtmpfs', 'devpts', 'tmpfs', 'cgroup', 'cgroup2', 'debugfs', 'tracefs',
+        'securityfs', 'pstore', 'bpf', 'configfs', 'fusectl', 'mqueue', 'hugetlbfs', 'autofs',
+        'binfmt_misc', 'efivarfs', 'nfs', 'nfs4', 'cifs', 'smb3', 'fuse.sshfs'
+    ],
+    'oneFilesystem': False,
+    'maxFileSize': None,
+    'symlinks': 'file',
+    'archives': False,
+    'archiveDepth': 3,
+    'archiveMaxSize': 1 << 30,
+    'archiveMemberMaxSize': 256 << 20,
+    'archiveTotalSize': 4 << 30,
+    'archiveMaxMembers': 100000
+}
+
+class ScanRules:
+    def __init__(self, rules):
+        unknown = set(rules) - set(default_rules)
+        if len(unknown) > 0:
+            raise ValueError('unknown rules: ' + ', '.join(sorted(unknown)))
+        merged = dict(default_rules)
+        merged.update(rules)
+        if merged['symlinks'] not in ['skip', 'file', 'follow']:
+            raise ValueError('symlinks must be skip, file or follow, not %r' % merged['symlinks'])
+        if merged['maxFileSize'] != None and not isinstance(merged['maxFileSize'], int):
+            raise ValueError('maxFileSize must be a number of bytes')
+        for key in ['archiveDepth', 'archiveMaxSize', 'archiveMemberMaxSize', 'archiveTotalSize', 'archiveMaxMembers']:
+            if not isinstance(merged[key], int):
+                raise ValueError(key + ' must be a number')
+
+        self.include = merged['include']
+        self.exclude = merged['exclude']
+        self.include_regex = [re.compile(pattern) for pattern in merged['includeRegex']]
+        self.exclude_regex = [re.compile(pattern) for pattern in merged['excludeRegex']]
+        self.exclude_filesystems = set(merged['excludeFilesystems'])
+        self.one_filesystem = merged['oneFilesystem']
+        self.max_file_size = merged['maxFileSize']
+        self.symlinks = merged['symlinks']
+        self.archives = merged['archives']
+        self.archive_depth = merged['archiveDepth']
+        self.archive_max_size = merged['archiveMaxSize']
+        self.archive_member_max_size = merged['archiveMemberMaxSize']
+        self.archive_total_size = merged['archiveTotalSize']
+        self.archive_max_members = merged['archiveMaxMembers']
+        self.mounts = read_mounts()
+
+    def matches(self, patterns, regexes, path):
+        # Globs without a slash match the file name, like in .gitignore
+        name = os.path.basename(path)
+        for pattern in patterns:
+            if fnmatch.fnmatchcase(path if '/' in pattern else name, pattern):
+                return True
+        for regex in regexes:
+            if regex.search(path):
+                return True
+        return False
+
+    def excluded(self, path):
+        return self.matches(self.exclude, self.exclude_regex, path)
+
+    def included(self, path):
+        if len(self.include) == 0 and len(self.include_regex) == 0:
+            return True
+        return self.matches(self.include, self.include_regex, path)
+
+    def filesystem(self, path):
+        # The type of the longest mount point containing path
+        fs_type = None
+        longest = -1
+        for mount_point, mount_type in self.mounts:
+            if len(mount_point) > longest and (path == mount_point or path.startswith(mount_point.rstrip('/') + '/')):
+                fs_type = mount_type
+                longest = len(mount_point)
+        return fs_type
+
+def read_mounts():
+    mounts = []
+    try:
+        with open('/proc/self/mounts') as f:
+            for line in f:
+                fields = line.split()
+                if len(fields) >= 3:
+                    # Spaces and other special characters are octal escaped
+                    mount_point = re.sub(r'\\([0-7]{3})', lambda m: chr(int(m.group(1), 8)), fields[1])
+                    mounts.append((mount_point, fields[2]))
+    except OSError:
+        pass
+    return mounts
+
+def load_rules(path):
+    if path == None:
+        return ScanRules({})
+    with open(path) as f:
+        return ScanRules(json.load(f))
+
+def allowed_directory(path, root_dev, visited):
+    try:
+        stat = os.stat(path)
+    except OSError:
+        return False
+    if rules.one_filesystem and stat.st_dev != root_dev:
+        return False
+    if rules.filesystem(os.path.realpath(path)) in rules.exclude_filesystems:
+        return False
+    # Followed symlinks can lead back to a directory walked before
+    key = (stat.st_dev, stat.st_ino)
+    if key in visited:
+        return False
+    visited.add(key)
+    return True
+
+def list_directory(directory, root_dev, visited):
+    files = []
+    dirs = []
+    try:
+        entries = list(os.scandir(directory))
+    except OSError:
+        return files, dirs
+    for entry in entries:
+        path = entry.path
+        try:
+            if entry.is_symlink() and rules.symlinks == 'skip':
+                continue
+            if entry.is_dir(follow_symlinks=rules.symlinks == 'follow'):
+                if not rules.excluded(path) and allowed_directory(path, root_dev, visited):
+                    dirs.append(path)
+            elif entry.is_file():
+                if not rules.archives and is_compressed(path):
+                    continue
+                if rules.excluded(path) or not rules.included(path):
+                    continue
+                if rules.max_file_size != None and entry.stat().st_size > rules.max_file_size:
+                    continue
+                files.append(path)
+        except OSError:
+            continue
+    return files, dirs
+
+def get_file_paths(directory, root_dev, visited):
+    file_paths, dirs = list_directory(directory, root_dev, visited)
+    for dir in dirs:
+        file_paths.extend(get_file_paths(dir, root_dev, visited))
     return file_paths
 
-def calculate_checksum(file, checksum_algorithm):
-    hash_algo = hashlib.new(checksum_algorithm)
+class SsdeepHash:
+    def __init__(self):
+        self.hash = ssdeep.Hash()
+
+    def update(self, data):
+        self.hash.update(data)
+
+    def hexdigest(self):
+        return self.hash.digest()
+
+class TlshHash:
+    def __init__(self):
+        self.hash = tlsh.Tlsh()
+
+    def update(self, data):
+        self.hash.update(data)
+
+    def hexdigest(self):
+        # Files that are too small or too uniform have no TLSH digest
+        try:
+            self.hash.final()
+            digest = self.hash.hexdigest()
+        except ValueError:
+            return ''
+        return '' if digest == 'TNULL' else digest
+
+# Python modules computing the algorithms hashlib lacks
+hash_modules = {'BLAKE3': 'blake3', 'SSDEEP': 'ssdeep', 'TLSH': 'py-tlsh'}
+
+def hash_available(algo):
+    return {'BLAKE3': blake3, 'SSDEEP': ssdeep, 'TLSH': tlsh}.get(algo, hashlib) != None
+
+def new_hash(algo):
+    if algo == 'BLAKE3':
+        return blake3.blake3()
+    if algo == 'SSDEEP':
+        return SsdeepHash()
+    if algo == 'TLSH':
+        return TlshHash()
+    return hashlib.new(algo)
+
+def hash_digests(hashes):
+    # Algorithms without a digest for the data are left out
+    digests = {}
+    for algo, h in zip(hash_algorithms, hashes):
+        digest = h.hexdigest()
+        if digest:
+            digests[algo] = digest
+    return digests
+
+def calculate_checksums(file):
+    # The file is read once for all algorithms
+    hashes = [new_hash(algo) for algo in hash_algorithms]
     try:
         with open(file, 'rb') as f:
             while True:
-                try:
-                    data = f.read(8192)
-                    if not data:
-                        break
-                except:
-                    return None
-                hash_algo.update(data)
-    except:
+                data = f.read(65536)
+                if not data:
+                    break
+                for h in hashes:
+                    h.update(data)
+    except OSError:
         return None
-    return hash_algo.hexdigest()
-
-def calculate_checksums(file):
-    checksum_algorithms = [ 'MD5', 'SHA1', 'SHA256', 'SHA512' ]
-    checksums = []
-    for algo in checksum_algorithms:
-        checksum = calculate_checksum(file, algo)
-        if checksum != None:
-            checksums.append(checksum)
-    return checksums  
+    return hash_digests(hashes)
 
 def get_file_details(file):
     full_path = os.path.abspath(file)
@@ -146,21 +306,232 @@ def process_file(file):
     if os.path.exists(file) and os.path.isfile(file):
         file_details = get_file_details(file)
         checksums = calculate_checksums(file)
-        if len(checksums) < 4:
+        if checksums == None:
             return None
-        file_details['MD5'] = checksums[0]
-        file_details['SHA1'] = checksums[1]
-        file_details['SHA256'] = checksums[2]
-        file_details['SHA512'] = checksums[3]
+        file_details['hashes'] = checksums
         return file_details
     return None
 
+# Archive formats by file name suffix. Formats the standard library cannot
+# read are hashed as plain files only
+archive_suffixes = {
+    '.zip': 'zip', '.jar': 'zip', '.war': 'zip', '.ear': 'zip', '.apk': 'zip', '.whl': 'zip',
+    '.tar': 'tar', '.tgz': 'tar', '.tar.gz': 'tar', '.tbz2': 'tar', '.tar.bz2': 'tar', '.txz': 'tar', '.tar.xz': 'tar',
+    '.deb': 'ar', '.a': 'ar',
+    '.gz': 'gz', '.bz2': 'bz2', '.xz': 'xz'
+}
+# Compressed files, which are skipped unless archives are opened, as their
+# hashes say nothing about the files in them. Other archives, like .jar
+# and .deb files, are hashed as plain files
+compressed_suffixes = ['.zip', '.rar', '.tar', '.gz', '.7z', '.bz2', '.xz']
+
+def archive_format(name):
+    lower = name.lower()
+    for suffix in sorted(archive_suffixes, key=len, reverse=True):
+        if lower.endswith(suffix):
+            return archive_suffixes[suffix]
+    return None
+
+def is_compressed(name):
+    return os.path.splitext(name)[1].lower() in compressed_suffixes
+
+class ArchiveLimit(Exception):
+    pass
+
+class LimitedReader:
+    # Reads size bytes of an ar member from the archive file
+    def __init__(self, f, size):
+        self.f = f
+        self.remaining = size
+
+    def read(self, n=-1):
+        if n < 0 or n > self.remaining:
+            n = self.remaining
+        data = self.f.read(n)
+        self.remaining -= len(data)
+        return data
+
+    def __enter__(self):
+        return self
+
+    def __exit__(self, *args):
+        return False
+
+def ar_entries(f):
+    if f.read(8) != b'!<arch>\n':
+        raise ValueError('not an ar archive')
+    offset = 8
+    while True:
+        f.seek(offset)
+        header = f.read(60)
+        if len(header) < 60:
+            return
+        name = header[0:16].decode('utf-8', 'replace').strip().rstrip('/')
+        mtime = int(header[16:28].strip() or 0)
+        mode = int(header[40:48].strip() or 0, 8)
+        size = int(header[48:58].strip())
+        start = offset + 60
+        # Symbol and long name tables are not members
+        if name != '' and name != '/' and name != '/SYM64':
+            yield name, size, mode, mtime, '', '', lambda start=start, size=size: (f.seek(start), LimitedReader(f, size))[1]
+        offset = start + size + size % 2
+
+def archive_entries(f, fmt, name):
+    # Yields name, size, mode, modification time, owner, group and an
+    # opener of every regular file in an archive
+    if fmt == 'zip':
+        with zipfile.ZipFile(f) as archive:
+            for info in archive.infolist():
+                if info.is_dir():
+                    continue
+                mtime = datetime.datetime(*info.date_time).timestamp()
+                yield info.filename, info.file_size, (info.external_attr >> 16) & 0o777, mtime, '', '', lambda info=info: archive.open(info)
+    elif fmt == 'tar':
+        with tarfile.open(fileobj=f, mode='r:*') as archive:
+            for info in archive:
+                if not info.isfile():
+                    continue
+                yield info.name, info.size, info.mode & 0o777, info.mtime, info.uname, info.gname, lambda info=info: archive.extractfile(info)
+    elif fmt == 'ar':
+        yield from ar_entries(f)
+    else:
+        # Compressed files hold a single member named like the file
+        opener = {'gz': gzip.GzipFile, 'bz2': bz2.BZ2File, 'xz': lzma.LZMAFile}[fmt]
+        member = os.path.basename(name)
+        member = member[:member.rfind('.')]
+        yield member, None, None, None, '', '', lambda: opener(fileobj=f)
+
+class ArchiveScan:
+    # Limits shared by an archive on disk and the archives within it
+    def __init__(self):
+        self.remaining = rules.archive_total_size
+        self.members = 0
+        self.records = []
+
+def hash_member(stream, scan, copy):
+    # Returns the checksums and size of a member, or no checksums if it is
+    # larger than archiveMemberMaxSize
+    hashes = [new_hash(algo) for algo in hash_algorithms]
+    size = 0
+    while True:
+        data = stream.read(65536)
+        if not data:
+            break
+        size += len(data)
+        scan.remaining -= len(data)
+        if scan.remaining < 0:
+            raise ArchiveLimit()
+        if size > rules.archive_member_max_size:
+            return None, size
+        for h in hashes:
+            h.update(data)
+        if copy != None:
+            copy.write(data)
+    return hash_digests(hashes), size
+
+archive_errors = (OSError, EOFError, ValueError, zipfile.BadZipFile, tarfile.TarError, lzma.LZMAError, RuntimeError, NotImplementedError)
+
+def archive_members(container, f, fmt, depth, scan):
+    try:
+        for name, size, mode, mtime, owner, group, open_member in archive_entries(f, fmt, container['path']):
+            scan.members += 1
+            if scan.members > rules.archive_max_members:
+                raise ArchiveLimit()
+            if size != None and size > rules.archive_member_max_size:
+                continue
+            nested = archive_format(name) if depth < rules.archive_depth else None
+            # Nested archives are read again from a copy, as most formats
+            # need to seek
+            copy = tempfile.SpooledTemporaryFile(max_size=16 << 20) if nested != None else None
+            try:
+                with open_member() as stream:
+                    checksums, size = hash_member(stream, scan, copy)
+            except archive_errors:
+                # Encrypted or damaged members are skipped
+                checksums = None
+            if checksums == None:
+                if copy != None:
+                    copy.close()
+                continue
+
+            record = {
+                "path": container['path'] + '!/' + re.sub(r'^(\./|/)+', '', name),
+                "name": os.path.basename(name),
+                "container": container['path'],
+                "created": "",
+                "modified": datetime.datetime.fromtimestamp(mtime).isoformat() if mtime != None else container['modified'],
+                "accessed": "",
+                "owner": owner or container['owner'],
+                "group": group or container['group'],
+                "perm": '%03o' % mode if mode != None else container['perm'],
+                "size": size
+            }
+            record['hashes'] = checksums
+            scan.records.append(record)
+            if copy != None:
+                try:
+                    copy.seek(0)
+                    archive_members(record, copy, nested, depth + 1, scan)
+                finally:
+                    copy.close()
+    except archive_errors:
+        # Damaged or unsupported archives keep the members read so far
+        pass
+
+def process_archive(file_details):
+    # Members of an archive on disk and of the archives within it, up to
+    # archiveDepth levels deep and archiveTotalSize uncompressed bytes
+    if file_details['size'] > rules.archive_max_size:
+        return []
+    scan = ArchiveScan()
+    try:
+        with open(file_details['path'], 'rb') as f:
+            archive_members(file_details, f, archive_format(file_details['path']), 1, scan)
+    except (ArchiveLimit, OSError):
+        pass
+    return scan.records
+
 def get_metadata():
     metadata = {
-    'ip_address': get_local_ipv4_address()
+    'ip_address': get_local_ipv4_address(),
+    'scan_id': scan_id
     }
+    if profile != None:
+        metadata['profile'] = profile['name']
+        metadata['profile_version'] = profile['version']
+    if scan_directories != None:
+        metadata['directories'] = scan_directories
     return metadata
 
+def fetch_profile(name):
+    # The last profile fetched is used while the listener cannot be reached
+    url = f'http://{service_host}:{service_port}/profiles/{name}'
+    cache_dir = os.path.join(local_dir, 'profiles')
+    cache_path = os.path.join(cache_dir, name + '.json')
+    for attempt in range(retries + 1):
+        if attempt > 0:
+            backoff(attempt)
+        try:
+            response = requests.get(url, timeout=30)
+        except requests.RequestException as e:
+            print('Profile request failed:', e)
+            continue
+        if response.status_code == 404:
+            raise ValueError(f'profile {name} does not exist')
+        if response.status_code != 200:
+            print('Profile request failed:', response.status_code)
+            continue
+        fetched = response.json()
+        os.makedirs(cache_dir, exist_ok=True)
+        with open(cache_path + '.tmp', 'w') as f:
+            json.dump(fetched, f)
+        os.rename(cache_path + '.tmp', cache_path)
+        return fetched, False
+    if not os.path.exists(cache_path):
+        raise ValueError('the listener cannot be reached and the profile was never fetched')
+    with open(cache_path) as f:
+        return json.load(f), True
+
 def check_files_integrity(file_list):
     payload_data = {
     "files" : file_list,
@@ -168,38 +539,151 @@ def check_files_integrity(file_list):
     "status" : "processing"
     }
     
-    send_integrity_request(payload_data)
-
-def send_integrity_request(payload):
+    if classify_locally:
+        verify_locally(payload_data)
+    else:
+        if verifier != None:
+            # Only adds the ELF facts of the files
+            with verifier_lock:
+                payload_data = verifier_request(payload_data)
+        spool_request(payload_data)
+        upload_spooled_requests(wait=False)
+
+def start_verifier(verifier_path, snapshot, snapshot_key, inspect_elf):
+    args = [verifier_path]
+    if snapshot != None:
+        args += ['--snapshot', snapshot, '--snapshot-key', snapshot_key]
+    if inspect_elf:
+        args.append('--inspect-elf')
+    process = subprocess.Popen(args, stdin=subprocess.PIPE, stdout=subprocess.PIPE, stderr=subprocess.PIPE, text=True)
+    # The verifier logs to stderr while it runs, which would block it once
+    # the pipe is full. Only the last lines are kept, for error messages
+    global verifier_log_reader
+    verifier_log_reader = threading.Thread(target=verifier_log.extend, args=(process.stderr,), daemon=True)
+    verifier_log_reader.start()
+    return process
+
+def verifier_error():
+    verifier.wait()
+    verifier_log_reader.join(timeout=5)
+    return ''.join(verifier_log).strip()
+
+def verifier_request(payload):
+    # The verifier answers one request at a time, in order, so callers
+    # hold verifier_lock
+    verifier.stdin.write(json.dumps(payload) + '\n')
+    verifier.stdin.flush()
+    line = verifier.stdout.readline()
+    if not line:
+        raise RuntimeError('verifier exited: ' + verifier_error())
+    return json.loads(line)
+
+def verify_locally(payload):
+    with verifier_lock:
+        report = verifier_request(payload)
+        for key in ['verifiedFiles', 'candidateFiles', 'maliciousFiles', 'maliciousVariables']:
+            local_report[key].extend(report[key])
+
+    # Verified files are not uploaded, the server learns nothing from them
+    queued_files = report['candidateFiles'] + report['maliciousFiles']
+    if len(queued_files) > 0:
+        spool_request({
+        "files" : queued_files,
+        "metadata" : payload['metadata'],
+        "status" : payload['status']
+        })
+
+def spool_request(payload):
+    # Names sort in the order the requests were spooled in, and are sent
+    # as idempotency keys so the listener can ignore replays
+    file_name = '%020d-%s.json' % (time.time_ns(), uuid.uuid4())
+    file_path = os.path.join(spool_dir, file_name)
+    with open(file_path + '.tmp', 'w') as f:
+        json.dump(payload, f)
+    os.rename(file_path + '.tmp', file_path)
+
+def upload_spooled_requests(wait=True):
+    # Requests are sent oldest first, and sending stops at the first one
+    # that is not acknowledged. A scan's final request therefore only goes
+    # out once all of its batches, and all earlier scans, were received
+    global upload_failed
+    if not upload_lock.acquire(blocking=wait):
+        # The thread holding the lock sends this request as well
+        return None
+    try:
+        while not upload_failed:
+            spooled = sorted(name for name in os.listdir(spool_dir) if name.endswith('.json'))
+            if len(spooled) == 0:
+                return 0
+            for name in spooled:
+                if not send_spooled_request(name):
+                    upload_failed = True
+                    break
+        return len([name for name in os.listdir(spool_dir) if name.endswith('.json')])
+    finally:
+        upload_lock.release()
+
+def send_spooled_request(name):
     url = f'http://{service_host}:{service_port}'
-    json_payload = json.dumps(payload)
-    headers = {'Content-Type': 'application/json'}
-    response = requests.post(url, data=json_payload, headers=headers)
-
-    if response.status_code != 200:
+    file_path = os.path.join(spool_dir, name)
+    with open(file_path) as f:
+        json_payload = f.read()
+    headers = {'Content-Type': 'application/json', 'Idempotency-Key': name[:-len('.json')]}
+
+    for attempt in range(retries + 1):
+        if attempt > 0:
+            backoff(attempt)
+        try:
+            response = requests.post(url, data=json_payload, headers=headers, timeout=600)
+        except requests.RequestException as e:
+            print('Request failed:', e)
+            continue
+        if response.status_code == 200:
+            os.remove(file_path)
+            return True
         print('Request failed:', response.status_code)
+    return False
+
+def backoff(attempt):
+    # Exponential backoff with full jitter
+    time.sleep(random.uniform(0, min(retry_max_delay, retry_delay * 2 ** (attempt - 1))))
+
+def save_local_report():
+    reports_dir = os.path.join(local_dir, 'reports')
+    os.makedirs(reports_dir, exist_ok=True)
+    local_report['metadata'] = get_metadata()
+    file_path = os.path.join(reports_dir, f'report-{scan_id}.json')
+    with open(file_path, 'w') as f:
+        json.dump(local_report, f, indent=2)
+    return file_path
 
 def process_root_dir(directory):
     threads = []
-    
-    partial_files = search_files(directory)
-    process_file_paths(partial_files)
+
+    try:
+        root_dev = os.stat(directory).st_dev
+    except OSError:
+        return
+    visited = set()
+    if not allowed_directory(directory, root_dev, visited):
+        return
+
+    partial_files, sub_dirs = list_directory(directory, root_dev, visited)
     
     thread = threading.Thread(target=process_file_paths, args=(partial_files,))
     threads.append(thread)
     thread.start()
     
-    sub_dirs = search_directories(directory)   
     for dir in sub_dirs:
-        thread = threading.Thread(target=process_dir, args=(dir,))
+        thread = threading.Thread(target=process_dir, args=(dir, root_dev, visited))
         threads.append(thread)
         thread.start()
 
     for thread in threads:
         thread.join()
 
-def process_dir(directory):
-    file_paths = get_file_paths(directory) 
+def process_dir(directory, root_dev, visited):
+    file_paths = get_file_paths(directory, root_dev, visited) 
     process_file_paths(file_paths)
 
 def process_file_paths(file_paths):
@@ -208,25 +692,140 @@ def process_file_paths(file_paths):
             processed_file = process_file(file)
             if processed_file != None:
                 results.append(processed_file)
+                if rules.archives and archive_format(file) != None:
+                    results.extend(process_archive(processed_file))
                 
     if len(results) > 0:
         check_files_integrity(results)
 
+supported_hash_algorithms = ['MD5', 'SHA1', 'SHA256', 'SHA512', 'BLAKE3', 'SSDEEP', 'TLSH']
+fuzzy_hash_algorithms = ['SSDEEP', 'TLSH']
+hash_algorithms = ['MD5', 'SHA1', 'SHA256', 'SHA512']
+profile = None
+scan_directories = None
+verifier = None
+verifier_log = collections.deque(maxlen=20)
+verifier_log_reader = None
+classify_locally = False
+verifier_lock = threading.Lock()
+upload_lock = threading.Lock()
+upload_failed = False
+local_report = {
+    'verifiedFiles': [],
+    'candidateFiles': [],
+    'maliciousFiles': [],
+    'maliciousVariables': []
+}
+
+def profile_result():
+    if profile == None:
+        return {}
+    return {'profile': profile['name'], 'profile_version': profile['version']}
+
 def main():
     global service_host
     global service_port
+    global scan_id
+    global scan_directories
+    global verifier
+    global classify_locally
+    global local_dir
+    global spool_dir
+    global retries
+    global retry_delay
+    global retry_max_delay
+    global rules
+    global profile
+    global hash_algorithms
     module = AnsibleModule(
         argument_spec=dict(
-            directories=dict(type='list', required=True),
+            directories=dict(type='list'),
+            profile=dict(type='str'),
             service_host=dict(type='str', required=True),
             service_port=dict(type='int', required=True),
-        )
+            snapshot=dict(type='path'),
+            snapshot_key=dict(type='path'),
+            verifier=dict(type='path', default='/var/lib/sys-check/verifier'),
+            inspect_elf=dict(type='bool', default=False),
+            local_dir=dict(type='path', default='/var/lib/sys-check'),
+            retries=dict(type='int', default=5),
+            retry_delay=dict(type='float', default=1.0),
+            retry_max_delay=dict(type='float', default=60.0),
+            rules=dict(type='path'),
+            hash_algorithms=dict(type='list'),
+        ),
+        required_together=[['snapshot', 'snapshot_key']],
+        required_one_of=[['directories', 'profile']]
     )
     
     dirs = module.params["directories"]
     service_host = module.params['service_host']
     service_port = module.params['service_port']
-    
+    scan_id = str(uuid.uuid4())
+    retries = module.params['retries']
+    retry_delay = module.params['retry_delay']
+    retry_max_delay = module.params['retry_max_delay']
+
+    # Every request is spooled until the listener acknowledges it
+    local_dir = module.params['local_dir']
+    spool_dir = os.path.join(local_dir, 'queue')
+    os.makedirs(spool_dir, exist_ok=True)
+
+    # A profile served by the listener replaces the directories, and its
+    # rules the rule file
+    rules_file = module.params['rules']
+    if module.params['hash_algorithms'] != None:
+        hash_algorithms = module.params['hash_algorithms']
+    inspect_elf = module.params['inspect_elf']
+    profile_rules = None
+    stale_profile = False
+    if module.params['profile'] != None:
+        try:
+            profile, stale_profile = fetch_profile(module.params['profile'])
+        except (OSError, ValueError) as e:
+            module.fail_json(msg=f'failed to get profile {module.params["profile"]}: {e}')
+        dirs = profile['directories']
+        profile_rules = profile.get('rules')
+        if profile.get('hashAlgorithms'):
+            hash_algorithms = profile['hashAlgorithms']
+        if 'inspectElf' in profile:
+            inspect_elf = profile['inspectElf']
+    try:
+        if profile_rules != None:
+            rules = ScanRules(profile_rules)
+        else:
+            rules = load_rules(rules_file)
+    except (OSError, ValueError, re.error) as e:
+        module.fail_json(msg=f'invalid scan rules: {e}')
+    unsupported = set(hash_algorithms) - set(supported_hash_algorithms)
+    if len(unsupported) > 0:
+        module.fail_json(msg='unsupported hash algorithms: ' + ', '.join(sorted(unsupported)))
+    unavailable = [algo for algo in hash_algorithms if not hash_available(algo)]
+    if len(unavailable) > 0:
+        module.fail_json(msg='hash algorithms need python modules that are not installed: ' +
+                         ', '.join(f'{algo} ({hash_modules[algo]})' for algo in unavailable))
+    # Files are looked up by the digests that are not fuzzy
+    if len(set(hash_algorithms) - set(fuzzy_hash_algorithms)) == 0:
+        module.fail_json(msg='hash algorithms must include one that is not fuzzy')
+    if stale_profile:
+        module.warn(f'scanning with the cached version {profile["version"]} of profile {profile["name"]}')
+
+    # With a snapshot files are classified on this computer, and only
+    # candidates and malicious files are spooled for upload. ELF headers
+    # can only be read here, where the files are. Without a snapshot that
+    # means reading every ELF file a second time
+    classify_locally = module.params['snapshot'] != None
+    if inspect_elf and not classify_locally and not os.path.exists(module.params['verifier']):
+        module.warn(f'ELF files are not inspected, {module.params["verifier"]} is missing')
+        inspect_elf = False
+    if classify_locally or inspect_elf:
+        try:
+            verifier = start_verifier(module.params['verifier'], module.params['snapshot'],
+                                      module.params['snapshot_key'], inspect_elf)
+        except OSError as e:
+            module.fail_json(msg=f'failed to start verifier: {e}')
+
+    scan_directories = dirs
     for dir in dirs:
         process_root_dir(dir)
 
@@ -237,9 +836,28 @@ def main():
     "status" : "final"
     }
 
-    send_integrity_request(payload_data)
-
-    module.exit_json(changed=False)
+    if verifier != None:
+        verifier.stdin.close()
+        if verifier.wait() != 0:
+            module.fail_json(msg='verifier failed: ' + verifier_error())
+    if classify_locally:
+        report_path = save_local_report()
+
+    spool_request(payload_data)
+    # Requests spooled by earlier scans that could not reach the server
+    # are uploaded first
+    queued = upload_spooled_requests()
+    if queued > 0:
+        module.warn(f'{queued} requests could not be sent to {service_host}:{service_port} and stay spooled in {spool_dir} for the next scan')
+
+    if classify_locally:
+        module.exit_json(changed=True, report=report_path, **profile_result(),
+                         verified=len(local_report['verifiedFiles']),
+                         candidates=len(local_report['candidateFiles']),
+                         malicious=len(local_report['maliciousFiles']),
+                         queued=queued)
+
+    module.exit_json(changed=queued > 0, queued=queued, **profile_result())
     
 if __name__ == '__main__':
     main()
@@ -0,0 +1,13 @@
+module verifier
+
+go 1.19
+
+require common v0.0.0-00010101000000-000000000000
+
+require (
+	github.com/lib/pq v1.10.9 // indirect
+	go.etcd.io/bbolt v1.3.7 // indirect
+	golang.org/x/sys v0.4.0 // indirect
+)
+
+replace common => ../../common
@@ -0,0 +1,185 @@
+// The verifier classifies scans on the scanned computer with a snapshot of
+// the known hashes. It reads scan requests from standard input and writes
+// a report per request to standard output, one JSON value per line, so the
+// snapshot is only loaded once per scan.
+//
+// With --inspect-elf the ELF headers of candidate and malicious files are
+// read as well, which needs the files and so only works where they were
+// scanned. Without a snapshot the requests are written back with the ELF
+// facts of every ELF file, for the analyzer to classify.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"common/classify"
+	"common/elfinfo"
+	"common/snapshot"
+	"common/store"
+)
+
+type ScannedFiles struct {
+	Name        string            `json:"name"`
+	Path        string            `json:"path"`
+	Container   string            `json:"container,omitempty"`
+	Size        int               `json:"size"`
+	Owner       string            `json:"owner"`
+	Perm        string            `json:"perm"`
+	Accessed    string            `json:"accessed"`
+	Created     string            `json:"created"`
+	Group       string            `json:"group"`
+	Modified    string            `json:"modified"`
+	Hashes      map[string]string `json:"hashes"`
+	FileStatus  string            `json:"fileStatus,omitempty"`
+	Family      string            `json:"family,omitempty"`
+	Source      string            `json:"source,omitempty"`
+	FirstSeen   string            `json:"firstSeen,omitempty"`
+	ThreatLabel string            `json:"threatLabel,omitempty"`
+	ELF         *elfinfo.Info     `json:"elf,omitempty"`
+}
+
+type Metadata struct {
+	IPv4Address    string `json:"ip_address"`
+	ScanID         string `json:"scan_id,omitempty"`
+	Profile        string `json:"profile,omitempty"`
+	ProfileVersion string `json:"profile_version,omitempty"`
+	// Directories the agent scanned.
+	Directories []string `json:"directories,omitempty"`
+}
+
+type ScanRequest struct {
+	Files    []ScannedFiles `json:"files"`
+	Metadata Metadata       `json:"metadata"`
+	Status   string         `json:"status"`
+}
+
+type Report struct {
+	Metadata       Metadata       `json:"metadata"`
+	VerifiedFiles  []ScannedFiles `json:"verifiedFiles"`
+	CandidateFiles []ScannedFiles `json:"candidateFiles"`
+	MaliciousFiles []ScannedFiles `json:"maliciousFiles"`
+	MaliciousVars  []string       `json:"maliciousVariables"`
+}
+
+func main() {
+	snapshotPath := flag.String("snapshot", "", "snapshot of the known hashes")
+	snapshotKey := flag.String("snapshot-key", "", "public key the snapshot is signed with")
+	inspectELF := flag.Bool("inspect-elf", false, "read the ELF headers of candidate and malicious files")
+	flag.Parse()
+	if (*snapshotPath == "") != (*snapshotKey == "") || (*snapshotPath == "" && !*inspectELF) {
+		fmt.Fprintln(os.Stderr, "usage: verifier [--snapshot <snapshot file> --snapshot-key <public key file>] [--inspect-elf]")
+		os.Exit(2)
+	}
+
+	var snap *snapshot.Snapshot
+	if *snapshotPath != "" {
+		key, err := snapshot.LoadPublicKey(*snapshotKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		snap, err = snapshot.Open(*snapshotPath, key)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer snap.Close()
+		header := snap.Header()
+		log.Printf("verifying with snapshot of %s (%d verified, %d malicious files)",
+			header.CreatedAt.Format(time.RFC3339), header.Files["verified"], header.Files["malicious"])
+	}
+
+	decoder := json.NewDecoder(os.Stdin)
+	encoder := json.NewEncoder(os.Stdout)
+	for {
+		var request ScanRequest
+		err := decoder.Decode(&request)
+		if errors.Is(err, io.EOF) {
+			return
+		}
+		if err != nil {
+			log.Fatal("invalid scan request: ", err)
+		}
+		if snap == nil {
+			for i := range request.Files {
+				inspect(&request.Files[i])
+			}
+			if err := encoder.Encode(request); err != nil {
+				log.Fatal(err)
+			}
+			continue
+		}
+		report, err := verify(&request, snap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if *inspectELF {
+			for _, files := range [][]ScannedFiles{report.CandidateFiles, report.MaliciousFiles} {
+				for i := range files {
+					inspect(&files[i])
+				}
+			}
+		}
+		if err := encoder.Encode(report); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func verify(request *ScanRequest, st store.Operations) (*Report, error) {
+	report := &Report{
+		Metadata:       request.Metadata,
+		VerifiedFiles:  []ScannedFiles{},
+		CandidateFiles: []ScannedFiles{},
+		MaliciousFiles: []ScannedFiles{},
+		MaliciousVars:  []string{},
+	}
+	lookups := make([]store.Hashes, len(request.Files))
+	for i, file := range request.Files {
+		// Files with invalid hashes are left without any, which makes
+		// them candidates.
+		lookups[i], _ = store.HashesOf(file.Hashes)
+	}
+	results, err := classify.Files(context.Background(), st, lookups)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, file := range request.Files {
+		result := results[i]
+		file.FileStatus = result.Status
+		file.Family = result.Family
+		file.Source = result.Source
+		file.FirstSeen = result.FirstSeen
+		file.ThreatLabel = result.ThreatLabel
+		switch result.Status {
+		case "verified":
+			report.VerifiedFiles = append(report.VerifiedFiles, file)
+		case "malicious":
+			report.MaliciousFiles = append(report.MaliciousFiles, file)
+		default:
+			report.CandidateFiles = append(report.CandidateFiles, file)
+		}
+	}
+	return report, nil
+}
+
+// inspect attaches the ELF facts of file if it is an ELF file on disk.
+// Archive members are not.
+func inspect(file *ScannedFiles) {
+	if file.Container != "" || !elfinfo.IsELF(file.Path) {
+		return
+	}
+	info, err := elfinfo.Inspect(file.Path)
+	if err != nil {
+		log.Printf("failed to inspect %s: %v", file.Path, err)
+		return
+	}
+	file.ELF = info
+}
@@ -9,6 +9,7 @@ cp "${sys_check_repo_location}/upload_known_data/.env.example" "/home/${user}/.s
 
 #setup golang
 sudo apt install -y golang-go
+cd "${sys_check_repo_location}/upload_known_data/sys-check-data" && go build sys-check-data
 
 #setup python
 sudo apt install -y python3
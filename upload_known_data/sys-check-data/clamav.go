@@ -0,0 +1,210 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const cvdHeaderSize = 512
+
+// ClamAV hash signature databases. Whole file signatures are stored as
+// hash:size:name, PE section signatures (.mdb/.msb) as size:hash:name.
+var clamAVDatabases = map[string]bool{
+	".hdb": true,
+	".hdu": true,
+	".hsb": true,
+	".hsu": true,
+	".mdb": false,
+	".mdu": false,
+	".msb": false,
+	".msu": false,
+}
+
+// readClamAV imports the hash signatures of a single ClamAV database file,
+// a .cvd/.cld container or a directory unpacked with sigtool --unpack.
+func readClamAV(path string, w recordWriter) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		return filepath.Walk(path, func(member string, info os.FileInfo, err error) error {
+			if err != nil {
+				return err
+			}
+			if info.IsDir() {
+				return nil
+			}
+			if _, ok := clamAVDatabases[strings.ToLower(filepath.Ext(member))]; !ok {
+				return nil
+			}
+			return readClamAVFile(member, w)
+		})
+	}
+	return readClamAVFile(path, w)
+}
+
+func readClamAVFile(path string, w recordWriter) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	ext := strings.ToLower(filepath.Ext(path))
+	if ext == ".cvd" || ext == ".cld" {
+		return readClamAVContainer(filepath.Base(path), file, w)
+	}
+	if _, ok := clamAVDatabases[ext]; !ok {
+		return fmt.Errorf("%s is not a ClamAV hash signature database", path)
+	}
+	return readClamAVDatabase(filepath.Base(path), file, w)
+}
+
+// readClamAVContainer reads the databases packed in a .cvd or .cld file: a
+// 512 byte "ClamAV-VDB:" header followed by a tar archive, which is gzip
+// compressed in .cvd files.
+func readClamAVContainer(name string, r io.Reader, w recordWriter) error {
+	header := make([]byte, cvdHeaderSize)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return fmt.Errorf("error reading %s header: %v", name, err)
+	}
+	if !bytes.HasPrefix(header, []byte("ClamAV-VDB:")) {
+		return fmt.Errorf("%s is not a ClamAV signature container", name)
+	}
+
+	buffered := bufio.NewReader(r)
+	var archive io.Reader = buffered
+	if magic, err := buffered.Peek(2); err == nil && magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return fmt.Errorf("error decompressing %s: %v", name, err)
+		}
+		defer gz.Close()
+		archive = gz
+	}
+
+	tr := tar.NewReader(archive)
+	for {
+		member, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading %s: %v", name, err)
+		}
+		if member.Typeflag != tar.TypeReg {
+			continue
+		}
+		if _, ok := clamAVDatabases[strings.ToLower(filepath.Ext(member.Name))]; !ok {
+			continue
+		}
+		if err := readClamAVDatabase(name+"/"+member.Name, tr, w); err != nil {
+			return err
+		}
+	}
+}
+
+// readClamAVDatabase reads the whole file signatures of a database. Its
+// records name the database as their source, which --source replaces.
+// PE section signatures are hashes of single sections of executables,
+// which never match the whole file hashes of scans, so they are only
+// counted.
+func readClamAVDatabase(name string, r io.Reader, w recordWriter) error {
+	ext := strings.ToLower(filepath.Ext(name))
+	if !clamAVDatabases[ext] {
+		skipped, err := countLines(r)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "\rskipped %d PE section signatures in %s, they do not match whole file hashes\n", skipped, name)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		location := fmt.Sprintf("%s line %d", name, line)
+
+		fields := strings.Split(text, ":")
+		if len(fields) < 3 {
+			w.Reject(location, fmt.Errorf("expected hash:size:name, got %q", text))
+			continue
+		}
+		file := ScannedFiles{
+			Source:      "clamav:" + name,
+			ThreatLabel: fields[2],
+			Family:      clamAVFamily(fields[2]),
+		}
+		if err := file.setHash(fields[0]); err != nil {
+			w.Reject(location, err)
+			continue
+		}
+		if fields[1] != "*" {
+			size, err := parseSize(fields[1])
+			if err != nil {
+				w.Reject(location, err)
+				continue
+			}
+			file.Size = size
+		}
+		if err := w.Write(file); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// clamAVFamily returns the family part of a signature name following the
+// Platform.Category.Name-SignatureID-Revision convention, for example
+// Emotet for Win.Trojan.Emotet-6999845-0.
+func clamAVFamily(signature string) string {
+	parts := strings.Split(signature, ".")
+	if len(parts) < 3 {
+		return ""
+	}
+	name := parts[2]
+	if i := strings.Index(name, "-"); i > 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// sourceWriter stores every record with source, for imports whose
+// records name their own source, like ClamAV databases.
+type sourceWriter struct {
+	recordWriter
+	source string
+}
+
+func (w sourceWriter) Write(file ScannedFiles) error {
+	file.Source = w.source
+	return w.recordWriter.Write(file)
+}
+
+func countLines(r io.Reader) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+	count := 0
+	for scanner.Scan() {
+		if strings.TrimSpace(scanner.Text()) != "" {
+			count++
+		}
+	}
+	return count, scanner.Err()
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var hdb = testMD5 + ":68:Win.Test.EICAR_HDB-1\n" +
+	"# comment\n" +
+	testSHA256 + ":*:Unix.Trojan.Mirai-9999-0\n" +
+	"\n" +
+	testMD5 + ":68\n" +
+	"abc:68:Win.Trojan.Short-1-0\n" +
+	testSHA1 + ":big:Win.Trojan.Size-1-0\n"
+
+func TestReadClamAVDatabase(t *testing.T) {
+	var got records
+	if err := readClamAVDatabase("main.hdb", strings.NewReader(hdb), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []ScannedFiles{
+		{MD5: testMD5, Size: sizeOf(68), Source: "clamav:main.hdb", ThreatLabel: "Win.Test.EICAR_HDB-1", Family: "EICAR_HDB"},
+		// Sizes of * match files of any size.
+		{SHA256: testSHA256, Source: "clamav:main.hdb", ThreatLabel: "Unix.Trojan.Mirai-9999-0", Family: "Mirai"},
+	}
+	if !reflect.DeepEqual(got.files, want) {
+		t.Errorf("records = %+v, want %+v", got.files, want)
+	}
+	wantRejected := []string{"main.hdb line 5", "main.hdb line 6", "main.hdb line 7"}
+	if !reflect.DeepEqual(got.rejected, wantRejected) {
+		t.Errorf("rejected %v, want %v", got.rejected, wantRejected)
+	}
+
+	// PE section signatures are skipped without rejecting them.
+	got = records{}
+	if err := readClamAVDatabase("main.mdb", strings.NewReader("68:"+testMD5+":Win.Trojan.Section-1-0\n"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.files) != 0 || len(got.rejected) != 0 {
+		t.Errorf("PE section signatures were read as %+v and rejected as %v", got.files, got.rejected)
+	}
+}
+
+func TestClamAVFamily(t *testing.T) {
+	tests := map[string]string{
+		"Win.Trojan.Emotet-6999845-0": "Emotet",
+		"Unix.Malware.Agent":          "Agent",
+		"Eicar-Signature":             "",
+		"Win.Trojan.Emotet":           "Emotet",
+	}
+	for signature, want := range tests {
+		if got := clamAVFamily(signature); got != want {
+			t.Errorf("clamAVFamily(%q) = %q, want %q", signature, got, want)
+		}
+	}
+}
+
+// cvd packs members into a container with a ClamAV-VDB header and a tar
+// archive, gzip compressed when compress is set.
+func cvd(t *testing.T, compress bool, members map[string]string) []byte {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	for name, content := range members {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header := []byte("ClamAV-VDB:01 Jan 2024 00-00 +0000:1:2:90:0:sigtool:0")
+	data := append(header, bytes.Repeat([]byte(" "), cvdHeaderSize-len(header))...)
+	if !compress {
+		return append(data, archive.Bytes()...)
+	}
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	gz.Write(archive.Bytes())
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return append(data, compressed.Bytes()...)
+}
+
+func TestReadClamAVContainer(t *testing.T) {
+	members := map[string]string{
+		"main.hdb":  testMD5 + ":68:Win.Test.EICAR_HDB-1\n",
+		"main.hsb":  testSHA256 + ":*:Unix.Trojan.Mirai-9999-0\n",
+		"main.mdb":  "68:" + testMD5 + ":Win.Trojan.Section-1-0\n",
+		"main.info": "not a database\n",
+	}
+	for _, compress := range []bool{true, false} {
+		var got records
+		if err := readClamAVContainer("main.cvd", bytes.NewReader(cvd(t, compress, members)), &got); err != nil {
+			t.Fatalf("compressed %v: %v", compress, err)
+		}
+		sources := map[string]bool{}
+		for _, file := range got.files {
+			sources[file.Source] = true
+		}
+		want := map[string]bool{"clamav:main.cvd/main.hdb": true, "clamav:main.cvd/main.hsb": true}
+		if len(got.files) != 2 || !reflect.DeepEqual(sources, want) || len(got.rejected) != 0 {
+			t.Errorf("compressed %v: records %+v, rejected %v, want one of main.hdb and main.hsb each", compress, got.files, got.rejected)
+		}
+	}
+
+	for name, data := range map[string][]byte{
+		"short header":   []byte("ClamAV-VDB:"),
+		"no header":      bytes.Repeat([]byte(" "), cvdHeaderSize+10),
+		"corrupted gzip": append(cvd(t, false, nil)[:cvdHeaderSize], 0x1f, 0x8b, 0),
+	} {
+		var got records
+		if err := readClamAVContainer("main.cvd", bytes.NewReader(data), &got); err == nil {
+			t.Errorf("%s: read %+v, want an error", name, got.files)
+		}
+	}
+}
+
+func TestReadClamAV(t *testing.T) {
+	dir := t.TempDir()
+	files := map[string]string{
+		"daily.hdb":  hdb,
+		"daily.msb":  "68:" + testSHA256 + ":Win.Trojan.Section-1-0\n",
+		"daily.info": "not a database\n",
+	}
+	for name, content := range files {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0o644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A directory unpacked with sigtool reads every database in it.
+	var got records
+	if err := readClamAV(dir, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.files) != 2 || len(got.rejected) != 3 {
+		t.Errorf("read %d records and rejected %d, want 2 and 3", len(got.files), len(got.rejected))
+	}
+
+	// --source replaces the database names.
+	got = records{}
+	if err := readClamAV(filepath.Join(dir, "daily.hdb"), sourceWriter{&got, "clamav-2024-01"}); err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range got.files {
+		if file.Source != "clamav-2024-01" {
+			t.Errorf("source %q, want clamav-2024-01", file.Source)
+		}
+	}
+
+	if err := readClamAV(filepath.Join(dir, "daily.info"), &got); err == nil {
+		t.Error("reading daily.info succeeded, want an error")
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+
+	"common/migrations"
+	"common/store"
+	"common/views"
+
+	"github.com/joho/godotenv"
+	_ "github.com/lib/pq"
+)
+
+type dbOptions struct {
+	envPath  string
+	host     string
+	port     int
+	name     string
+	schema   string
+	user     string
+	password string
+	dryRun   bool
+}
+
+func addDBFlags(fs *flag.FlagSet) *dbOptions {
+	opts := &dbOptions{}
+	fs.StringVar(&opts.envPath, "env", "", "environment file with DB_* settings (default /home/<user>/.sys-check/.env/upload_data.env)")
+	fs.StringVar(&opts.host, "db-host", "", "database host, overrides DB_HOST")
+	fs.IntVar(&opts.port, "db-port", 0, "database port, overrides DB_PORT")
+	fs.StringVar(&opts.name, "db-name", "", "database name, overrides DB_NAME")
+	fs.StringVar(&opts.schema, "db-schema", "", "database schema, overrides DB_SCHEMA")
+	fs.StringVar(&opts.user, "db-user", "", "database user, overrides DB_USER")
+	fs.StringVar(&opts.password, "db-password", "", "database password, overrides DB_PASSWORD")
+	fs.BoolVar(&opts.dryRun, "dry-run", false, "run every change inside a transaction and roll it back")
+	return opts
+}
+
+func (opts *dbOptions) loadEnv() error {
+	envPath := opts.envPath
+	if envPath == "" {
+		currentUser, err := user.Current()
+		if err != nil {
+			return fmt.Errorf("failed to get the current user: %v", err)
+		}
+		envPath = fmt.Sprintf("/home/%s/.sys-check/.env/upload_data.env", currentUser.Username)
+		if _, err := os.Stat(envPath); errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+	}
+
+	err := godotenv.Load(envPath)
+	if err != nil {
+		return fmt.Errorf("error loading .env file %s: %v", envPath, err)
+	}
+	return nil
+}
+
+// connInfo returns the connection string and the schema the tables live in.
+func (opts *dbOptions) connInfo() (string, string, error) {
+	if err := opts.loadEnv(); err != nil {
+		return "", "", err
+	}
+
+	host := firstNonEmpty(opts.host, os.Getenv("DB_HOST"))
+	dbName := firstNonEmpty(opts.name, os.Getenv("DB_NAME"))
+	dbSchema := firstNonEmpty(opts.schema, os.Getenv("DB_SCHEMA"))
+	user := firstNonEmpty(opts.user, os.Getenv("DB_USER"))
+	password := firstNonEmpty(opts.password, os.Getenv("DB_PASSWORD"))
+
+	port := opts.port
+	if port == 0 && os.Getenv("DB_PORT") != "" {
+		var err error
+		port, err = strconv.Atoi(os.Getenv("DB_PORT"))
+		if err != nil {
+			return "", "", fmt.Errorf("invalid DB_PORT %q: %v", os.Getenv("DB_PORT"), err)
+		}
+	}
+	if port == 0 {
+		port = 5432
+	}
+
+	if host == "" || dbName == "" || user == "" {
+		return "", "", fmt.Errorf("database host, name and user must be set with flags or DB_HOST, DB_NAME and DB_USER")
+	}
+	if dbSchema == "" {
+		dbSchema = dbName
+	}
+
+	return fmt.Sprintf("host=%s port=%d dbname=%s search_path=%s user=%s password=%s sslmode=disable",
+		host, port, dbName, dbSchema, user, password), dbSchema, nil
+}
+
+// open connects to the database and refuses to use it unless its schema is
+// the version this program was built for.
+func (opts *dbOptions) open() (*sql.DB, error) {
+	db, _, err := opts.connect()
+	if err != nil {
+		return nil, err
+	}
+	if err := migrations.Check(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// openStore opens the known hash store selected by KNOWN_HASH_STORE.
+func (opts *dbOptions) openStore() (store.KnownHashStore, error) {
+	cfg, err := opts.storeConfig()
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Backend == store.BackendBolt {
+		return store.OpenBolt(cfg.Path)
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return nil, err
+	}
+	return store.NewPostgres(db), nil
+}
+
+func (opts *dbOptions) storeConfig() (store.Config, error) {
+	if err := opts.loadEnv(); err != nil {
+		return store.Config{}, err
+	}
+	return store.ConfigFromEnv()
+}
+
+// connect connects to the PostgreSQL database. Commands working on tables
+// other than files refuse to run with any other store.
+func (opts *dbOptions) connect() (*sql.DB, string, error) {
+	cfg, err := opts.storeConfig()
+	if err != nil {
+		return nil, "", err
+	}
+	if cfg.Backend != store.BackendPostgres {
+		return nil, "", fmt.Errorf("%w, KNOWN_HASH_STORE is %s", store.ErrUnsupported, cfg.Backend)
+	}
+
+	psqlInfo, schema, err := opts.connInfo()
+	if err != nil {
+		return nil, "", err
+	}
+
+	db, err := sql.Open("postgres", psqlInfo)
+	if err != nil {
+		return nil, "", err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, "", fmt.Errorf("failed to connect to database: %v", err)
+	}
+	return db, schema, nil
+}
+
+// finish commits tx, or rolls it back when running with -dry-run. Once the
+// changes are committed the materialized views are refreshed, at most once
+// per VIEW_REFRESH_INTERVAL.
+func (opts *dbOptions) finish(db *sql.DB, tx *sql.Tx) error {
+	if opts.dryRun {
+		fmt.Fprintln(os.Stderr, "dry run: changes rolled back")
+		return tx.Rollback()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	// The changes are committed, so failing to refresh is only a warning.
+	interval, err := views.Interval()
+	if err == nil {
+		err = views.Request(db)
+	}
+	var refreshed []string
+	if err == nil {
+		refreshed, err = views.RefreshPending(db, interval)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	} else if len(refreshed) > 0 {
+		fmt.Fprintln(os.Stderr, "Refreshed views:", strings.Join(refreshed, ", "))
+	}
+	return nil
+}
+
+// finishStore commits tx, or rolls it back when running with -dry-run. Once
+// the changes are committed, stores with derived data refresh it at most
+// once per VIEW_REFRESH_INTERVAL.
+func (opts *dbOptions) finishStore(st store.KnownHashStore, tx store.Tx) error {
+	if opts.dryRun {
+		fmt.Fprintln(os.Stderr, "dry run: changes rolled back")
+		return tx.Rollback()
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	refresher, ok := st.(store.Refresher)
+	if !ok {
+		return nil
+	}
+	// The changes are committed, so failing to refresh is only a warning.
+	interval, err := views.Interval()
+	var refreshed []string
+	if err == nil {
+		refreshed, err = refresher.Refresh(context.Background(), interval)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning:", err)
+	} else if len(refreshed) > 0 {
+		fmt.Fprintln(os.Stderr, "Refreshed views:", strings.Join(refreshed, ", "))
+	}
+	return nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// currentUsername names the actor of changes in the status history.
+func currentUsername() string {
+	currentUser, err := user.Current()
+	if err != nil {
+		return "unknown"
+	}
+	return currentUser.Username
+}
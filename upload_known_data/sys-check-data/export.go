@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bufio"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"common/store"
+)
+
+func runExport(args []string) error {
+	fs := newFlagSet("export")
+	opts := addDBFlags(fs)
+	status := fs.String("status", "", "only export files with this status")
+	output := fs.String("output", "", "write to this file instead of standard output")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageErrorf("unexpected arguments %v", positional)
+	}
+	if *status != "" && !validStatus(*status) {
+		return usageErrorf("unknown status %q", *status)
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+
+	count, err := exportFiles(db, *status, writer)
+	if err != nil {
+		return err
+	}
+	if err := writer.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported %d files\n", count)
+	return nil
+}
+
+func exportFiles(db *sql.DB, status string, w io.Writer) (int, error) {
+	rows, err := db.Query(`
+		SELECT `+fileColumns+`
+		FROM files f
+		WHERE ($1 = '' OR f.status = $1) AND f.merged_into IS NULL
+		ORDER BY f.id;
+	`, status)
+	if err != nil {
+		return 0, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	if _, err := io.WriteString(w, "[\n"); err != nil {
+		return 0, err
+	}
+	count := 0
+	for rows.Next() {
+		file, err := scanFile(rows)
+		if err != nil {
+			return count, err
+		}
+		data, err := json.Marshal(file)
+		if err != nil {
+			return count, err
+		}
+		if count > 0 {
+			io.WriteString(w, ",\n")
+		}
+		io.WriteString(w, "  ")
+		if _, err := w.Write(data); err != nil {
+			return count, err
+		}
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return count, err
+	}
+	_, err = io.WriteString(w, "\n]\n")
+	return count, err
+}
+
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// fileColumns selects the columns read by scanFile from files f.
+const fileColumns = `encode(f.md5, 'hex'), encode(f.sha1, 'hex'), encode(f.sha256, 'hex'), encode(f.sha512, 'hex'),
+	` + store.OtherDigests + `, f.filesize,
+	(SELECT string_agg(p.filepath, E'\n' ORDER BY p.added_at, p.filepath) FROM file_paths p WHERE p.file_id = f.id),
+	f.status, f.family, f.source, f.first_seen, f.threat_label`
+
+// scanFile reads a row of fileColumns.
+func scanFile(row rowScanner) (ScannedFiles, error) {
+	var file ScannedFiles
+	var md5, sha1, sha256, sha512, others, paths, family, source, threatLabel sql.NullString
+	var size sql.NullInt64
+	var firstSeen sql.NullTime
+	err := row.Scan(&md5, &sha1, &sha256, &sha512, &others, &size, &paths, &file.FileStatus, &family, &source, &firstSeen, &threatLabel)
+	if err != nil {
+		return file, fmt.Errorf("error checking query results: %v", err)
+	}
+	file.MD5 = md5.String
+	file.SHA1 = sha1.String
+	file.SHA256 = sha256.String
+	file.SHA512 = sha512.String
+	file.Hashes = store.ParseOtherDigests(others.String)
+	if paths.String != "" {
+		file.Paths = strings.Split(paths.String, "\n")
+		file.Path = file.Paths[0]
+		if len(file.Paths) == 1 {
+			file.Paths = nil
+		}
+	}
+	file.Family = family.String
+	file.Source = source.String
+	file.ThreatLabel = threatLabel.String
+	if firstSeen.Valid {
+		file.FirstSeen = &firstSeen.Time
+	}
+	if size.Valid {
+		file.Size = &size.Int64
+	}
+	return file, nil
+}
+
+// fromStore converts a file read from the known hash store.
+func fromStore(f store.File) ScannedFiles {
+	file := ScannedFiles{
+		Size:        f.Size,
+		MD5:         f.MD5,
+		SHA1:        f.SHA1,
+		SHA256:      f.SHA256,
+		SHA512:      f.SHA512,
+		Hashes:      f.Other,
+		FileStatus:  f.Status,
+		Family:      f.Family,
+		Source:      f.Source,
+		FirstSeen:   f.FirstSeen,
+		ThreatLabel: f.ThreatLabel,
+	}
+	if len(f.Paths) > 0 {
+		file.Path = f.Paths[0]
+	}
+	if len(f.Paths) > 1 {
+		file.Paths = f.Paths
+	}
+	return file
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"common/hashes"
+	"common/history"
+	"common/store"
+)
+
+type recordWriter interface {
+	Write(file ScannedFiles) error
+	Reject(location string, reason error)
+}
+
+type recordReader func(r io.Reader, w recordWriter) error
+
+// recordSource reads every record found at a data file or directory path.
+type recordSource func(path string, w recordWriter) error
+
+var importFormats = map[string]recordSource{
+	"nsrl":     fromFile(readNSRL),
+	"json":     fromFile(readJSON),
+	"csv":      fromFile(readCSV),
+	"hashlist": fromFile(readHashList),
+	"clamav":   readClamAV,
+}
+
+func fromFile(reader recordReader) recordSource {
+	return func(path string, w recordWriter) error {
+		file, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		return reader(bufio.NewReaderSize(file, 1<<20), w)
+	}
+}
+
+func runImport(args []string) error {
+	if len(args) < 1 {
+		return usageErrorf("missing import format")
+	}
+	format := args[0]
+	reader, ok := importFormats[format]
+	if !ok {
+		return usageErrorf("unknown import format %q", format)
+	}
+
+	fs := newFlagSet("import " + format)
+	opts := addDBFlags(fs)
+	status := fs.String("status", "", "status given to the imported files: verified or malicious (default verified for nsrl)")
+	source := fs.String("source", "", "feed name stored with every imported file (default the data file name, clamav:<database> for ClamAV)")
+	family := fs.String("family", "", "malware family stored with files that do not name one")
+	firstSeen := fs.String("first-seen", "", "first seen date stored with files that do not have one (default now)")
+	positional, err := parseArgs(fs, args[1:])
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("expected exactly one data file")
+	}
+	if *status == "" && format == "nsrl" {
+		*status = "verified"
+	}
+	if *status == "" && format == "clamav" {
+		*status = "malicious"
+	}
+	if !validStatus(*status, "verified", "malicious") {
+		return usageErrorf("--status must be verified or malicious")
+	}
+	if format == "clamav" && *status != "malicious" {
+		return usageErrorf("ClamAV signatures can only be imported as malicious")
+	}
+	defaults := ScannedFiles{Source: *source, Family: *family}
+	if defaults.Source == "" {
+		defaults.Source = filepath.Base(positional[0])
+	}
+	defaults.FirstSeen, err = parseTime(*firstSeen)
+	if err != nil {
+		return usageErrorf("--first-seen: %v", err)
+	}
+
+	if _, err := os.Stat(positional[0]); err != nil {
+		return err
+	}
+
+	st, err := opts.openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	tx, err := st.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	importID := history.NewImportID()
+	reason := fmt.Sprintf("%s import of %s", format, filepath.Base(positional[0]))
+	uploader := newUploader(tx, *status, defaults, history.ImportSource(importID), reason)
+
+	var w recordWriter = uploader
+	if format == "clamav" && *source != "" {
+		w = sourceWriter{recordWriter: uploader, source: *source}
+	}
+
+	fmt.Fprintln(os.Stderr, "Reading data from file...")
+	err = reader(positional[0], w)
+	if err != nil {
+		return fmt.Errorf("import aborted after %d records: %v", uploader.inserted+uploader.flagged+uploader.existing, err)
+	}
+	if err := opts.finishStore(st, tx); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "\rImported %d new files as %s, %d known files made malicious, %d already known, %d rejected (import ID %s)\n",
+		uploader.inserted, *status, uploader.flagged, uploader.existing, uploader.rejected, importID)
+	if uploader.rejected > 0 {
+		return fmt.Errorf("%d records were rejected", uploader.rejected)
+	}
+	return nil
+}
+
+type uploader struct {
+	tx       store.Tx
+	status   string
+	defaults ScannedFiles
+	inserted int
+	flagged  int
+	existing int
+	rejected int
+
+	// Status history of every inserted or flagged file.
+	change store.Change
+}
+
+// newUploader stores every record in tx. Source, Family and FirstSeen of
+// defaults fill in records that do not carry their own. Known files get
+// the paths, hashes and size they are missing, and a malicious status
+// makes them malicious with the source, family and threat label of the
+// record. Every inserted or flagged file is recorded in the status
+// history under historySource.
+func newUploader(tx store.Tx, status string, defaults ScannedFiles, historySource, reason string) *uploader {
+	return &uploader{
+		tx:       tx,
+		status:   status,
+		defaults: defaults,
+		change:   store.Change{Actor: currentUsername(), Source: historySource, Reason: reason},
+	}
+}
+
+func (u *uploader) Write(file ScannedFiles) error {
+	if file.Source == "" {
+		file.Source = u.defaults.Source
+	}
+	if file.Family == "" {
+		file.Family = u.defaults.Family
+	}
+	if file.FirstSeen == nil {
+		file.FirstSeen = u.defaults.FirstSeen
+	}
+	if err := file.validate(u.status == "malicious"); err != nil {
+		u.Reject(file.Path, err)
+		return nil
+	}
+
+	outcome, err := u.tx.Upsert(context.Background(), store.File{
+		MD5:         file.MD5,
+		SHA1:        file.SHA1,
+		SHA256:      file.SHA256,
+		SHA512:      file.SHA512,
+		Other:       file.Hashes,
+		Size:        file.Size,
+		Paths:       file.knownPaths(),
+		Status:      u.status,
+		Family:      file.Family,
+		Source:      file.Source,
+		FirstSeen:   file.FirstSeen,
+		ThreatLabel: file.ThreatLabel,
+	}, u.change)
+	if err != nil {
+		return fmt.Errorf("failed to insert new file data into files table: %v", err)
+	}
+	switch outcome {
+	case store.Inserted:
+		u.inserted++
+	case store.Flagged:
+		u.flagged++
+	default:
+		u.existing++
+	}
+
+	if total := u.inserted + u.flagged + u.existing; total%10000 == 0 {
+		fmt.Fprintf(os.Stderr, "\rProgress: %d", total)
+	}
+	return nil
+}
+
+func (u *uploader) Reject(location string, reason error) {
+	u.rejected++
+	fmt.Fprintf(os.Stderr, "\rrejected %s: %v\n", location, reason)
+}
+
+func readNSRL(r io.Reader, w recordWriter) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1<<20)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		if line == 1 || strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		location := fmt.Sprintf("line %d", line)
+
+		row := strings.Split(scanner.Text(), "\t")
+		if len(row) < 4 {
+			w.Reject(location, fmt.Errorf("expected 4 tab separated columns, got %d", len(row)))
+			continue
+		}
+		size, err := parseSize(row[2])
+		if err != nil {
+			w.Reject(location, err)
+			continue
+		}
+		err = w.Write(ScannedFiles{SHA1: row[1], Size: size, Path: row[3]})
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func readJSON(r io.Reader, w recordWriter) error {
+	decoder := json.NewDecoder(r)
+	token, err := decoder.Token()
+	if err != nil {
+		return fmt.Errorf("error decoding JSON: %v", err)
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("error decoding JSON: expected an array of files")
+	}
+
+	for i := 0; decoder.More(); i++ {
+		var file ScannedFiles
+		if err := decoder.Decode(&file); err != nil {
+			return fmt.Errorf("error decoding JSON element %d: %v", i, err)
+		}
+		if err := w.Write(file); err != nil {
+			return err
+		}
+	}
+	_, err = decoder.Token()
+	return err
+}
+
+// csvColumns maps the header names used by common threat intelligence
+// feeds to record fields.
+var csvColumns = map[string]string{
+	"path":           "path",
+	"filepath":       "path",
+	"name":           "name",
+	"filename":       "name",
+	"file_name":      "name",
+	"size":           "size",
+	"filesize":       "size",
+	"file_size":      "size",
+	"hash":           "hash",
+	"md5":            "md5",
+	"md5_hash":       "md5",
+	"sha1":           "sha1",
+	"sha1_hash":      "sha1",
+	"sha256":         "sha256",
+	"sha256_hash":    "sha256",
+	"sha512":         "sha512",
+	"sha512_hash":    "sha512",
+	"blake3":         "blake3",
+	"ssdeep":         "ssdeep",
+	"tlsh":           "tlsh",
+	"family":         "family",
+	"malware_family": "family",
+	"signature":      "family",
+	"source":         "source",
+	"feed":           "source",
+	"first_seen":     "first_seen",
+	"firstseen":      "first_seen",
+	"first_seen_utc": "first_seen",
+}
+
+// readCSV reads comma separated data with a header row naming the
+// columns, see csvColumns. A hash column holds MD5, SHA1, SHA256 or
+// SHA512 digests, the algorithm is detected from the hash length. A name
+// column is used as the path when there is no path column.
+func readCSV(r io.Reader, w recordWriter) error {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	reader.ReuseRecord = true
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("error reading CSV header: %v", err)
+	}
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		name = strings.ReplaceAll(name, " ", "_")
+		if field, ok := csvColumns[name]; ok {
+			if _, seen := columns[field]; !seen {
+				columns[field] = i
+			}
+		}
+	}
+	hasHash := false
+	for _, field := range []string{"hash", "md5", "sha1", "sha256", "sha512", "blake3", "ssdeep", "tlsh"} {
+		if _, ok := columns[field]; ok {
+			hasHash = true
+		}
+	}
+	if !hasHash {
+		return fmt.Errorf("CSV header has no hash, md5, sha1, sha256, sha512, blake3, ssdeep or tlsh column")
+	}
+
+	for {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("error reading CSV: %v", err)
+		}
+		line, _ := reader.FieldPos(0)
+		location := fmt.Sprintf("line %d", line)
+
+		field := func(name string) string {
+			i, ok := columns[name]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+
+		size, err := parseSize(field("size"))
+		if err != nil {
+			w.Reject(location, err)
+			continue
+		}
+		firstSeen, err := parseTime(field("first_seen"))
+		if err != nil {
+			w.Reject(location, err)
+			continue
+		}
+		file := ScannedFiles{
+			Path:      firstNonEmpty(field("path"), field("name")),
+			Size:      size,
+			MD5:       field("md5"),
+			SHA1:      field("sha1"),
+			SHA256:    field("sha256"),
+			SHA512:    field("sha512"),
+			Family:    field("family"),
+			Source:    field("source"),
+			FirstSeen: firstSeen,
+		}
+		for _, algorithm := range []string{hashes.BLAKE3, hashes.SSDEEP, hashes.TLSH} {
+			if digest := field(strings.ToLower(algorithm)); digest != "" {
+				if file.Hashes == nil {
+					file.Hashes = make(map[string]string)
+				}
+				file.Hashes[algorithm] = digest
+			}
+		}
+		if hash := field("hash"); hash != "" {
+			if err := file.setHash(hash); err != nil {
+				w.Reject(location, err)
+				continue
+			}
+		}
+		if err := w.Write(file); err != nil {
+			return err
+		}
+	}
+}
+
+// readHashList reads one bare hash per line; the algorithm is detected
+// from the hash length. Empty lines and lines starting with # are skipped,
+// as is anything after the hash on a line.
+func readHashList(r io.Reader, w recordWriter) error {
+	scanner := bufio.NewScanner(r)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields := strings.FieldsFunc(scanner.Text(), func(c rune) bool {
+			return unicode.IsSpace(c) || c == ',' || c == ';'
+		})
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+
+		var file ScannedFiles
+		if err := file.setHash(fields[0]); err != nil {
+			w.Reject(fmt.Sprintf("line %d", line), err)
+			continue
+		}
+		if err := w.Write(file); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func parseSize(value string) (*int64, error) {
+	if value == "" {
+		return nil, nil
+	}
+	size, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid file size %q", value)
+	}
+	return &size, nil
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// records collects what a reader writes, and the locations it rejects.
+type records struct {
+	files    []ScannedFiles
+	rejected []string
+}
+
+func (r *records) Write(file ScannedFiles) error {
+	r.files = append(r.files, file)
+	return nil
+}
+
+func (r *records) Reject(location string, reason error) {
+	r.rejected = append(r.rejected, location)
+}
+
+func sizeOf(n int64) *int64 {
+	return &n
+}
+
+const (
+	testMD5    = "44d88612fea8a8f36de82e1278abb02f"
+	testSHA1   = "3395856ce81f2b7382dee72602f798b642f14140"
+	testSHA256 = "275a021bbfb6489e54d471899f7db9d1663fc695ec2fe2a2c4538aabf651fd0f"
+)
+
+var testSHA512 = strings.Repeat("ab", 64)
+
+func TestReadCSV(t *testing.T) {
+	input := `# exported by the feed
+SHA256_Hash, File Name, File Size, Malware Family, First Seen UTC, Feed, Unknown
+` + testSHA256 + `, eicar.com, 68, EICAR, 2023-04-01 12:30:00, malwarebazaar, x
+` + strings.ToUpper(testSHA256) + `, , , , 2023-04-01, ,
+` + testSHA256 + `, big.bin, large, , , ,
+` + testSHA256 + `, old.bin, , , yesterday, ,
+`
+	var got records
+	if err := readCSV(strings.NewReader(input), &got); err != nil {
+		t.Fatal(err)
+	}
+	firstSeen := time.Date(2023, 4, 1, 12, 30, 0, 0, time.UTC)
+	day := time.Date(2023, 4, 1, 0, 0, 0, 0, time.UTC)
+	want := []ScannedFiles{
+		{Path: "eicar.com", Size: sizeOf(68), SHA256: testSHA256, Family: "EICAR", Source: "malwarebazaar", FirstSeen: &firstSeen},
+		{SHA256: strings.ToUpper(testSHA256), FirstSeen: &day},
+	}
+	if !reflect.DeepEqual(got.files, want) {
+		t.Errorf("records = %+v, want %+v", got.files, want)
+	}
+	// Line numbers include the comment line.
+	if wantRejected := []string{"line 5", "line 6"}; !reflect.DeepEqual(got.rejected, wantRejected) {
+		t.Errorf("rejected %v, want %v", got.rejected, wantRejected)
+	}
+}
+
+func TestReadCSVHashColumn(t *testing.T) {
+	input := "filepath,filename,hash,tlsh\n" +
+		"/bin/a,a," + testMD5 + ",\n" +
+		",b," + testSHA1 + ",\n" +
+		"/bin/c,c," + testSHA256 + ",\n" +
+		"/bin/d,d," + testSHA512 + ",\n" +
+		"/bin/e,e,abc,\n" +
+		"/bin/f,f,,T1" + strings.Repeat("00", 35) + "\n"
+	var got records
+	if err := readCSV(strings.NewReader(input), &got); err != nil {
+		t.Fatal(err)
+	}
+	// The path column wins over the name column.
+	want := []ScannedFiles{
+		{Path: "/bin/a", MD5: testMD5},
+		{Path: "b", SHA1: testSHA1},
+		{Path: "/bin/c", SHA256: testSHA256},
+		{Path: "/bin/d", SHA512: testSHA512},
+		{Path: "/bin/f", Hashes: map[string]string{"TLSH": "T1" + strings.Repeat("00", 35)}},
+	}
+	if !reflect.DeepEqual(got.files, want) {
+		t.Errorf("records = %+v, want %+v", got.files, want)
+	}
+	if wantRejected := []string{"line 6"}; !reflect.DeepEqual(got.rejected, wantRejected) {
+		t.Errorf("rejected %v, want %v", got.rejected, wantRejected)
+	}
+}
+
+func TestReadCSVHeader(t *testing.T) {
+	for _, input := range []string{"", "name,size,family\nls,10,\n"} {
+		var got records
+		if err := readCSV(strings.NewReader(input), &got); err == nil {
+			t.Errorf("readCSV(%q) succeeded, want an error", input)
+		}
+	}
+	// The first of two columns for the same field is used.
+	var got records
+	if err := readCSV(strings.NewReader("md5,md5_hash\n"+testMD5+",other\n"), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got.files) != 1 || got.files[0].MD5 != testMD5 {
+		t.Errorf("records = %+v, want MD5 %s", got.files, testMD5)
+	}
+}
+
+func TestReadHashList(t *testing.T) {
+	input := "# IOC list\n" +
+		testMD5 + "\n" +
+		"\n" +
+		"  " + testSHA1 + " first seen today\n" +
+		testSHA256 + ";" + testMD5 + "\n" +
+		testSHA512 + ",\n" +
+		"not-a-hash\n" +
+		"#" + testMD5 + "\n" +
+		"abc123\n"
+	var got records
+	if err := readHashList(strings.NewReader(input), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := []ScannedFiles{
+		{MD5: testMD5},
+		{SHA1: testSHA1},
+		{SHA256: testSHA256},
+		{SHA512: testSHA512},
+	}
+	if !reflect.DeepEqual(got.files, want) {
+		t.Errorf("records = %+v, want %+v", got.files, want)
+	}
+	if wantRejected := []string{"line 7", "line 9"}; !reflect.DeepEqual(got.rejected, wantRejected) {
+		t.Errorf("rejected %v, want %v", got.rejected, wantRejected)
+	}
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"common/hashes"
+	"common/history"
+	"common/store"
+)
+
+func runStats(args []string) error {
+	fs := newFlagSet("stats")
+	opts := addDBFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageErrorf("unexpected arguments %v", positional)
+	}
+
+	st, err := opts.openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	counts, err := st.Stats(context.Background())
+	if err != nil {
+		return err
+	}
+	statuses := make([]string, 0, len(counts))
+	for status := range counts {
+		statuses = append(statuses, status)
+	}
+	sort.Strings(statuses)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "STATUS\tFILES")
+	var total int64
+	for _, status := range statuses {
+		fmt.Fprintf(w, "%s\t%d\n", status, counts[status])
+		total += counts[status]
+	}
+	fmt.Fprintf(w, "total\t%d\n", total)
+	return w.Flush()
+}
+
+func runLookup(args []string) error {
+	fs := newFlagSet("lookup")
+	opts := addDBFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("expected exactly one hash")
+	}
+	hash := positional[0]
+	column, err := hashes.Column(hash)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	lookup, err := store.ParseHash(hash)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+
+	st, err := opts.openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	matches, err := st.Lookup(context.Background(), lookup)
+	if err != nil {
+		return err
+	}
+	if len(matches) == 0 {
+		return fmt.Errorf("%s %s is not known", strings.ToUpper(column), hash)
+	}
+	files := make([]ScannedFiles, len(matches))
+	for i, match := range matches {
+		files[i] = fromStore(match)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(files)
+}
+
+func runHistory(args []string) error {
+	fs := newFlagSet("history")
+	opts := addDBFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 {
+		return usageErrorf("expected exactly one hash")
+	}
+	hash := positional[0]
+	column, err := hashes.Column(hash)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	lineage, err := history.Lineage(db, hash)
+	if err != nil {
+		return err
+	}
+	if len(lineage) == 0 {
+		return fmt.Errorf("%s %s is not known", strings.ToUpper(column), hash)
+	}
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(lineage)
+}
+
+func runSetStatus(args []string) error {
+	fs := newFlagSet("set-status")
+	opts := addDBFlags(fs)
+	comment := fs.String("comment", "", "reason for the change, stored in the status history")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageErrorf("expected a hash and a status")
+	}
+	hash, status := positional[0], positional[1]
+	column, err := hashes.Column(hash)
+	if err != nil {
+		return usageErrorf("%v", err)
+	}
+	if !validStatus(status) {
+		return usageErrorf("status must be one of %s", strings.Join(fileStatuses, ", "))
+	}
+
+	st, err := opts.openStore()
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+
+	tx, err := st.Begin(context.Background())
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	affected, err := tx.SetStatus(context.Background(), hash, status, store.Change{
+		Actor:  currentUsername(),
+		Source: history.Manual,
+		Reason: *comment,
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return fmt.Errorf("%s %s is not known", strings.ToUpper(column), hash)
+	}
+	if err != nil {
+		return err
+	}
+	if err := opts.finishStore(st, tx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Set status of %d files to %s\n", affected, status)
+	return nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"os"
+
+	"common/migrations"
+)
+
+func runMigrate(args []string) error {
+	fs := newFlagSet("migrate")
+	opts := addDBFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || (positional[0] != "up" && positional[0] != "status") {
+		return usageErrorf("expected up or status")
+	}
+
+	db, schema, err := opts.connect()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if positional[0] == "up" {
+		if opts.dryRun {
+			return usageErrorf("-dry-run is not supported by migrate up")
+		}
+		return migrations.PrintUp(os.Stdout, db, schema)
+	}
+	return migrations.PrintStatus(os.Stdout, db)
+}
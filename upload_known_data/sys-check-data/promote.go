@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"common/history"
+
+	"github.com/lib/pq"
+)
+
+const promotionReasonPrevalence = "prevalence"
+
+type promotionCandidate struct {
+	fileID   int64
+	sha256   string
+	filepath string
+	hosts    int
+	scans    int
+}
+
+// prevalentCandidates selects candidates seen at the same path on at least
+// minHosts hosts across at least minScans scans, where no host ever had a
+// malicious file at that path, and that were never similar to a malicious
+// file.
+const prevalentCandidates = `
+	SELECT DISTINCT ON (p.file_id) p.file_id, COALESCE(encode(f.sha256, 'hex'), ''), p.filepath, p.hosts, p.scans
+	FROM (
+		SELECT s.file_id, s.filepath, COUNT(DISTINCT s.host) AS hosts, COUNT(DISTINCT s.scan_id) AS scans
+		FROM file_sightings s
+		JOIN files c ON c.id = s.file_id AND c.status = 'candidate'
+		GROUP BY s.file_id, s.filepath
+		HAVING COUNT(DISTINCT s.host) >= $1 AND COUNT(DISTINCT s.scan_id) >= $2
+	) p
+	JOIN files f ON f.id = p.file_id
+	WHERE NOT EXISTS (
+		SELECT 1
+		FROM file_sightings ms
+		JOIN files m ON m.id = ms.file_id AND m.status = 'malicious'
+		WHERE ms.filepath = p.filepath
+	) AND NOT EXISTS (
+		SELECT 1
+		FROM file_sightings ss
+		WHERE ss.file_id = p.file_id AND ss.similar_to IS NOT NULL
+	)
+	ORDER BY p.file_id, p.hosts DESC, p.scans DESC;
+`
+
+func runPromote(args []string) error {
+	fs := newFlagSet("promote")
+	opts := addDBFlags(fs)
+	minHosts := fs.Int("min-hosts", 0, "distinct hosts that must have the file at the same path (default PROMOTE_MIN_HOSTS or 5)")
+	minScans := fs.Int("min-scans", 0, "distinct scans that must have seen the file (default PROMOTE_MIN_SCANS or 5)")
+	exclude := fs.String("exclude", "", "comma separated path prefixes that are never promoted (default PROMOTE_EXCLUDE)")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageErrorf("unexpected arguments %v", positional)
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	// The environment file is loaded by open, so defaults are resolved after it.
+	if *minHosts == 0 {
+		if *minHosts, err = envInt("PROMOTE_MIN_HOSTS", 5); err != nil {
+			return err
+		}
+	}
+	if *minScans == 0 {
+		if *minScans, err = envInt("PROMOTE_MIN_SCANS", 5); err != nil {
+			return err
+		}
+	}
+	if *minHosts < 1 || *minScans < 1 {
+		return usageErrorf("--min-hosts and --min-scans must be at least 1")
+	}
+	excluded := splitList(firstNonEmpty(*exclude, os.Getenv("PROMOTE_EXCLUDE")))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	candidates, err := findPromotionCandidates(tx, *minHosts, *minScans, excluded)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "PROMOTION\tSHA256\tPATH\tHOSTS\tSCANS")
+	actor := currentUsername()
+	promoted := 0
+	for _, c := range candidates {
+		var promotionID int64
+		err := tx.QueryRow(`
+			WITH promoted AS (
+				UPDATE files
+				SET status = 'verified'
+				WHERE id = $1 AND status = 'candidate'
+				RETURNING id
+			)
+			INSERT INTO promotions (file_id, filepath, old_status, new_status, reason, hosts, scans)
+			SELECT id, $2, 'candidate', 'verified', $3, $4, $5
+			FROM promoted
+			RETURNING id;
+		`, c.fileID, c.filepath, promotionReasonPrevalence, c.hosts, c.scans).Scan(&promotionID)
+		if err == sql.ErrNoRows {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error promoting %s: %v", c.filepath, err)
+		}
+		reason := fmt.Sprintf("%s: %d hosts, %d scans", promotionReasonPrevalence, c.hosts, c.scans)
+		err = history.Record(tx, c.fileID, "candidate", "verified", actor, history.PromotionSource(promotionID), reason)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\n", promotionID, c.sha256, c.filepath, c.hosts, c.scans)
+		promoted++
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	if err := opts.finish(db, tx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Promoted %d candidates seen on at least %d hosts across %d scans\n", promoted, *minHosts, *minScans)
+	return nil
+}
+
+func findPromotionCandidates(tx *sql.Tx, minHosts, minScans int, excluded []string) ([]promotionCandidate, error) {
+	rows, err := tx.Query(prevalentCandidates, minHosts, minScans)
+	if err != nil {
+		return nil, fmt.Errorf("error executing query: %v", err)
+	}
+	defer rows.Close()
+
+	var candidates []promotionCandidate
+	for rows.Next() {
+		var c promotionCandidate
+		if err := rows.Scan(&c.fileID, &c.sha256, &c.filepath, &c.hosts, &c.scans); err != nil {
+			return nil, fmt.Errorf("error checking query results: %v", err)
+		}
+		if hasPathPrefix(c.filepath, excluded) {
+			continue
+		}
+		candidates = append(candidates, c)
+	}
+	return candidates, rows.Err()
+}
+
+// runRevertPromotion restores the status a file had before it was
+// promoted, unless its status was changed again since.
+func runRevertPromotion(args []string) error {
+	fs := newFlagSet("revert-promotion")
+	opts := addDBFlags(fs)
+	since := fs.String("since", "", "revert every promotion made at or after this time")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if (*since == "") == (len(positional) == 0) {
+		return usageErrorf("expected either promotion IDs or --since")
+	}
+
+	var ids []int64
+	for _, arg := range positional {
+		id, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			return usageErrorf("invalid promotion ID %q", arg)
+		}
+		ids = append(ids, id)
+	}
+	sinceTime, err := parseTime(*since)
+	if err != nil {
+		return usageErrorf("invalid --since: %v", err)
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	query := `
+		WITH reverted AS (
+			UPDATE promotions
+			SET reverted_at = now()
+			WHERE reverted_at IS NULL AND %s
+			RETURNING id, file_id, old_status, new_status
+		), changed AS (
+			UPDATE files
+			SET status = reverted.old_status
+			FROM reverted
+			WHERE files.id = reverted.file_id AND files.status = reverted.new_status
+			RETURNING files.id, reverted.id AS promotion_id, reverted.new_status AS old_status, files.status AS new_status
+		)
+		INSERT INTO file_status_history (file_id, old_status, new_status, actor, source, reason)
+		SELECT id, old_status, new_status, $2, 'promotion:' || promotion_id, 'promotion reverted'
+		FROM changed;
+	`
+	var result sql.Result
+	if sinceTime != nil {
+		result, err = tx.Exec(fmt.Sprintf(query, "promoted_at >= $1"), *sinceTime, currentUsername())
+	} else {
+		result, err = tx.Exec(fmt.Sprintf(query, "id = ANY($1::bigint[])"), pq.Array(ids), currentUsername())
+	}
+	if err != nil {
+		return fmt.Errorf("error reverting promotions: %v", err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if err := opts.finish(db, tx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Reverted the status of %d files\n", affected)
+	return nil
+}
+
+func envInt(name string, fallback int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s %q: %v", name, value, err)
+	}
+	return n, nil
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func hasPathPrefix(path string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if path == prefix || strings.HasPrefix(path, strings.TrimSuffix(prefix, "/")+"/") {
+			return true
+		}
+	}
+	return false
+}
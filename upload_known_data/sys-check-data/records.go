@@ -0,0 +1,164 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"common/hashes"
+)
+
+type ScannedFiles struct {
+	Path string `json:"path"`
+	// Every known path when there is more than one, Path being the first.
+	Paths       []string   `json:"paths,omitempty"`
+	Size        *int64     `json:"size,omitempty"`
+	MD5         string     `json:"MD5"`
+	SHA1        string     `json:"SHA1"`
+	SHA256      string     `json:"SHA256"`
+	SHA512      string     `json:"SHA512"`
+	FileStatus  string     `json:"fileStatus,omitempty"`
+	Family      string     `json:"family,omitempty"`
+	Source      string     `json:"source,omitempty"`
+	FirstSeen   *time.Time `json:"firstSeen,omitempty"`
+	ThreatLabel string     `json:"threatLabel,omitempty"`
+	// Digests by algorithm, as in scan reports, for the algorithms
+	// without a field of their own.
+	Hashes map[string]string `json:"hashes,omitempty"`
+}
+
+var fileStatuses = []string{"verified", "candidate", "malicious"}
+
+func validStatus(status string, allowed ...string) bool {
+	if len(allowed) == 0 {
+		allowed = fileStatuses
+	}
+	for _, s := range allowed {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+func (file *ScannedFiles) setHash(hash string) error {
+	column, err := hashes.Column(hash)
+	if err != nil {
+		return err
+	}
+	switch column {
+	case "md5":
+		file.MD5 = hash
+	case "sha1":
+		file.SHA1 = hash
+	case "sha256":
+		file.SHA256 = hash
+	case "sha512":
+		file.SHA512 = hash
+	}
+	return nil
+}
+
+// validate checks and normalizes the hashes and details of a record.
+// Records with only fuzzy hashes are accepted with fuzzyOnly, as known
+// malware is compared with scanned files by similarity.
+func (file *ScannedFiles) validate(fuzzyOnly bool) error {
+	fields := map[string]*string{"MD5": &file.MD5, "SHA1": &file.SHA1, "SHA256": &file.SHA256, "SHA512": &file.SHA512}
+	for algorithm, field := range fields {
+		digest, ok := file.Hashes[algorithm]
+		if !ok {
+			continue
+		}
+		if *field != "" && !strings.EqualFold(*field, digest) {
+			return fmt.Errorf("%s %q and %q differ", algorithm, *field, digest)
+		}
+		*field = digest
+		delete(file.Hashes, algorithm)
+	}
+
+	found := false
+	for algorithm, digest := range file.Hashes {
+		normalized, err := hashes.Normalize(algorithm, digest)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", algorithm, err)
+		}
+		file.Hashes[algorithm] = normalized
+		// Files cannot be looked up by fuzzy hashes
+		found = found || fuzzyOnly || !hashes.Fuzzy(algorithm)
+	}
+
+	columns := []struct {
+		name, value, column string
+	}{
+		{"MD5", file.MD5, "md5"},
+		{"SHA1", file.SHA1, "sha1"},
+		{"SHA256", file.SHA256, "sha256"},
+		{"SHA512", file.SHA512, "sha512"},
+	}
+	for _, h := range columns {
+		if h.value == "" {
+			continue
+		}
+		found = true
+		column, err := hashes.Column(h.value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", h.name, err)
+		}
+		if column != h.column {
+			return fmt.Errorf("invalid %s: %q has the length of a %s hash", h.name, h.value, column)
+		}
+	}
+	if !found {
+		return fmt.Errorf("record has no hashes")
+	}
+	for _, path := range file.knownPaths() {
+		if len(path) > 4096 {
+			return fmt.Errorf("path is longer than 4096 characters")
+		}
+	}
+	if len(file.Family) > 128 {
+		return fmt.Errorf("family is longer than 128 characters")
+	}
+	if len(file.Source) > 128 {
+		return fmt.Errorf("source is longer than 128 characters")
+	}
+	if len(file.ThreatLabel) > 256 {
+		return fmt.Errorf("threat label is longer than 256 characters")
+	}
+	if file.Size != nil && *file.Size < 0 {
+		return fmt.Errorf("negative file size %d", *file.Size)
+	}
+	return nil
+}
+
+// knownPaths returns Path and Paths without duplicates.
+func (file *ScannedFiles) knownPaths() []string {
+	var paths []string
+	seen := make(map[string]bool)
+	for _, path := range append([]string{file.Path}, file.Paths...) {
+		if path != "" && !seen[path] {
+			seen[path] = true
+			paths = append(paths, path)
+		}
+	}
+	return paths
+}
+
+var timeLayouts = []string{
+	time.RFC3339,
+	"2006-01-02 15:04:05",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+func parseTime(value string) (*time.Time, error) {
+	if value == "" {
+		return nil, nil
+	}
+	for _, layout := range timeLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return &t, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid date %q", value)
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ed25519"
+	"database/sql"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"common/migrations"
+	"common/snapshot"
+)
+
+func runExportSnapshot(args []string) error {
+	fs := newFlagSet("export-snapshot")
+	opts := addDBFlags(fs)
+	keyPath := fs.String("key", "", "Ed25519 private key signing the snapshot (default SNAPSHOT_SIGNING_KEY)")
+	output := fs.String("output", "", "write to this file instead of standard output")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageErrorf("unexpected arguments %v", positional)
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *keyPath == "" {
+		*keyPath = os.Getenv("SNAPSHOT_SIGNING_KEY")
+	}
+	if *keyPath == "" {
+		return usageErrorf("--key or SNAPSHOT_SIGNING_KEY must name the signing key")
+	}
+	key, err := snapshot.LoadPrivateKey(*keyPath)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		out = file
+	}
+	writer := bufio.NewWriter(out)
+
+	header, err := exportSnapshot(db, key, writer)
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err != nil {
+		if *output != "" {
+			os.Remove(*output)
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "Exported snapshot of %d verified and %d malicious files at schema version %d\n",
+		header.Files["verified"], header.Files["malicious"], header.SchemaVersion)
+	return nil
+}
+
+// exportSnapshot writes every verified and malicious file as they were at
+// a single point in time.
+func exportSnapshot(db *sql.DB, key ed25519.PrivateKey, w io.Writer) (snapshot.Header, error) {
+	ctx := context.Background()
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return snapshot.Header{}, err
+	}
+	defer tx.Rollback()
+
+	version, err := migrations.Version(tx)
+	if err != nil {
+		return snapshot.Header{}, err
+	}
+	header := snapshot.Header{CreatedAt: time.Now().UTC(), SchemaVersion: version}
+
+	return snapshot.Write(w, key, header, func(add func(snapshot.Entry) error) error {
+		rows, err := tx.Query(`
+			SELECT ` + fileColumns + `
+			FROM files f
+			WHERE f.status IN ('verified', 'malicious')
+			ORDER BY f.id;
+		`)
+		if err != nil {
+			return fmt.Errorf("error executing query: %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			file, err := scanFile(rows)
+			if err != nil {
+				return err
+			}
+			err = add(snapshot.Entry{
+				MD5:         file.MD5,
+				SHA1:        file.SHA1,
+				SHA256:      file.SHA256,
+				SHA512:      file.SHA512,
+				Other:       file.Hashes,
+				Status:      file.FileStatus,
+				Family:      file.Family,
+				Source:      file.Source,
+				FirstSeen:   file.FirstSeen,
+				ThreatLabel: file.ThreatLabel,
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+func runSnapshotKey(args []string) error {
+	fs := newFlagSet("snapshot-key")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageErrorf("expected a private and a public key file")
+	}
+	for _, path := range positional {
+		if _, err := os.Stat(path); err == nil {
+			return fmt.Errorf("%s already exists", path)
+		}
+	}
+	if err := snapshot.GenerateKey(positional[0], positional[1]); err != nil {
+		return err
+	}
+	fmt.Printf("Wrote the signing key to %s and the public key to %s\n", positional[0], positional[1])
+	return nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	exitOK      = 0
+	exitFailure = 1
+	exitUsage   = 2
+)
+
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(args []string) error
+}
+
+var commands []command
+
+func init() {
+	commands = []command{
+		{"migrate", "migrate up|status [flags]", "create or upgrade the database schema, or show its version", runMigrate},
+		{"import", "import nsrl|json|csv|hashlist|clamav [--status verified|malicious] [flags] <file>", "import known file data into the files table", runImport},
+		{"export", "export [--status <status>] [--output <file>] [flags]", "export the files table as a JSON data file", runExport},
+		{"export-snapshot", "export-snapshot [--key <private key>] [--output <file>] [flags]", "export a signed snapshot of the verified and malicious files for offline analysis", runExportSnapshot},
+		{"snapshot-key", "snapshot-key <private key file> <public key file>", "generate a key pair for signing snapshots", runSnapshotKey},
+		{"stats", "stats [flags]", "show file counts per status", runStats},
+		{"lookup", "lookup [flags] <hash>", "show every entry matching a hash", runLookup},
+		{"history", "history [flags] <hash>", "show who changed the status of the entries matching a hash, and why", runHistory},
+		{"set-status", "set-status [--comment <text>] [flags] <hash> <status>", "change the status of the entries matching a hash", runSetStatus},
+		{"promote", "promote [--min-hosts <n>] [--min-scans <n>] [--exclude <prefixes>] [flags]", "mark candidates seen on many hosts as verified", runPromote},
+		{"revert-promotion", "revert-promotion [--since <time>] [flags] [<promotion id>...]", "undo promotions made by promote", runRevertPromotion},
+		{"views", "views status|refresh [flags]", "show how fresh the materialized views are, or refresh them", runViews},
+		{"candidates", "candidates [--prefix <path>] [--scan <scan id>] [--limit <n>] [--json] [flags]", "list candidates awaiting review with their prevalence", runCandidates},
+		{"decide", "decide [--reviewer <name>] [--comment <text>] [flags] <hash> verified|malicious", "record a review decision for a file", runDecide},
+		{"decide-prefix", "decide-prefix --scan <scan id> [--reviewer <name>] [--comment <text>] [flags] <path prefix> verified|malicious", "record a review decision for every candidate under a path", runDecidePrefix},
+	}
+}
+
+type usageError struct {
+	msg string
+}
+
+func (e *usageError) Error() string {
+	return e.msg
+}
+
+func usageErrorf(format string, args ...interface{}) error {
+	return &usageError{msg: fmt.Sprintf(format, args...)}
+}
+
+func main() {
+	os.Exit(run(os.Args[1:]))
+}
+
+func run(args []string) int {
+	if len(args) < 1 || args[0] == "help" || args[0] == "-h" || args[0] == "--help" {
+		printUsage()
+		if len(args) < 1 {
+			return exitUsage
+		}
+		return exitOK
+	}
+
+	cmd := findCommand(args[0])
+	if cmd == nil {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n", args[0])
+		printUsage()
+		return exitUsage
+	}
+
+	err := cmd.run(args[1:])
+	if err == nil {
+		return exitOK
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+
+	var usageErr *usageError
+	if errors.As(err, &usageErr) {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		fmt.Fprintln(os.Stderr, "usage: sys-check-data", cmd.usage)
+		return exitUsage
+	}
+
+	fmt.Fprintln(os.Stderr, "error:", err)
+	return exitFailure
+}
+
+func findCommand(name string) *command {
+	for i := range commands {
+		if commands[i].name == name {
+			return &commands[i]
+		}
+	}
+	return nil
+}
+
+func printUsage() {
+	var b strings.Builder
+	b.WriteString("Usage: sys-check-data <command> [arguments]\n\nCommands:\n")
+	for _, cmd := range commands {
+		fmt.Fprintf(&b, "  %-17s %s\n", cmd.name, cmd.summary)
+	}
+	b.WriteString("\nShared flags:\n")
+	fs := flag.NewFlagSet("shared", flag.ContinueOnError)
+	fs.SetOutput(&b)
+	addDBFlags(fs)
+	fs.PrintDefaults()
+	b.WriteString("\nExit codes: 0 success, 1 failure, 2 usage error\n")
+	fmt.Fprint(os.Stderr, b.String())
+}
+
+// parseArgs parses flags that may appear before, between or after the
+// positional arguments and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			if errors.Is(err, flag.ErrHelp) {
+				printCommandUsage(fs)
+				return nil, err
+			}
+			return nil, &usageError{msg: err.Error()}
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func newFlagSet(name string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func printCommandUsage(fs *flag.FlagSet) {
+	name := strings.Fields(fs.Name())[0]
+	if cmd := findCommand(name); cmd != nil {
+		fmt.Fprintln(os.Stderr, "usage: sys-check-data", cmd.usage)
+	}
+	fs.SetOutput(os.Stderr)
+	fs.PrintDefaults()
+	fs.SetOutput(io.Discard)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"common/triage"
+)
+
+func runCandidates(args []string) error {
+	fs := newFlagSet("candidates")
+	opts := addDBFlags(fs)
+	var filter triage.Filter
+	fs.StringVar(&filter.Prefix, "prefix", "", "only list candidates found under this path")
+	fs.StringVar(&filter.ScanID, "scan", "", "only list candidates found in this scan")
+	fs.IntVar(&filter.Limit, "limit", 100, "maximum number of candidates to list")
+	asJSON := fs.Bool("json", false, "print candidates as JSON")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 0 {
+		return usageErrorf("unexpected arguments %v", positional)
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	candidates, err := triage.ListCandidates(db, filter)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(candidates)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "HASH\tHOSTS\tSCANS\tPATHS")
+	for _, c := range candidates {
+		paths := c.Paths
+		if len(paths) == 0 {
+			paths = c.KnownPaths
+		}
+		fmt.Fprintf(w, "%s\t%d\t%d\t%s\n", firstNonEmpty(c.SHA256, c.SHA1, c.MD5, c.SHA512), c.Hosts, c.Scans, strings.Join(paths, " "))
+	}
+	return w.Flush()
+}
+
+func runDecide(args []string) error {
+	fs := newFlagSet("decide")
+	opts := addDBFlags(fs)
+	decision := addDecisionFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageErrorf("expected a hash and a status")
+	}
+	hash := positional[0]
+	decision.Status = positional[1]
+
+	return applyDecision(opts, func(tx *sql.Tx) (int64, error) {
+		return triage.Decide(tx, hash, *decision)
+	})
+}
+
+func runDecidePrefix(args []string) error {
+	fs := newFlagSet("decide-prefix")
+	opts := addDBFlags(fs)
+	decision := addDecisionFlags(fs)
+	scanID := fs.String("scan", "", "scan in which the candidates were found")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 2 {
+		return usageErrorf("expected a path prefix and a status")
+	}
+	if *scanID == "" {
+		return usageErrorf("--scan is required")
+	}
+	prefix := positional[0]
+	decision.Status = positional[1]
+
+	return applyDecision(opts, func(tx *sql.Tx) (int64, error) {
+		return triage.DecidePrefix(tx, prefix, *scanID, *decision)
+	})
+}
+
+func addDecisionFlags(fs *flag.FlagSet) *triage.Decision {
+	decision := &triage.Decision{}
+	fs.StringVar(&decision.Reviewer, "reviewer", currentUsername(), "name of the reviewer making the decision")
+	fs.StringVar(&decision.Comment, "comment", "", "reason for the decision")
+	return decision
+}
+
+// applyDecision runs decide in a transaction.
+func applyDecision(opts *dbOptions, decide func(tx *sql.Tx) (int64, error)) error {
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	changed, err := decide(tx)
+	if errors.Is(err, triage.ErrInvalidDecision) {
+		return usageErrorf("%v", err)
+	}
+	if err != nil {
+		return err
+	}
+	if err := opts.finish(db, tx); err != nil {
+		return err
+	}
+
+	fmt.Printf("Changed the status of %d files\n", changed)
+	return nil
+}
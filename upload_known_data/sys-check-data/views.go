@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"common/views"
+)
+
+func runViews(args []string) error {
+	fs := newFlagSet("views")
+	opts := addDBFlags(fs)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(positional) != 1 || (positional[0] != "status" && positional[0] != "refresh") {
+		return usageErrorf("expected status or refresh")
+	}
+
+	db, err := opts.open()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if positional[0] == "refresh" {
+		if opts.dryRun {
+			return usageErrorf("-dry-run is not supported by views refresh")
+		}
+		refreshed, err := views.RefreshAll(db)
+		if err != nil {
+			return err
+		}
+		if refreshed == nil {
+			return fmt.Errorf("the views are being refreshed by another process")
+		}
+		fmt.Println("Refreshed views:", strings.Join(refreshed, ", "))
+	}
+
+	status, err := views.Status(db)
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "VIEW\tROWS\tREFRESHED\tCHANGES SINCE\tSTATE")
+	for _, f := range status {
+		refreshed := "never"
+		if f.RefreshedAt != nil {
+			refreshed = fmt.Sprintf("%s (%s ago)", f.RefreshedAt.Format(time.RFC3339), time.Since(*f.RefreshedAt).Round(time.Second))
+		}
+		state := "fresh"
+		if f.Pending() {
+			state = "refresh pending"
+		} else if f.Stale() {
+			state = "stale"
+		}
+		fmt.Fprintf(w, "%s\t%d\t%s\t%d\t%s\n", f.View, f.Rows, refreshed, f.Changes, state)
+	}
+	return w.Flush()
+}
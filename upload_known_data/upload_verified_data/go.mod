@@ -1,8 +0,0 @@
-module upload_verified_data
-
-go 1.19
-
-require (
-	github.com/joho/godotenv v1.5.1
-	github.com/lib/pq v1.10.9
-)